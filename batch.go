@@ -0,0 +1,209 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+/*
+A function that handles a group of messages at once.
+
+Returning nil acks the whole batch. Returning a *BatchError acks the
+batch except for the failed messages, which are nacked following the
+queue's failure policy. Any other error nacks the whole batch.
+*/
+type BatchHandler func(ctx context.Context, msgs []*Message) error
+
+/*
+Reports which messages in a batch failed.
+*/
+type BatchError struct {
+	Failed []*Message
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d messages in batch failed: %v", len(e.Failed), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BatchError) failed(msg *Message) bool {
+	for _, m := range e.Failed {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Binds a BatchHandler to the configured queues.
+
+Messages are collected until the queue's batch_size is reached, or
+batch_timeout has passed since the first message in the batch arrived.
+A successful batch is acked with a single multiple ack. When a paused
+queue is resumed, its next batch waits for the batch that was being
+handled to be settled.
+*/
+func (c *Consumer) ConsumeBatch(handler BatchHandler) (err error) {
+	c.batch = handler
+	// Circuit breaker probes handle a single message.
+	return c.consume(func(ctx context.Context, msg *Message) error {
+		err := handler(ctx, []*Message{msg})
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) && !batchErr.failed(msg) {
+			return nil
+		}
+		return err
+	}, true)
+}
+
+/*
+Collect deliveries into batches - run inside a separate goroutine
+*/
+func (c *Consumer) processBatch(q queue, handler BatchHandler, messages <-chan amqp.Delivery) {
+	limiter := c.limiters[q.name]
+	batch := make([]*Message, 0, q.batchSize)
+	var timeout <-chan time.Time
+
+	flush := func() {
+		if len(batch) > 0 {
+			err := c.handleBatch(q, handler, batch)
+			c.observe(q, err)
+		}
+		batch = make([]*Message, 0, q.batchSize)
+		timeout = nil
+	}
+
+	for {
+		select {
+		case rawMsg, ok := <-messages:
+			if !ok {
+				flush()
+				c.stopped(q, messages)
+				return
+			}
+			limiter.wait(context.Background())
+			batch = append(batch, c.receive(q, rawMsg))
+			if len(batch) == 1 {
+				timeout = time.After(q.batchTimeout)
+			}
+			if len(batch) >= q.batchSize {
+				flush()
+			}
+		case <-timeout:
+			flush()
+		}
+	}
+}
+
+/*
+Run the handler for a batch and settle its messages.
+
+Each message is handled in its own span, which records the
+error if the message failed and ends once the batch is settled.
+*/
+func (c *Consumer) handleBatch(q queue, handler BatchHandler, batch []*Message) (err error) {
+	spans := make([]Span, len(batch))
+	for i, msg := range batch {
+		_, spans[i] = c.startSpan(context.Background(), q, msg)
+	}
+	defer func() {
+		var batchErr *BatchError
+		isBatchErr := errors.As(err, &batchErr)
+		for i, span := range spans {
+			if isBatchErr && batchErr.failed(batch[i]) {
+				span.SetError(batchErr.Err)
+			} else if err != nil && !isBatchErr {
+				span.SetError(err)
+			}
+			span.End()
+		}
+	}()
+
+	ctx := context.Background()
+	if q.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.handlerTimeout)
+		defer cancel()
+	}
+
+	for range batch {
+		c.metrics.handlerStarted(q.name)
+	}
+	start := time.Now()
+	err = handler(ctx, batch)
+	for range batch {
+		c.metrics.handlerFinished(q.name, time.Since(start))
+	}
+
+	c.settleBatch(q, batch, err)
+	return err
+}
+
+func (c *Consumer) settleBatch(q queue, batch []*Message, err error) {
+	last := batch[len(batch)-1]
+	fields := []interface{}{
+		"queue", q.name,
+		"batch_size", len(batch),
+		"delivery_tag", last.DeliveryTag,
+	}
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		c.log().Error("Batch partially failed", append(fields, "failed", len(batchErr.Failed), "error", err)...)
+		c.status.failed(q.name, err)
+		for _, msg := range batch {
+			if batchErr.failed(msg) {
+				c.fail(q, msg)
+			} else if !msg.Settled() {
+				msg.Ack(false)
+			}
+		}
+		return
+	}
+
+	if err != nil {
+		c.log().Error("Batch failed", append(fields, "error", err, "requeue", q.requeue)...)
+		c.status.failed(q.name, err)
+	}
+	if !anySettled(batch) {
+		// Every message in the batch is unsettled, so one
+		// multiple ack or nack on the last covers them all.
+		for _, msg := range batch[:len(batch)-1] {
+			msg.settle()
+		}
+		// Metrics count the multiple ack or nack once, so add the rest of the batch.
+		rest := float64(len(batch) - 1)
+		if err != nil {
+			last.Nack(true, q.requeue)
+			c.metrics.add(metricNacked, q.name, rest)
+		} else {
+			last.Ack(true)
+			c.metrics.add(metricAcked, q.name, rest)
+		}
+		return
+	}
+	for _, msg := range batch {
+		if err != nil {
+			c.fail(q, msg)
+		} else if !msg.Settled() {
+			msg.Ack(false)
+		}
+	}
+}
+
+func anySettled(batch []*Message) bool {
+	for _, msg := range batch {
+		if msg.Settled() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBatch(r *ackRecorder, size int) []*Message {
+	var batch []*Message
+	for i := 1; i <= size; i++ {
+		batch = append(batch, newTestMessage(r, uint64(i)))
+	}
+	return batch
+}
+
+func TestSettleBatchSuccess(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	batch := newBatch(r, 3)
+	c.settleBatch(queue{name: "test"}, batch, nil)
+
+	if len(r.acks) != 1 || r.acks[0] != 3 || !r.multiple {
+		t.Errorf("Batch should be acked with one multiple ack. Got %v", r.acks)
+	}
+	for _, msg := range batch {
+		if !msg.Settled() {
+			t.Error("Every message should be settled")
+		}
+	}
+}
+
+func TestSettleBatchFailure(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	c.settleBatch(queue{name: "test", requeue: true}, newBatch(r, 3), errors.New("boom"))
+
+	if len(r.nacks) != 1 || r.nacks[0] != 3 || !r.multiple || !r.requeue {
+		t.Errorf("Batch should be nacked with one multiple nack. Got %v", r.nacks)
+	}
+}
+
+func TestSettleBatchMetrics(t *testing.T) {
+	m := newMetrics()
+	c := &Consumer{metrics: m, logger: NopLogger()}
+	q := queue{name: "test", requeue: true}
+	batch := func(first uint64) []*Message {
+		var msgs []*Message
+		for tag := first; tag < first+3; tag++ {
+			msgs = append(msgs, newMessage(q, m.received(q.name, amqp.Delivery{Acknowledger: &ackRecorder{}, DeliveryTag: tag})))
+		}
+		return msgs
+	}
+	c.settleBatch(q, batch(1), nil)
+	c.settleBatch(q, batch(4), errors.New("boom"))
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`consumer_messages_acked_total{queue="test"} 3`,
+		`consumer_messages_nacked_total{queue="test"} 3`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Missing %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestSettleBatchPartialFailure(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	batch := newBatch(r, 3)
+	err := &BatchError{Failed: []*Message{batch[1]}, Err: errors.New("duplicate key")}
+	c.settleBatch(queue{name: "test", requeue: true}, batch, err)
+
+	if len(r.acks) != 2 || r.acks[0] != 1 || r.acks[1] != 3 {
+		t.Errorf("Successful messages should be acked. Got %v", r.acks)
+	}
+	if len(r.nacks) != 1 || r.nacks[0] != 2 {
+		t.Errorf("Only the failed message should be nacked. Got %v", r.nacks)
+	}
+}
+
+func TestSettleBatchAlreadySettled(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	batch := newBatch(r, 3)
+	batch[0].Reject(false)
+	c.settleBatch(queue{name: "test"}, batch, nil)
+
+	if len(r.acks) != 2 || r.multiple {
+		t.Errorf("Remaining messages should be acked one at a time. Got %v", r.acks)
+	}
+}
+
+func TestProcessBatch(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	q := queue{name: "test", batchSize: 2, batchTimeout: 20 * time.Millisecond}
+
+	var mu sync.Mutex
+	var sizes []int
+	handler := func(ctx context.Context, msgs []*Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, len(msgs))
+		return nil
+	}
+
+	messages := make(chan amqp.Delivery)
+	done := make(chan bool)
+	go func() {
+		c.processBatch(q, handler, messages)
+		close(done)
+	}()
+	for i := 1; i <= 3; i++ {
+		messages <- amqp.Delivery{Acknowledger: r, DeliveryTag: uint64(i)}
+	}
+	time.Sleep(50 * time.Millisecond)
+	messages <- amqp.Delivery{Acknowledger: r, DeliveryTag: 4}
+	close(messages)
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 1 || sizes[2] != 1 {
+		t.Errorf("Batches should flush on size, timeout and close. Got %v", sizes)
+	}
+}
+
+func TestBatchErrorFailed(t *testing.T) {
+	msgs := newBatch(&ackRecorder{}, 2)
+	err := &BatchError{Failed: msgs[:1]}
+	if !err.failed(msgs[0]) || err.failed(msgs[1]) {
+		t.Error("failed is wrong")
+	}
+}
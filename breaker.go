@@ -0,0 +1,204 @@
+package consumer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+The states of a queue's circuit breaker.
+*/
+type BreakerState int
+
+const (
+	// Messages are consumed normally.
+	BreakerClosed BreakerState = iota
+	// Too many handlers failed and the queue is paused.
+	BreakerOpen
+	// The cooldown has passed and a single message is being tried.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+/*
+Counts handler failures for a queue and decides when to stop consuming.
+
+The breaker opens once threshold failures happen within window.
+After cooldown it goes half-open so a single message can be tried.
+That message closes the breaker if it succeeds, or opens it again
+if it fails.
+*/
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures []time.Time
+	now      func() time.Time
+}
+
+func newBreakers(top topology) map[string]*breaker {
+	breakers := make(map[string]*breaker)
+	for _, bind := range top.Bindings() {
+		q := bind.Queue()
+		if q.breakerThreshold > 0 {
+			breakers[q.name] = &breaker{
+				threshold: q.breakerThreshold,
+				window:    q.breakerWindow,
+				cooldown:  q.breakerCooldown,
+				now:       time.Now,
+			}
+		}
+	}
+	return breakers
+}
+
+/*
+Record a handler outcome, returning the previous and new state.
+*/
+func (b *breaker) record(failed bool) (from, to BreakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from = b.state
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.state = BreakerOpen
+		} else {
+			b.state = BreakerClosed
+			b.failures = nil
+		}
+	case BreakerClosed:
+		if !failed {
+			break
+		}
+		now := b.now()
+		recent := b.failures[:0]
+		for _, at := range b.failures {
+			if now.Sub(at) < b.window {
+				recent = append(recent, at)
+			}
+		}
+		b.failures = append(recent, now)
+		if len(b.failures) >= b.threshold {
+			b.state = BreakerOpen
+		}
+	}
+	return from, b.state
+}
+
+/*
+Move an open breaker to half-open so it can be probed.
+*/
+func (b *breaker) halfOpen() (from, to BreakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from = b.state
+	if b.state == BreakerOpen {
+		b.state = BreakerHalfOpen
+	}
+	return from, b.state
+}
+
+/*
+Register a function to be called when a queue's circuit breaker changes state.
+*/
+func (c *Consumer) OnBreakerStateChange(fn func(queue string, from, to BreakerState)) {
+	c.onBreaker = fn
+}
+
+/*
+Feed a handler outcome to the queue's breaker.
+
+Decode failures are problems with the message rather than
+the handler's dependencies, so they aren't counted.
+*/
+func (c *Consumer) observe(q queue, err error) {
+	b := c.breakers[q.name]
+	if b == nil {
+		return
+	}
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		return
+	}
+	from, to := b.record(err != nil)
+	c.breakerChanged(q, from, to)
+	if from == BreakerClosed && to == BreakerOpen {
+		err := c.pause(q.name, pausedByBreaker)
+		if err != nil {
+			c.log().Error("Could not pause queue for open breaker", "queue", q.name, "error", err)
+		}
+		c.scheduleProbe(q, b)
+	}
+}
+
+func (c *Consumer) scheduleProbe(q queue, b *breaker) {
+	time.AfterFunc(b.cooldown, func() {
+		c.probe(q, b)
+	})
+}
+
+/*
+Try a single message with the breaker half-open, then either
+resume the queue or wait for another cooldown. Queues paused
+with Pause while the breaker was open stay paused.
+*/
+func (c *Consumer) probe(q queue, b *breaker) {
+	from, to := b.halfOpen()
+	c.breakerChanged(q, from, to)
+
+	c.mu.Lock()
+	channel, handler, autoAck := c.channels[q.name], c.handler, c.autoAck
+	c.mu.Unlock()
+	if channel == nil {
+		return
+	}
+
+	rawMsg, ok, err := channel.Get(q.name, false)
+	if err != nil || !ok {
+		if err != nil {
+			c.log().Error("Could not get probe message", "queue", q.name, "error", err)
+		}
+		c.scheduleProbe(q, b)
+		return
+	}
+
+	err = c.deliver(q, handler, autoAck, rawMsg)
+	from, to = b.record(err != nil)
+	c.breakerChanged(q, from, to)
+	if to == BreakerClosed {
+		err = c.resume(q.name, pausedByBreaker)
+		if err != nil {
+			c.log().Error("Could not resume queue for closed breaker", "queue", q.name, "error", err)
+		}
+		return
+	}
+	c.scheduleProbe(q, b)
+}
+
+func (c *Consumer) breakerChanged(q queue, from, to BreakerState) {
+	if from == to {
+		return
+	}
+	c.log().Warn("Circuit breaker changed state", "queue", q.name, "from", from, "to", to)
+	c.metrics.breakerState(q.name, to)
+	if c.onBreaker != nil {
+		c.onBreaker(q.name, from, to)
+	}
+}
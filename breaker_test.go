@@ -0,0 +1,125 @@
+package consumer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(now *time.Time) *breaker {
+	return &breaker{
+		threshold: 3,
+		window:    time.Minute,
+		cooldown:  time.Second,
+		now: func() time.Time {
+			return *now
+		},
+	}
+}
+
+func TestBreakerOpensOnThreshold(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	if b.state != BreakerClosed {
+		t.Error("Breaker should stay closed under the threshold")
+	}
+	from, to := b.record(true)
+	if from != BreakerClosed || to != BreakerOpen {
+		t.Errorf("Breaker should open. Got %s -> %s", from, to)
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	b.record(true)
+	b.record(true)
+	now = now.Add(2 * time.Minute)
+	_, to := b.record(true)
+	if to != BreakerClosed {
+		t.Error("Failures outside the window should not count")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	if _, to := b.halfOpen(); to != BreakerClosed {
+		t.Error("Closed breakers should not go half-open")
+	}
+	b.state = BreakerOpen
+	if _, to := b.halfOpen(); to != BreakerHalfOpen {
+		t.Error("Open breakers should go half-open")
+	}
+	if _, to := b.record(true); to != BreakerOpen {
+		t.Error("A failed probe should open the breaker")
+	}
+	b.halfOpen()
+	if _, to := b.record(false); to != BreakerClosed {
+		t.Error("A successful probe should close the breaker")
+	}
+	if len(b.failures) != 0 {
+		t.Error("Closing should forget old failures")
+	}
+}
+
+func TestBreakerStateString(t *testing.T) {
+	if BreakerHalfOpen.String() != "half-open" {
+		t.Error("String is wrong")
+	}
+}
+
+func TestNewQueueBreakerOptions(t *testing.T) {
+	ini := `
+[queue]
+name = test
+breaker_failure_threshold = 5
+breaker_window = 10s
+`
+	q, err := newQueue(newConfig(ini), "queue")
+	if err != nil {
+		t.Error("Should not make an error")
+	}
+	if q.breakerThreshold != 5 || q.breakerWindow != 10*time.Second {
+		t.Error("Breaker options are wrong")
+	}
+	if q.breakerCooldown != 30*time.Second {
+		t.Error("breaker_cooldown should default to 30s")
+	}
+}
+
+func TestObserveTripsBreaker(t *testing.T) {
+	q := queue{name: "orders"}
+	now := time.Now()
+	b := newTestBreaker(&now)
+	b.cooldown = time.Hour
+	var changes []BreakerState
+	c := &Consumer{
+		logger:   NopLogger(),
+		metrics:  newMetrics(),
+		breakers: map[string]*breaker{"orders": b},
+	}
+	c.OnBreakerStateChange(func(queue string, from, to BreakerState) {
+		changes = append(changes, to)
+	})
+
+	decodeErr := &DecodeError{Err: errors.New("bad json")}
+	for i := 0; i < 5; i++ {
+		c.observe(q, decodeErr)
+	}
+	if len(changes) != 0 {
+		t.Error("Decode failures should not trip the breaker")
+	}
+	for i := 0; i < 3; i++ {
+		c.observe(q, errors.New("database down"))
+	}
+	if len(changes) != 1 || changes[0] != BreakerOpen {
+		t.Errorf("Breaker should open once. Got %v", changes)
+	}
+	if c.metrics.values[metricBreakerState]["orders"] != 1 {
+		t.Error("Breaker state gauge should be updated")
+	}
+}
@@ -0,0 +1,83 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+)
+
+/*
+A connection to a message broker.
+
+Connections made by DialAMQP satisfy it, as do fakes such as
+the in-memory broker in the consumertest package.
+*/
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+/*
+The channel methods used by this package. *amqp.Channel satisfies it.
+*/
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+/*
+Connects to the broker at an AMQP URL.
+*/
+type Dialer func(url string) (Broker, error)
+
+/*
+Connect to a RabbitMQ server. The default Dialer.
+*/
+func DialAMQP(url string) (Broker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return amqpBroker{conn}, nil
+}
+
+type amqpBroker struct {
+	*amqp.Connection
+}
+
+func (b amqpBroker) Channel() (Channel, error) {
+	channel, err := b.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+/*
+Connect to brokers with d instead of DialAMQP.
+Useful for connecting to a fake broker in tests.
+*/
+func WithDialer(d Dialer) Option {
+	return func(o *options) {
+		o.dial = d
+	}
+}
+
+func dialerOrDefault(d Dialer) Dialer {
+	if d == nil {
+		return DialAMQP
+	}
+	return d
+}
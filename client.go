@@ -0,0 +1,351 @@
+package consumer
+
+import (
+	"code.google.com/p/goconf/conf"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"sync"
+)
+
+/*
+RabbitMQ's pseudo queue for direct reply-to.
+*/
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+/*
+Returned when calling on a closed client, or when the
+connection closes before a reply arrives.
+*/
+var ErrClientClosed = errors.New("Client is closed.")
+
+/*
+Returned, wrapped with the broker's reason, when a request can't
+be routed to any queue so no responder will ever reply.
+*/
+var ErrCallReturned = errors.New("Request was returned by the broker.")
+
+/*
+Makes RPC calls to consumers using ConsumeRPC.
+
+Replies are received on RabbitMQ's direct reply-to queue when it is
+available, or on a private exclusive queue otherwise. A Client is safe
+to use from multiple goroutines and supports many calls in flight.
+*/
+type Client struct {
+	conn       connection
+	dial       Dialer
+	amqpConn   Broker
+	channel    Channel
+	replyQueue string
+	replies    *replyTracker
+	closed     bool
+	mu         sync.Mutex
+	logger     Logger
+
+	propagators []Propagator
+}
+
+/*
+Create a new RPC client using the connection settings in the
+provided configuration file.
+*/
+func CreateClient(configFile string, opts ...Option) (c *Client, err error) {
+	o := newOptions(opts)
+	o.logger.Info("Creating new client", "config", configFile)
+
+	config, err := conf.ReadConfigFile(configFile)
+	if err != nil {
+		return
+	}
+	conn, err := newConnection(config)
+	if err != nil {
+		return
+	}
+	c = &Client{conn: conn, dial: o.dial, logger: o.logger, propagators: o.propagators}
+	return
+}
+
+/*
+Connect to the AMQP server and start consuming replies.
+
+If the broker closes the reply channel, calls in flight return
+ErrClientClosed and the next call reconnects.
+*/
+func (c *Client) Connect() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	if c.channel != nil {
+		return
+	}
+
+	conn, err := dialerOrDefault(c.dial)(c.conn.Url())
+	if err != nil {
+		return
+	}
+	logger := loggerOrDefault(c.logger)
+	channel, queue, replies, err := consumeReplies(conn, logger)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	c.amqpConn = conn
+	c.channel = channel
+	c.replyQueue = queue
+	c.replies = newReplyTracker(logger)
+	go c.replies.listen(replies)
+	go c.replies.listenReturns(channel.NotifyReturn(make(chan amqp.Return, 16)))
+	go c.watchChannel(channel, channel.NotifyClose(make(chan *amqp.Error, 1)))
+	return
+}
+
+/*
+Drop the connection once the broker closes the reply channel,
+failing the calls waiting on it.
+*/
+func (c *Client) watchChannel(channel Channel, closed <-chan *amqp.Error) {
+	err, ok := <-closed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channel != channel {
+		return
+	}
+	if ok && err != nil {
+		loggerOrDefault(c.logger).Warn("Client channel closed", "error", err)
+	}
+	c.channel = nil
+	c.replies.close()
+	c.amqpConn.Close()
+}
+
+/*
+Start consuming from the direct reply-to queue, falling back to
+a private exclusive queue on brokers that don't support it.
+*/
+func consumeReplies(conn Broker, logger Logger) (Channel, string, <-chan amqp.Delivery, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	replies, err := channel.Consume(directReplyTo, "", true, true, false, false, nil)
+	if err == nil {
+		return channel, directReplyTo, replies, nil
+	}
+	logger.Warn("Direct reply-to unavailable, using a private queue", "error", err)
+
+	// A failed consume closes the channel, so start over with a new one.
+	channel, err = conn.Channel()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	q, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	replies, err = channel.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return channel, q.Name, replies, nil
+}
+
+/*
+Publish body to exchange with routingKey and wait for the reply.
+
+If the responder fails, the returned error is an *RPCError. Requests
+are published as mandatory, so one that no queue is bound to receive
+fails with ErrCallReturned straight away. The call gives up when ctx
+is done.
+*/
+func (c *Client) Call(ctx context.Context, exchange, routingKey string, body []byte) (*Message, error) {
+	err := c.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newCorrelationId()
+	if err != nil {
+		return nil, err
+	}
+	// Direct reply-to requires publishing on the consuming channel.
+	c.mu.Lock()
+	if c.channel == nil {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	replies := c.replies
+	done := replies.add(id)
+	err = c.channel.Publish(exchange, routingKey, true, false, Publishing{
+		Headers:       inject(ctx, c.propagators, nil),
+		CorrelationId: id,
+		ReplyTo:       c.replyQueue,
+		Body:          body,
+	})
+	c.mu.Unlock()
+	if err != nil {
+		replies.forget(id)
+		return nil, err
+	}
+
+	select {
+	case r, ok := <-done:
+		if !ok {
+			return nil, ErrClientClosed
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		msg := r.msg
+		if rpcErr := rpcErrorFrom(msg); rpcErr != nil {
+			return msg, rpcErr
+		}
+		return msg, nil
+	case <-ctx.Done():
+		replies.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+/*
+Close the client's connection. Calls in flight, and any
+made afterwards, return ErrClientClosed.
+*/
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.channel == nil {
+		return nil
+	}
+	c.channel = nil
+	c.replies.close()
+	return c.amqpConn.Close()
+}
+
+/*
+Get the error a responder sent, if any.
+*/
+func rpcErrorFrom(msg *Message) *RPCError {
+	if msg.Headers[RPCErrorHeader] != true {
+		return nil
+	}
+	var body rpcErrorBody
+	if err := json.Unmarshal(msg.Body, &body); err != nil || body.Error == nil {
+		return &RPCError{Message: "Responder failed with an unreadable error."}
+	}
+	return body.Error
+}
+
+func newCorrelationId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*
+The outcome of a call, either a reply or the reason
+the broker returned the request.
+*/
+type reply struct {
+	msg *Message
+	err error
+}
+
+/*
+Matches replies to the calls waiting on them by correlation id.
+*/
+type replyTracker struct {
+	mu      sync.Mutex
+	pending map[string]chan reply
+	closed  bool
+	logger  Logger
+}
+
+func newReplyTracker(logger Logger) *replyTracker {
+	return &replyTracker{pending: make(map[string]chan reply), logger: logger}
+}
+
+func (t *replyTracker) add(id string) chan reply {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	done := make(chan reply, 1)
+	if t.closed {
+		close(done)
+		return done
+	}
+	t.pending[id] = done
+	return done
+}
+
+func (t *replyTracker) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, id)
+}
+
+func (t *replyTracker) resolve(msg *Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	done, ok := t.pending[msg.CorrelationId]
+	if !ok {
+		t.logger.Warn("Dropping reply with unknown correlation id", "correlation_id", msg.CorrelationId)
+		return
+	}
+	done <- reply{msg: msg}
+	delete(t.pending, msg.CorrelationId)
+}
+
+/*
+Fail the call whose request the broker returned.
+*/
+func (t *replyTracker) returned(r amqp.Return) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	done, ok := t.pending[r.CorrelationId]
+	if !ok {
+		return
+	}
+	done <- reply{err: fmt.Errorf("%w Got %d %s from exchange %q with routing key %q.",
+		ErrCallReturned, r.ReplyCode, r.ReplyText, r.Exchange, r.RoutingKey)}
+	delete(t.pending, r.CorrelationId)
+}
+
+func (t *replyTracker) listenReturns(returns <-chan amqp.Return) {
+	for r := range returns {
+		t.returned(r)
+	}
+}
+
+func (t *replyTracker) listen(replies <-chan amqp.Delivery) {
+	for d := range replies {
+		msg := &Message{Delivery: d}
+		// Replies are consumed with auto ack.
+		msg.settle()
+		t.resolve(msg)
+	}
+	t.close()
+}
+
+/*
+Fail every pending call, and any added later.
+*/
+func (t *replyTracker) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for id, done := range t.pending {
+		close(done)
+		delete(t.pending, id)
+	}
+}
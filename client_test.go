@@ -0,0 +1,78 @@
+package consumer
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestReplyTracker(t *testing.T) {
+	tracker := newReplyTracker(NopLogger())
+	first := tracker.add("one")
+	second := tracker.add("two")
+
+	msg := &Message{}
+	msg.CorrelationId = "two"
+	tracker.resolve(msg)
+	unknown := &Message{}
+	unknown.CorrelationId = "three"
+	tracker.resolve(unknown)
+
+	if got := <-second; got.msg != msg {
+		t.Error("Reply should be sent to the matching call")
+	}
+	select {
+	case <-first:
+		t.Error("Other calls should still be waiting")
+	default:
+	}
+}
+
+func TestReplyTrackerClose(t *testing.T) {
+	tracker := newReplyTracker(NopLogger())
+	done := tracker.add("one")
+	replies := make(chan amqp.Delivery, 1)
+	replies <- amqp.Delivery{CorrelationId: "one"}
+	close(replies)
+	tracker.listen(replies)
+
+	msg := (<-done).msg
+	if msg == nil || !msg.Settled() {
+		t.Error("Reply should be delivered and marked settled")
+	}
+	if _, ok := <-tracker.add("two"); ok {
+		t.Error("Calls after close should be closed")
+	}
+}
+
+func TestReplyTrackerReturned(t *testing.T) {
+	tracker := newReplyTracker(NopLogger())
+	done := tracker.add("one")
+	tracker.returned(amqp.Return{CorrelationId: "one", ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE"})
+	tracker.returned(amqp.Return{CorrelationId: "unknown"})
+	r := <-done
+	if r.msg != nil || !errors.Is(r.err, ErrCallReturned) {
+		t.Errorf("Returned calls should fail, got %v", r.err)
+	}
+}
+
+func TestRPCErrorFrom(t *testing.T) {
+	msg := &Message{}
+	if rpcErrorFrom(msg) != nil {
+		t.Error("Normal replies are not errors")
+	}
+	msg.Headers = amqp.Table{RPCErrorHeader: true}
+	msg.Body = []byte(`{"error":{"code":"bad","message":"nope"}}`)
+	err := rpcErrorFrom(msg)
+	if err == nil || err.Code != "bad" || err.Message != "nope" {
+		t.Errorf("Error is wrong. Got %v", err)
+	}
+}
+
+func TestNewCorrelationId(t *testing.T) {
+	a, _ := newCorrelationId()
+	b, _ := newCorrelationId()
+	if len(a) != 32 || a == b {
+		t.Error("Correlation ids should be unique")
+	}
+}
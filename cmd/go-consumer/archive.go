@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+)
+
+/*
+Archive formats.
+
+JSON archives have a record per line. Binary archives frame each
+message as a record without its body followed by the raw body,
+both prefixed with their length as a big endian uint32, so large
+and binary bodies aren't base64 encoded.
+*/
+const (
+	formatJSON   = "json"
+	formatBinary = "binary"
+)
+
+/*
+Writes messages to an archive.
+*/
+type archiveWriter struct {
+	w      *bufio.Writer
+	format string
+}
+
+func newArchiveWriter(w io.Writer, format string) (*archiveWriter, error) {
+	if format != formatJSON && format != formatBinary {
+		return nil, fmt.Errorf("Unknown archive format %q.", format)
+	}
+	return &archiveWriter{w: bufio.NewWriter(w), format: format}, nil
+}
+
+/*
+Write a message. It is flushed before returning,
+so the message can be acked safely.
+*/
+func (a *archiveWriter) write(d amqp.Delivery) (err error) {
+	r := newRecord(d)
+	if a.format == formatJSON {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		a.w.Write(line)
+		a.w.WriteByte('\n')
+		return a.w.Flush()
+	}
+
+	r.Body, r.BodyBase64 = nil, ""
+	meta, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	writeFrame(a.w, meta)
+	writeFrame(a.w, d.Body)
+	return a.w.Flush()
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+/*
+Reads messages from an archive in either format.
+*/
+type archiveReader struct {
+	r      *bufio.Reader
+	format string
+}
+
+/*
+Create a reader, detecting the format from the first byte.
+JSON records start with { and binary ones with the high byte
+of a length, which is 0 for any sensible record.
+*/
+func newArchiveReader(r io.Reader) (*archiveReader, error) {
+	a := &archiveReader{r: bufio.NewReaderSize(r, 64<<10), format: formatBinary}
+	first, err := a.r.Peek(1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(first) == 1 && first[0] == '{' {
+		a.format = formatJSON
+	}
+	return a, nil
+}
+
+/*
+Read the next message. Returns io.EOF after the last one.
+*/
+func (a *archiveReader) next() (r record, err error) {
+	if a.format == formatJSON {
+		line, err := a.r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return r, err
+		}
+		err = json.Unmarshal(line, &r)
+		return r, err
+	}
+
+	meta, err := readFrame(a.r)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(meta, &r); err != nil {
+		return
+	}
+	body, err := readFrame(a.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	text := string(body)
+	r.Body = &text
+	return
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/streadway/amqp"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDeliveries() []amqp.Delivery {
+	return []amqp.Delivery{
+		{
+			Exchange:     "events",
+			RoutingKey:   "order.created",
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    "m1",
+			Timestamp:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Headers:      amqp.Table{"customer": "42", "tries": int32(2), "nested": amqp.Table{"ok": true}},
+			Body:         []byte(`{"id":1}`),
+		},
+		{
+			Exchange:   "events",
+			RoutingKey: "order.refunded",
+			Body:       []byte{0, 0xff, '\n'},
+		},
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, format := range []string{formatJSON, formatBinary} {
+		var buf bytes.Buffer
+		w, _ := newArchiveWriter(&buf, format)
+		for _, d := range testDeliveries() {
+			if err := w.write(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r, err := newArchiveReader(&buf)
+		if err != nil || r.format != format {
+			t.Fatalf("%s: wrong format %s %v", format, r.format, err)
+		}
+		first, err := r.next()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		msg, _ := first.publishing()
+		if first.RoutingKey != "order.created" || msg.MessageId != "m1" || msg.DeliveryMode != amqp.Persistent {
+			t.Errorf("%s: wrong properties %#v", format, msg)
+		}
+		if !msg.Timestamp.Equal(testDeliveries()[0].Timestamp) || string(msg.Body) != `{"id":1}` {
+			t.Errorf("%s: wrong timestamp or body %#v", format, msg)
+		}
+		if msg.Headers["customer"] != "42" || msg.Headers["tries"] != int32(2) || msg.Headers["nested"].(amqp.Table)["ok"] != true {
+			t.Errorf("%s: wrong headers %#v", format, msg.Headers)
+		}
+
+		second, _ := r.next()
+		msg, _ = second.publishing()
+		if !bytes.Equal(msg.Body, []byte{0, 0xff, '\n'}) {
+			t.Errorf("%s: binary body changed %v", format, msg.Body)
+		}
+		if _, err := r.next(); err != io.EOF {
+			t.Errorf("%s: expected EOF, got %v", format, err)
+		}
+	}
+}
+
+func TestArchiveHeaderTypes(t *testing.T) {
+	headers := amqp.Table{
+		"bytes":   []byte{0, 0xff},
+		"time":    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"whole":   float64(3),
+		"float32": float32(1.5),
+		"int64":   int64(1) << 60,
+		"int16":   int16(-2),
+		"uint8":   uint8(7),
+		"decimal": amqp.Decimal{Scale: 2, Value: 1234},
+		"none":    nil,
+		"x-death": []interface{}{
+			amqp.Table{
+				"count":        int64(1),
+				"queue":        "orders",
+				"reason":       "rejected",
+				"routing-keys": []interface{}{"order.created"},
+				"time":         time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+		},
+	}
+	for _, format := range []string{formatJSON, formatBinary} {
+		var buf bytes.Buffer
+		w, _ := newArchiveWriter(&buf, format)
+		if err := w.write(amqp.Delivery{Headers: headers}); err != nil {
+			t.Fatal(err)
+		}
+		r, _ := newArchiveReader(&buf)
+		rec, err := r.next()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		msg, _ := rec.publishing()
+		if !reflect.DeepEqual(msg.Headers, headers) {
+			t.Errorf("%s: headers changed\ngot  %#v\nwant %#v", format, msg.Headers, headers)
+		}
+	}
+}
+
+func TestArchiveUntaggedHeaders(t *testing.T) {
+	// Archives written before headers were tagged.
+	line := `{"exchange":"events","routing_key":"a","headers":{"customer":"42","tries":2,"rate":0.5,"nested":{"ok":true}}}`
+	r, _ := newArchiveReader(strings.NewReader(line))
+	rec, err := r.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := amqp.Table{"customer": "42", "tries": int64(2), "rate": 0.5, "nested": amqp.Table{"ok": true}}
+	if !reflect.DeepEqual(amqp.Table(rec.Headers), expected) {
+		t.Errorf("Wrong headers %#v", rec.Headers)
+	}
+
+	bad := `{"exchange":"events","routing_key":"a","headers":{"n":{"int16":70000}}}`
+	r, _ = newArchiveReader(strings.NewReader(bad))
+	if _, err := r.next(); err == nil {
+		t.Error("Out of range values should fail")
+	}
+}
+
+func TestArchiveUnknownFormat(t *testing.T) {
+	if _, err := newArchiveWriter(io.Discard, "xml"); err == nil {
+		t.Error("Unknown formats should fail")
+	}
+}
+
+func TestArchiveTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := newArchiveWriter(&buf, formatBinary)
+	w.write(testDeliveries()[0])
+	r, _ := newArchiveReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	if _, err := r.next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	filters, err := parseFilters([]string{"routing_key=order.*", "header.customer=4?", "body~id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testDeliveries()[0]
+	if !matchFilters(filters, newRecord(d), d.Body) {
+		t.Error("Filters should match")
+	}
+	d.Headers = nil
+	if matchFilters(filters, newRecord(d), d.Body) {
+		t.Error("Missing headers should not match")
+	}
+	for _, value := range []string{"nope", "colour=red", "header.=x", "type=[", "body=x"} {
+		if _, err := parseFilters([]string{value}); err == nil {
+			t.Errorf("Filter %q should be invalid", value)
+		}
+	}
+}
+
+type getRecorder struct {
+	deliveries []amqp.Delivery
+	acks       *ackRecorder
+	nackTag    uint64
+	multiple   bool
+	requeue    bool
+}
+
+func (g *getRecorder) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if len(g.deliveries) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	d := g.deliveries[0]
+	g.deliveries = g.deliveries[1:]
+	d.Acknowledger = g.acks
+	return d, true, nil
+}
+
+func (g *getRecorder) Nack(tag uint64, multiple, requeue bool) error {
+	g.nackTag, g.multiple, g.requeue = tag, multiple, requeue
+	return nil
+}
+
+func newGetRecorder() *getRecorder {
+	deliveries := testDeliveries()
+	for i := range deliveries {
+		deliveries[i].DeliveryTag = uint64(i + 1)
+	}
+	return &getRecorder{deliveries: deliveries, acks: &ackRecorder{}}
+}
+
+func TestDumpQueue(t *testing.T) {
+	var buf bytes.Buffer
+	archive, _ := newArchiveWriter(&buf, formatJSON)
+	g := newGetRecorder()
+	n, err := dumpQueue(context.Background(), g, "orders", false, 0, archive)
+	if err != nil || n != 2 || g.acks.acks != 2 || g.nackTag != 0 {
+		t.Errorf("Expected 2 acked messages, got %d %v %#v", n, err, g)
+	}
+	if strings.Count(buf.String(), "\n") != 2 {
+		t.Errorf("Wrong archive %s", buf.String())
+	}
+}
+
+func TestDumpQueueRequeue(t *testing.T) {
+	archive, _ := newArchiveWriter(io.Discard, formatJSON)
+	g := newGetRecorder()
+	n, err := dumpQueue(context.Background(), g, "orders", true, 1, archive)
+	if err != nil || n != 1 || g.acks.acks != 0 {
+		t.Errorf("Expected 1 unacked message, got %d %v", n, err)
+	}
+	if g.nackTag != 1 || !g.multiple || !g.requeue {
+		t.Errorf("Messages should be requeued together, got %#v", g)
+	}
+}
+
+type streamRecorder struct {
+	deliveries chan amqp.Delivery
+	args       amqp.Table
+	prefetch   int
+}
+
+func (s *streamRecorder) Qos(prefetchCount, prefetchSize int, global bool) error {
+	s.prefetch = prefetchCount
+	return nil
+}
+
+func (s *streamRecorder) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	s.args = args
+	return s.deliveries, nil
+}
+
+func TestDumpStream(t *testing.T) {
+	s := &streamRecorder{deliveries: make(chan amqp.Delivery, 2)}
+	acks := &ackRecorder{}
+	for _, d := range testDeliveries() {
+		d.Acknowledger = acks
+		s.deliveries <- d
+	}
+	archive, _ := newArchiveWriter(io.Discard, formatJSON)
+	n, err := dumpStream(context.Background(), s, "events", streamOffset("10"), 10*time.Millisecond, 0, archive)
+	if err != nil || n != 2 || acks.acks != 2 {
+		t.Errorf("Expected 2 messages, got %d %v", n, err)
+	}
+	if s.args["x-stream-offset"] != int64(10) || s.prefetch != streamPrefetch {
+		t.Errorf("Wrong stream settings %v %d", s.args, s.prefetch)
+	}
+	if streamOffset("first") != "first" {
+		t.Error("Named offsets should be strings")
+	}
+}
+
+func TestReplayArchive(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := newArchiveWriter(&buf, formatJSON)
+	for _, d := range testDeliveries() {
+		w.write(d)
+	}
+	archive, _ := newArchiveReader(&buf)
+	filters, _ := parseFilters([]string{"routing_key=order.created"})
+	ch := &publishRecorder{}
+	route := func(r record) (string, string) {
+		return "replayed", r.RoutingKey + ".v2"
+	}
+	sent, skipped, err := replayArchive(context.Background(), ch, archive, filters, route, 0, func() {})
+	if err != nil || sent != 1 || skipped != 1 {
+		t.Errorf("Expected 1 sent and 1 skipped, got %d %d %v", sent, skipped, err)
+	}
+	if ch.keys[0] != "replayed/order.created.v2" || ch.bodies[0] != `{"id":1}` {
+		t.Errorf("Wrong publish %v %v", ch.keys, ch.bodies)
+	}
+}
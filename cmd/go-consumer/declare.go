@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"io"
+	"text/tabwriter"
+)
+
+/*
+Declare a configuration file's topology on the broker
+and print what was created.
+*/
+func declare(args []string, out io.Writer) error {
+	path, err := parseConfigArg(newFlagSet("declare"), args)
+	if err != nil {
+		return err
+	}
+	c, err := consumer.Create(path, consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		return err
+	}
+	decls, err := c.Declare()
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, d := range decls {
+		status := "present"
+		if d.Created {
+			status = "created"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Kind, d.Name, status)
+	}
+	w.Flush()
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+/*
+Messages fetched from a stream before they're acked.
+RabbitMQ requires a prefetch to consume streams.
+*/
+const streamPrefetch = 100
+
+/*
+Write a queue's messages to an archive.
+
+By default messages are acked once they're written. With
+-requeue they're all returned to the queue at the end instead,
+and with -stream a stream queue is read from -offset.
+*/
+func dump(args []string, out io.Writer) error {
+	flags := newFlagSet("dump")
+	configFile := flags.String("config", "", "The configuration file with the connection to use.")
+	queue := flags.String("queue", "", "The queue to dump.")
+	output := flags.String("out", "-", "The archive to write. Defaults to stdout.")
+	format := flags.String("format", formatJSON, "Archive format, json or binary.")
+	requeue := flags.Bool("requeue", false, "Leave messages on the queue.")
+	stream := flags.Bool("stream", false, "Read a stream queue.")
+	offset := flags.String("offset", "first", "Where to start reading a stream: first, last, next or an offset.")
+	idle := flags.Duration("idle", 2*time.Second, "Stop reading a stream after this long without messages.")
+	count := flags.Int("count", 0, "Stop after this many messages.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *configFile == "" || *queue == "" || flags.NArg() != 0 || (*stream && *requeue) {
+		return errUsage
+	}
+
+	w := out
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	archive, err := newArchiveWriter(w, *format)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	conn, err := dial(*configFile)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var n int
+	if *stream {
+		n, err = dumpStream(ctx, channel, *queue, streamOffset(*offset), *idle, *count, archive)
+	} else {
+		n, err = dumpQueue(ctx, channel, *queue, *requeue, *count, archive)
+	}
+	// Don't mix the summary into an archive written to out.
+	if *output != "-" {
+		fmt.Fprintf(out, "Dumped %d messages from %s\n", n, *queue)
+	}
+	return err
+}
+
+type getChannel interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Nack(tag uint64, multiple, requeue bool) error
+}
+
+/*
+Get messages until the queue is empty.
+
+Messages are acked after they're written. When requeueing,
+they are held until the queue is empty and then all returned,
+so none are fetched twice. They will be marked as redelivered.
+*/
+func dumpQueue(ctx context.Context, channel getChannel, queue string, requeue bool, count int, archive *archiveWriter) (n int, err error) {
+	var last uint64
+	defer func() {
+		if requeue && last > 0 {
+			if nackErr := channel.Nack(last, true, true); err == nil {
+				err = nackErr
+			}
+		}
+	}()
+	for (count == 0 || n < count) && ctx.Err() == nil {
+		d, ok, err := channel.Get(queue, false)
+		if err != nil || !ok {
+			return n, err
+		}
+		last = d.DeliveryTag
+		if err = archive.write(d); err != nil {
+			return n, err
+		}
+		n++
+		if !requeue {
+			if err = d.Ack(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return
+}
+
+type consumeChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+}
+
+/*
+Read a stream from offset until it is idle.
+Reading a stream doesn't remove messages from it.
+*/
+func dumpStream(ctx context.Context, channel consumeChannel, queue string, offset interface{}, idle time.Duration, count int, archive *archiveWriter) (n int, err error) {
+	if err = channel.Qos(streamPrefetch, 0, false); err != nil {
+		return
+	}
+	deliveries, err := channel.Consume(queue, "", false, false, false, false, amqp.Table{"x-stream-offset": offset})
+	if err != nil {
+		return
+	}
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for count == 0 || n < count {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return n, fmt.Errorf("Connection closed.")
+			}
+			if err = archive.write(d); err != nil {
+				return
+			}
+			n++
+			if err = d.Ack(false); err != nil {
+				return
+			}
+			timer.Reset(idle)
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+	return
+}
+
+/*
+Stream offsets are either names or numbers.
+*/
+func streamOffset(offset string) interface{} {
+	if n, err := strconv.ParseInt(offset, 10, 64); err == nil {
+		return n
+	}
+	return offset
+}
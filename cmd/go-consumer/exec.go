@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Exit status a command uses to reject a message without requeueing it.
+EX_DATAERR from sysexits.h.
+*/
+const defaultRejectStatus = 65
+
+/*
+How a message is settled after a command handles it. Failed
+messages are left for the consumer to nack following the
+queue's requeue option.
+*/
+const (
+	resultAck     = "ack"
+	resultRequeue = "requeue"
+	resultReject  = "reject"
+	resultFailed  = "failed"
+)
+
+/*
+Consume messages, handing each one to an external command.
+*/
+func execCommand(args []string, out io.Writer) error {
+	flags := newFlagSet("exec")
+	configFile := flags.String("config", "", "The configuration file to use.")
+	worker := flags.Bool("worker", false, "Run the command once and send it messages as JSON lines.")
+	rejectStatus := flags.Int("reject-status", defaultRejectStatus, "Exit status that rejects a message instead of requeueing it.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	argv := flags.Args()
+	if *configFile == "" || len(argv) == 0 {
+		return errUsage
+	}
+
+	c, err := consumer.Create(*configFile)
+	if err != nil {
+		return err
+	}
+	var handler consumer.Handler
+	if *worker {
+		w := &workerProcess{argv: argv, stderr: os.Stderr}
+		defer w.stop()
+		handler = w.handle
+	} else {
+		handler = commandHandler(argv, *rejectStatus, out, os.Stderr)
+	}
+	return c.ConsumeContext(handler)
+}
+
+/*
+Create a handler that runs a command for each message.
+
+The body is written to the command's stdin and the rest of the
+message is passed in environment variables. An exit status of 0
+acks the message, rejectStatus rejects it and anything else nacks
+it following the queue's requeue option.
+*/
+func commandHandler(argv []string, rejectStatus int, stdout, stderr io.Writer) consumer.Handler {
+	return func(ctx context.Context, msg *consumer.Message) error {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Env = append(os.Environ(), messageEnv(msg)...)
+		cmd.Stdin = bytes.NewReader(msg.Body)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+			return settle(msg, resultAck, nil)
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == rejectStatus:
+			return settle(msg, resultReject, err)
+		}
+		return settle(msg, resultFailed, err)
+	}
+}
+
+/*
+Settle a message, returning err so failures are still
+logged and counted by the consumer.
+*/
+func settle(msg *consumer.Message, result string, err error) error {
+	var settleErr error
+	switch result {
+	case resultAck:
+		settleErr = msg.Ack(false)
+	case resultReject:
+		settleErr = msg.Reject(false)
+	case resultRequeue:
+		settleErr = msg.Nack(false, true)
+	}
+	if err == nil {
+		err = settleErr
+	}
+	return err
+}
+
+/*
+Describe a message with CONSUMER_ environment variables.
+
+Headers are passed as CONSUMER_HEADER_<NAME>, with the
+name upper cased and other characters replaced by _.
+*/
+func messageEnv(msg *consumer.Message) []string {
+	env := []string{
+		"CONSUMER_QUEUE=" + msg.Queue(),
+		"CONSUMER_EXCHANGE=" + msg.Exchange,
+		"CONSUMER_ROUTING_KEY=" + msg.RoutingKey,
+		"CONSUMER_DELIVERY_TAG=" + strconv.FormatUint(msg.DeliveryTag, 10),
+		"CONSUMER_REDELIVERED=" + strconv.FormatBool(msg.Redelivered),
+		"CONSUMER_CONTENT_TYPE=" + msg.ContentType,
+		"CONSUMER_CONTENT_ENCODING=" + msg.ContentEncoding,
+		"CONSUMER_MESSAGE_ID=" + msg.MessageId,
+		"CONSUMER_CORRELATION_ID=" + msg.CorrelationId,
+		"CONSUMER_REPLY_TO=" + msg.ReplyTo,
+		"CONSUMER_TYPE=" + msg.Type,
+		"CONSUMER_APP_ID=" + msg.AppId,
+	}
+	if !msg.Timestamp.IsZero() {
+		env = append(env, "CONSUMER_TIMESTAMP="+strconv.FormatInt(msg.Timestamp.Unix(), 10))
+	}
+	for name, value := range msg.Headers {
+		env = append(env, "CONSUMER_HEADER_"+envName(name)+"="+headerValue(value))
+	}
+	return env
+}
+
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func headerValue(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return strconv.FormatInt(v.Unix(), 10)
+	}
+	return fmt.Sprint(value)
+}
+
+/*
+A message sent to a worker process.
+*/
+type workerRequest struct {
+	Queue           string                 `json:"queue"`
+	Exchange        string                 `json:"exchange"`
+	RoutingKey      string                 `json:"routing_key"`
+	DeliveryTag     uint64                 `json:"delivery_tag"`
+	Redelivered     bool                   `json:"redelivered"`
+	ContentType     string                 `json:"content_type,omitempty"`
+	ContentEncoding string                 `json:"content_encoding,omitempty"`
+	MessageId       string                 `json:"message_id,omitempty"`
+	CorrelationId   string                 `json:"correlation_id,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Headers         map[string]interface{} `json:"headers,omitempty"`
+	// Body is used for UTF-8 text, and BodyBase64 for anything else.
+	Body       *string `json:"body,omitempty"`
+	BodyBase64 string  `json:"body_base64,omitempty"`
+}
+
+/*
+A worker process's answer for a message.
+*/
+type workerResponse struct {
+	DeliveryTag uint64 `json:"delivery_tag"`
+	Result      string `json:"result"`
+	Error       string `json:"error"`
+}
+
+func newWorkerRequest(msg *consumer.Message) workerRequest {
+	req := workerRequest{
+		Queue:           msg.Queue(),
+		Exchange:        msg.Exchange,
+		RoutingKey:      msg.RoutingKey,
+		DeliveryTag:     msg.DeliveryTag,
+		Redelivered:     msg.Redelivered,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		MessageId:       msg.MessageId,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+	}
+	if len(msg.Headers) > 0 {
+		req.Headers = make(map[string]interface{}, len(msg.Headers))
+		for name, value := range msg.Headers {
+			req.Headers[name] = headerValue(value)
+		}
+	}
+	if utf8.Valid(msg.Body) {
+		body := string(msg.Body)
+		req.Body = &body
+	} else {
+		req.BodyBase64 = base64.StdEncoding.EncodeToString(msg.Body)
+	}
+	return req
+}
+
+/*
+A long-lived command that handles messages one at a time.
+
+Each message is written to the command's stdin as a line of JSON
+and the command answers with a line like
+
+	{"delivery_tag": 1, "result": "ack"}
+
+where result is ack, requeue or reject. The command is started
+for the first message and restarted after it exits or fails to
+answer before the handler times out. Messages the worker fails
+to answer are nacked following the queue's requeue option.
+*/
+type workerProcess struct {
+	argv   []string
+	stderr io.Writer
+
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines *bufio.Scanner
+}
+
+func (w *workerProcess) handle(ctx context.Context, msg *consumer.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	resp, err := w.call(ctx, newWorkerRequest(msg))
+	if err != nil {
+		w.kill()
+		return settle(msg, resultFailed, err)
+	}
+	switch resp.Result {
+	case resultAck, resultRequeue, resultReject:
+	default:
+		return settle(msg, resultFailed, fmt.Errorf("Unknown result %q from worker.", resp.Result))
+	}
+	if resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	if resp.Result != resultAck && err == nil {
+		err = fmt.Errorf("Worker returned %s.", resp.Result)
+	}
+	return settle(msg, resp.Result, err)
+}
+
+/*
+Send a request and wait for its response. Must hold mu.
+*/
+func (w *workerProcess) call(ctx context.Context, req workerRequest) (resp workerResponse, err error) {
+	if w.cmd == nil {
+		if err = w.start(); err != nil {
+			return
+		}
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	if _, err = w.stdin.Write(append(line, '\n')); err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if !w.lines.Scan() {
+			err := w.lines.Err()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- fmt.Errorf("Worker stopped: %w", err)
+			return
+		}
+		done <- json.Unmarshal(w.lines.Bytes(), &resp)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Killing the worker unblocks the scanner.
+		w.kill()
+		<-done
+		return resp, ctx.Err()
+	}
+	if err == nil && resp.DeliveryTag != 0 && resp.DeliveryTag != req.DeliveryTag {
+		err = fmt.Errorf("Worker answered delivery tag %d, expected %d.", resp.DeliveryTag, req.DeliveryTag)
+	}
+	return
+}
+
+/*
+Start the command. Must hold mu.
+*/
+func (w *workerProcess) start() error {
+	cmd := exec.Command(w.argv[0], w.argv[1:]...)
+	cmd.Stderr = w.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	w.cmd = cmd
+	w.stdin = stdin
+	w.lines = bufio.NewScanner(stdout)
+	w.lines.Buffer(nil, 64<<20)
+	return nil
+}
+
+/*
+Stop the command so the next message restarts it. Must hold mu.
+*/
+func (w *workerProcess) kill() {
+	if w.cmd == nil {
+		return
+	}
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+	w.cmd = nil
+}
+
+/*
+Close the command's stdin and wait for it to exit.
+*/
+func (w *workerProcess) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cmd == nil {
+		return
+	}
+	w.stdin.Close()
+	w.cmd.Wait()
+	w.cmd = nil
+}
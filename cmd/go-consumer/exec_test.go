@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/markstory/go-consumer"
+	"github.com/markstory/go-consumer/consumertest"
+	"github.com/streadway/amqp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type ackRecorder struct {
+	acks, nacks, rejects int
+	requeue              bool
+}
+
+func (r *ackRecorder) Ack(tag uint64, multiple bool) error {
+	r.acks++
+	return nil
+}
+
+func (r *ackRecorder) Nack(tag uint64, multiple, requeue bool) error {
+	r.nacks++
+	r.requeue = requeue
+	return nil
+}
+
+func (r *ackRecorder) Reject(tag uint64, requeue bool) error {
+	r.rejects++
+	r.requeue = requeue
+	return nil
+}
+
+func newExecMessage(r *ackRecorder, body string) *consumer.Message {
+	return &consumer.Message{Delivery: amqp.Delivery{
+		Acknowledger: r,
+		DeliveryTag:  7,
+		Exchange:     "app",
+		RoutingKey:   "order.created",
+		Headers:      amqp.Table{"x-customer-id": []byte("42")},
+		Body:         []byte(body),
+	}}
+}
+
+func TestCommandHandlerExitStatus(t *testing.T) {
+	cases := []struct {
+		script  string
+		acks    int
+		nacks   int
+		rejects int
+	}{
+		{"exit 0", 1, 0, 0},
+		{"exit 1", 0, 0, 0},
+		{"exit 65", 0, 0, 1},
+	}
+	for _, tc := range cases {
+		r := &ackRecorder{}
+		handler := commandHandler([]string{"sh", "-c", tc.script}, defaultRejectStatus, &bytes.Buffer{}, &bytes.Buffer{})
+		err := handler(context.Background(), newExecMessage(r, "{}"))
+		if r.acks != tc.acks || r.nacks != tc.nacks || r.rejects != tc.rejects {
+			t.Errorf("%s: wrong outcome %#v", tc.script, r)
+		}
+		if (err == nil) != (tc.acks == 1) {
+			t.Errorf("%s: unexpected error %v", tc.script, err)
+		}
+	}
+}
+
+func TestCommandHandlerFollowsQueueRequeue(t *testing.T) {
+	for _, requeue := range []bool{true, false} {
+		h := consumertest.NewHarness("orders")
+		h.Requeue = requeue
+		handler := commandHandler([]string{"sh", "-c", "exit 1"}, defaultRejectStatus, &bytes.Buffer{}, &bytes.Buffer{})
+		h.Run(handler, h.Message([]byte("{}"))).AssertNacked(t, requeue)
+	}
+}
+
+func TestCommandHandlerInput(t *testing.T) {
+	var out bytes.Buffer
+	handler := commandHandler([]string{"sh", "-c", `echo "$CONSUMER_ROUTING_KEY $CONSUMER_DELIVERY_TAG $CONSUMER_HEADER_X_CUSTOMER_ID"; cat`}, defaultRejectStatus, &out, &bytes.Buffer{})
+	if err := handler(context.Background(), newExecMessage(&ackRecorder{}, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "order.created 7 42\nhello" {
+		t.Errorf("Wrong output %q", out.String())
+	}
+}
+
+func TestCommandHandlerTimeout(t *testing.T) {
+	r := &ackRecorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	handler := commandHandler([]string{"sleep", "5"}, defaultRejectStatus, &bytes.Buffer{}, &bytes.Buffer{})
+	if err := handler(ctx, newExecMessage(r, "")); err == nil {
+		t.Error("Expected an error")
+	}
+	if r.nacks != 0 {
+		t.Error("Timed out messages should be left for the consumer to nack")
+	}
+}
+
+const workerScript = `
+while read line; do
+	case "$line" in
+	*'"body":"bad"'*) echo '{"result":"reject","error":"bad body"}' ;;
+	*'"body":"exit"'*) exit 1 ;;
+	*'"routing_key":"order.created"'*) echo '{"delivery_tag":7,"result":"ack"}' ;;
+	esac
+done
+`
+
+func TestWorkerProcess(t *testing.T) {
+	w := &workerProcess{argv: []string{"sh", "-c", workerScript}, stderr: &bytes.Buffer{}}
+	defer w.stop()
+
+	r := &ackRecorder{}
+	if err := w.handle(context.Background(), newExecMessage(r, "ok")); err != nil || r.acks != 1 {
+		t.Errorf("Expected ack, got %v %#v", err, r)
+	}
+	pid := w.cmd.Process.Pid
+
+	r = &ackRecorder{}
+	err := w.handle(context.Background(), newExecMessage(r, "bad"))
+	if err == nil || err.Error() != "bad body" || r.rejects != 1 || r.requeue {
+		t.Errorf("Expected reject, got %v %#v", err, r)
+	}
+	if w.cmd.Process.Pid != pid {
+		t.Error("Worker should be reused")
+	}
+
+	r = &ackRecorder{}
+	err = w.handle(context.Background(), newExecMessage(r, "exit"))
+	if err == nil || !strings.Contains(err.Error(), "Worker stopped") || r.nacks != 0 {
+		t.Errorf("Expected an unsettled failure, got %v %#v", err, r)
+	}
+
+	r = &ackRecorder{}
+	if err := w.handle(context.Background(), newExecMessage(r, "ok")); err != nil || r.acks != 1 {
+		t.Errorf("Worker should restart, got %v %#v", err, r)
+	}
+}
+
+func TestWorkerRequestBinaryBody(t *testing.T) {
+	req := newWorkerRequest(newExecMessage(&ackRecorder{}, "\xff\xfe"))
+	if req.Body != nil || req.BodyBase64 != "//4=" {
+		t.Errorf("Binary bodies should be base64 encoded, got %#v", req)
+	}
+	if req.Headers["x-customer-id"] != "42" {
+		t.Errorf("Wrong headers %v", req.Headers)
+	}
+}
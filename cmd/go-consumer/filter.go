@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+/*
+Matches messages against -filter flags.
+
+Filters look like field=pattern, where pattern is a glob, or
+body~text to match messages whose body contains text. Fields are
+exchange, routing_key, content_type, message_id, correlation_id,
+type, app_id and header.<name>. All filters must match.
+*/
+type filter struct {
+	field   string
+	pattern string
+	contain bool
+}
+
+func parseFilters(values []string) (filters []filter, err error) {
+	for _, value := range values {
+		if text, ok := strings.CutPrefix(value, "body~"); ok {
+			filters = append(filters, filter{field: "body", pattern: text, contain: true})
+			continue
+		}
+		field, pattern, ok := strings.Cut(value, "=")
+		if !ok || !knownFilterField(field) {
+			return nil, fmt.Errorf("Invalid filter %q. Expected field=pattern or body~text.", value)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern in filter %q.", value)
+		}
+		filters = append(filters, filter{field: field, pattern: pattern})
+	}
+	return
+}
+
+func knownFilterField(field string) bool {
+	switch field {
+	case "exchange", "routing_key", "content_type", "message_id", "correlation_id", "type", "app_id":
+		return true
+	}
+	return strings.HasPrefix(field, "header.") && len(field) > len("header.")
+}
+
+func matchFilters(filters []filter, r record, body []byte) bool {
+	for _, f := range filters {
+		if !f.match(r, body) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f filter) match(r record, body []byte) bool {
+	if f.contain {
+		return strings.Contains(string(body), f.pattern)
+	}
+	var value string
+	switch f.field {
+	case "exchange":
+		value = r.Exchange
+	case "routing_key":
+		value = r.RoutingKey
+	case "content_type":
+		value = r.ContentType
+	case "message_id":
+		value = r.MessageId
+	case "correlation_id":
+		value = r.CorrelationId
+	case "type":
+		value = r.Type
+	case "app_id":
+		value = r.AppId
+	default:
+		header, ok := r.Headers[strings.TrimPrefix(f.field, "header.")]
+		if !ok {
+			return false
+		}
+		value = headerValue(header)
+	}
+	ok, _ := path.Match(f.pattern, value)
+	return ok
+}
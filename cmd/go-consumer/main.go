@@ -0,0 +1,143 @@
+/*
+Command go-consumer works with go-consumer configuration files and
+the broker they point at.
+
+	go-consumer validate <config>
+	go-consumer show [-json] <config>
+	go-consumer declare <config>
+	go-consumer exec -config <config> [-worker] [-reject-status 65] -- <command> [args...]
+	go-consumer tail -config <config> -exchange <name> [-key <key>...] [-json] [-count n]
+	go-consumer publish -config <config> -exchange <name> -key <key> [-file <glob>...] [options]
+	go-consumer dump -config <config> -queue <name> [-out <file>] [-format json|binary] [-requeue | -stream]
+	go-consumer replay -config <config> [-in <file>] [-exchange <name>] [-key <key>] [options]
+	go-consumer requeue -config <config> -from <queue> [-filter field=pattern...] [-direct] [-dry-run]
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage   string
+	summary string
+	run     func(args []string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"validate": {"validate <config>", "Check a configuration file for problems.", validate},
+	"show":     {"show [-json] <config>", "Show the connection, exchanges, queues and bindings in a configuration file.", show},
+	"declare":  {"declare <config>", "Declare the exchanges, queues and bindings on the broker.", declare},
+	"exec": {
+		"exec -config <config> [-worker] [-reject-status 65] -- <command> [args...]",
+		"Consume messages, handing each one to a command.",
+		execCommand,
+	},
+	"tail": {
+		"tail -config <config> -exchange <name> [-key <key>...] [-json] [-count n]",
+		"Print messages sent to an exchange without taking them from other consumers.",
+		tail,
+	},
+	"publish": {
+		"publish -config <config> -exchange <name> -key <key> [-file <glob>...] [-header name=value...] [-count n] [-rate n] [-confirm]",
+		"Publish messages from stdin or files.",
+		publish,
+	},
+	"dump": {
+		"dump -config <config> -queue <name> [-out <file>] [-format json|binary] [-requeue | -stream [-offset first]] [-count n]",
+		"Write a queue's messages to an archive.",
+		dump,
+	},
+	"replay": {
+		"replay -config <config> [-in <file>] [-exchange <name>] [-key <key>] [-rewrite old=new...] [-filter field=pattern...] [-rate n]",
+		"Publish the messages in an archive.",
+		replay,
+	},
+	"requeue": {
+		"requeue -config <config> -from <queue> [-filter field=pattern...] [-direct] [-dry-run] [-count n]",
+		"Move dead lettered messages back to where they came from.",
+		requeue,
+	},
+}
+
+/*
+Returned when a command has already reported why it failed.
+*/
+var errFailed = errors.New("failed")
+
+/*
+Returned for bad arguments, to print the command's usage.
+*/
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, out, errOut io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(errOut)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(errOut, "go-consumer: unknown command %q\n\n", args[0])
+		usage(errOut)
+		return 2
+	}
+
+	err := cmd.run(args[1:], out)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp):
+		fmt.Fprintf(errOut, "usage: go-consumer %s\n", cmd.usage)
+		return 2
+	case errors.Is(err, errFailed):
+		return 1
+	}
+	fmt.Fprintf(errOut, "go-consumer %s: %v\n", args[0], err)
+	return 1
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: go-consumer <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
+
+/*
+Create a flag set for a command that reports errors
+through run instead of exiting.
+*/
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+/*
+Parse a command's flags followed by the configuration file.
+*/
+func parseConfigArg(flags *flag.FlagSet, args []string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if flags.NArg() != 1 {
+		return "", errUsage
+	}
+	return flags.Arg(0), nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+How long to wait for outstanding confirms once everything is published.
+*/
+const confirmTimeout = 30 * time.Second
+
+type publishChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+/*
+Publish messages from stdin or files, optionally
+at a fixed rate and waiting for confirms.
+*/
+func publish(args []string, out io.Writer) error {
+	flags := newFlagSet("publish")
+	configFile := flags.String("config", "", "The configuration file with the connection to use.")
+	exchange := flags.String("exchange", "", "The exchange to publish to.")
+	key := flags.String("key", "", "The routing key to publish with.")
+	var files, headers stringsFlag
+	flags.Var(&files, "file", "File or glob of files to publish, one message per file. Can be repeated. Defaults to stdin.")
+	flags.Var(&headers, "header", "Header to set as name=value. Can be repeated.")
+	count := flags.Int("count", 0, "Number of messages to publish, cycling through the bodies. Defaults to one per body.")
+	rate := flags.Float64("rate", 0, "Messages per second. Defaults to unlimited.")
+	confirm := flags.Bool("confirm", false, "Wait for publisher confirms and report their latency.")
+	props := amqp.Publishing{}
+	flags.StringVar(&props.ContentType, "content-type", "", "Content type property.")
+	flags.StringVar(&props.ContentEncoding, "content-encoding", "", "Content encoding property.")
+	flags.StringVar(&props.MessageId, "message-id", "", "Message id property.")
+	flags.StringVar(&props.CorrelationId, "correlation-id", "", "Correlation id property.")
+	flags.StringVar(&props.ReplyTo, "reply-to", "", "Reply to property.")
+	flags.StringVar(&props.Expiration, "expiration", "", "Expiration property in milliseconds.")
+	flags.StringVar(&props.Type, "type", "", "Type property.")
+	flags.StringVar(&props.AppId, "app-id", "", "App id property.")
+	priority := flags.Uint("priority", 0, "Priority property, 0 to 9.")
+	persistent := flags.Bool("persistent", false, "Publish persistent messages.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *configFile == "" || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	table, err := parseHeaders(headers)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	props.Headers = table
+	props.Priority = uint8(*priority)
+	if *persistent {
+		props.DeliveryMode = amqp.Persistent
+	}
+	bodies, err := readBodies(files, os.Stdin)
+	if err != nil {
+		return err
+	}
+	msgs := make([]amqp.Publishing, len(bodies))
+	for i, body := range bodies {
+		msgs[i] = props
+		msgs[i].Body = body
+	}
+	if *count == 0 {
+		*count = len(msgs)
+	}
+
+	conn, err := dial(*configFile)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	var confirms *confirmLatencies
+	if *confirm {
+		if err = channel.Confirm(false); err != nil {
+			return err
+		}
+		confirms = newConfirmLatencies()
+		go confirms.listen(channel.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+	sent, err := publishLoop(ctx, channel, *exchange, *key, msgs, *count, *rate, confirms.sent)
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(out, "Published %d messages in %s (%.1f/s)\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	if confirms != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+		defer cancel()
+		confirms.wait(waitCtx, sent)
+		confirms.report(out, sent)
+	}
+	return err
+}
+
+/*
+Parse name=value headers.
+*/
+func parseHeaders(headers []string) (amqp.Table, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	table := amqp.Table{}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("Invalid header %q. Expected name=value.", header)
+		}
+		table[name] = value
+	}
+	return table, nil
+}
+
+/*
+Read message bodies from files, expanding globs,
+or from stdin when there are no files.
+*/
+func readBodies(patterns []string, stdin io.Reader) (bodies [][]byte, err error) {
+	if len(patterns) == 0 {
+		body, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{body}, nil
+	}
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("No files match %q.", pattern)
+		}
+		for _, path := range paths {
+			body, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			bodies = append(bodies, body)
+		}
+	}
+	return
+}
+
+/*
+Publish count messages, cycling through msgs, at most rate
+a second. onSent is called before each publish.
+*/
+func publishLoop(ctx context.Context, ch publishChannel, exchange, key string, msgs []amqp.Publishing, count int, rate float64, onSent func()) (sent int, err error) {
+	pace := newPacer(rate)
+	for sent < count {
+		if !pace.wait(ctx) {
+			return sent, nil
+		}
+		onSent()
+		if err = ch.Publish(exchange, key, false, false, msgs[sent%len(msgs)]); err != nil {
+			return
+		}
+		sent++
+	}
+	return
+}
+
+/*
+Spreads work evenly over time instead of in bursts.
+A zero rate doesn't wait.
+*/
+type pacer struct {
+	rate  float64
+	start time.Time
+	n     int
+}
+
+func newPacer(rate float64) *pacer {
+	return &pacer{rate: rate, start: time.Now()}
+}
+
+/*
+Wait for the next slot. Returns false if ctx is done first.
+*/
+func (p *pacer) wait(ctx context.Context) bool {
+	if p.rate <= 0 {
+		return ctx.Err() == nil
+	}
+	next := p.start.Add(time.Duration(float64(p.n) / p.rate * float64(time.Second)))
+	p.n++
+	select {
+	case <-time.After(time.Until(next)):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/*
+Times publishes until they are confirmed.
+Confirms arrive in delivery tag order, starting at 1.
+*/
+type confirmLatencies struct {
+	mu        sync.Mutex
+	sentAt    []time.Time
+	latencies []time.Duration
+	nacked    int
+	changed   chan struct{}
+}
+
+func newConfirmLatencies() *confirmLatencies {
+	return &confirmLatencies{changed: make(chan struct{}, 1)}
+}
+
+func (l *confirmLatencies) sent() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sentAt = append(l.sentAt, time.Now())
+}
+
+func (l *confirmLatencies) listen(confirms <-chan amqp.Confirmation) {
+	for c := range confirms {
+		l.confirmed(c, time.Now())
+	}
+}
+
+func (l *confirmLatencies) confirmed(c amqp.Confirmation, at time.Time) {
+	l.mu.Lock()
+	if c.DeliveryTag > 0 && int(c.DeliveryTag) <= len(l.sentAt) {
+		l.latencies = append(l.latencies, at.Sub(l.sentAt[c.DeliveryTag-1]))
+		if !c.Ack {
+			l.nacked++
+		}
+	}
+	l.mu.Unlock()
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Wait for n confirms or ctx to be done.
+*/
+func (l *confirmLatencies) wait(ctx context.Context, n int) {
+	for {
+		l.mu.Lock()
+		done := len(l.latencies) >= n
+		l.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-l.changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *confirmLatencies) report(out io.Writer, sent int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	confirmed := len(l.latencies)
+	fmt.Fprintf(out, "Confirmed %d, nacked %d, unconfirmed %d\n", confirmed-l.nacked, l.nacked, sent-confirmed)
+	if confirmed == 0 {
+		return
+	}
+	sorted := append([]time.Duration(nil), l.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	fmt.Fprintf(out, "Confirm latency p50=%s p90=%s p99=%s max=%s\n",
+		percentile(sorted, 0.5),
+		percentile(sorted, 0.9),
+		percentile(sorted, 0.99),
+		sorted[len(sorted)-1])
+}
+
+/*
+Get the nearest rank percentile of sorted durations.
+*/
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/streadway/amqp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type publishRecorder struct {
+	keys   []string
+	bodies []string
+}
+
+func (p *publishRecorder) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.keys = append(p.keys, exchange+"/"+key)
+	p.bodies = append(p.bodies, string(msg.Body))
+	return nil
+}
+
+func TestParseHeaders(t *testing.T) {
+	table, err := parseHeaders([]string{"a=1", "b=x=y"})
+	if err != nil || table["a"] != "1" || table["b"] != "x=y" {
+		t.Errorf("Wrong headers %v %v", table, err)
+	}
+	if _, err := parseHeaders([]string{"nope"}); err == nil {
+		t.Error("Headers without = should fail")
+	}
+}
+
+func TestReadBodies(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.json"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.json"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(dir, "c.txt"), []byte("c"), 0644)
+
+	bodies, err := readBodies([]string{filepath.Join(dir, "*.json"), filepath.Join(dir, "c.txt")}, nil)
+	if err != nil || len(bodies) != 3 || string(bodies[0]) != "a" || string(bodies[2]) != "c" {
+		t.Errorf("Wrong bodies %q %v", bodies, err)
+	}
+	if _, err := readBodies([]string{filepath.Join(dir, "*.xml")}, nil); err == nil {
+		t.Error("Globs without matches should fail")
+	}
+
+	bodies, err = readBodies(nil, strings.NewReader("stdin"))
+	if err != nil || len(bodies) != 1 || string(bodies[0]) != "stdin" {
+		t.Errorf("Wrong stdin body %q %v", bodies, err)
+	}
+}
+
+func TestPublishLoop(t *testing.T) {
+	ch := &publishRecorder{}
+	msgs := []amqp.Publishing{{Body: []byte("a")}, {Body: []byte("b")}}
+	calls := 0
+	sent, err := publishLoop(context.Background(), ch, "app", "events", msgs, 3, 0, func() { calls++ })
+	if err != nil || sent != 3 || calls != 3 {
+		t.Errorf("Expected 3 messages, got %d %v", sent, err)
+	}
+	if strings.Join(ch.bodies, ",") != "a,b,a" || ch.keys[0] != "app/events" {
+		t.Errorf("Wrong messages %v %v", ch.keys, ch.bodies)
+	}
+}
+
+func TestPublishLoopRate(t *testing.T) {
+	ch := &publishRecorder{}
+	start := time.Now()
+	sent, _ := publishLoop(context.Background(), ch, "", "", []amqp.Publishing{{}}, 3, 50, func() {})
+	if sent != 3 || time.Since(start) < 40*time.Millisecond {
+		t.Errorf("Messages should be spread out, took %s", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sent, _ := publishLoop(ctx, ch, "", "", []amqp.Publishing{{}}, 3, 0, func() {}); sent != 0 {
+		t.Errorf("Cancelled publishes should stop, sent %d", sent)
+	}
+}
+
+func TestConfirmLatencies(t *testing.T) {
+	l := newConfirmLatencies()
+	for i := 0; i < 4; i++ {
+		l.sent()
+	}
+	now := l.sentAt[0]
+	for i := range l.sentAt {
+		l.sentAt[i] = now
+	}
+	l.confirmed(amqp.Confirmation{DeliveryTag: 1, Ack: true}, now.Add(10*time.Millisecond))
+	l.confirmed(amqp.Confirmation{DeliveryTag: 2, Ack: true}, now.Add(20*time.Millisecond))
+	l.confirmed(amqp.Confirmation{DeliveryTag: 3, Ack: false}, now.Add(30*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	l.wait(ctx, 4)
+
+	var out bytes.Buffer
+	l.report(&out, 4)
+	expected := "Confirmed 2, nacked 1, unconfirmed 1\nConfirm latency p50=20ms p90=30ms p99=30ms max=30ms\n"
+	if out.String() != expected {
+		t.Errorf("Wrong report\n%s", out.String())
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if percentile(sorted, 0.5) != 5 || percentile(sorted, 0.9) != 9 || percentile(sorted, 0.99) != 10 || percentile(sorted, 0) != 1 {
+		t.Error("Wrong percentiles")
+	}
+}
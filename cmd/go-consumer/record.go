@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+A message as a line of JSON.
+*/
+type record struct {
+	Exchange        string      `json:"exchange"`
+	RoutingKey      string      `json:"routing_key"`
+	Redelivered     bool        `json:"redelivered,omitempty"`
+	Headers         headerTable `json:"headers,omitempty"`
+	ContentType     string      `json:"content_type,omitempty"`
+	ContentEncoding string      `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8       `json:"delivery_mode,omitempty"`
+	Priority        uint8       `json:"priority,omitempty"`
+	CorrelationId   string      `json:"correlation_id,omitempty"`
+	ReplyTo         string      `json:"reply_to,omitempty"`
+	Expiration      string      `json:"expiration,omitempty"`
+	MessageId       string      `json:"message_id,omitempty"`
+	Timestamp       *time.Time  `json:"timestamp,omitempty"`
+	Type            string      `json:"type,omitempty"`
+	UserId          string      `json:"user_id,omitempty"`
+	AppId           string      `json:"app_id,omitempty"`
+	// Body is used for UTF-8 text, and BodyBase64 for anything else.
+	Body       *string `json:"body,omitempty"`
+	BodyBase64 string  `json:"body_base64,omitempty"`
+}
+
+func newRecord(d amqp.Delivery) record {
+	r := record{
+		Exchange:        d.Exchange,
+		RoutingKey:      d.RoutingKey,
+		Redelivered:     d.Redelivered,
+		Headers:         headerTable(d.Headers),
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+	}
+	if !d.Timestamp.IsZero() {
+		ts := d.Timestamp
+		r.Timestamp = &ts
+	}
+	if utf8.Valid(d.Body) {
+		body := string(d.Body)
+		r.Body = &body
+	} else {
+		r.BodyBase64 = base64.StdEncoding.EncodeToString(d.Body)
+	}
+	return r
+}
+
+/*
+Convert a record back into a message to publish.
+*/
+func (r record) publishing() (amqp.Publishing, error) {
+	msg := amqp.Publishing{
+		Headers:         amqp.Table(r.Headers),
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		CorrelationId:   r.CorrelationId,
+		ReplyTo:         r.ReplyTo,
+		Expiration:      r.Expiration,
+		MessageId:       r.MessageId,
+		Type:            r.Type,
+		UserId:          r.UserId,
+		AppId:           r.AppId,
+	}
+	if r.Timestamp != nil {
+		msg.Timestamp = *r.Timestamp
+	}
+	body, err := r.body()
+	msg.Body = body
+	return msg, err
+}
+
+func (r record) body() ([]byte, error) {
+	if r.Body != nil {
+		return []byte(*r.Body), nil
+	}
+	return base64.StdEncoding.DecodeString(r.BodyBase64)
+}
+
+/*
+Message headers, encoded to JSON without losing their AMQP types.
+
+Strings, booleans, int64s, nulls and arrays use their JSON form.
+Other values are tagged with their type as an object with a
+single key, such as {"bytes": "NDI="}, {"int32": 2} or
+{"table": {"count": 1}}.
+
+Objects that aren't a known tag are read as tables, so archives
+written before headers were tagged can still be read.
+*/
+type headerTable amqp.Table
+
+func (h headerTable) MarshalJSON() ([]byte, error) {
+	out, err := taggedValue(amqp.Table(h))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out.(map[string]interface{})["table"])
+}
+
+func (h *headerTable) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return err
+	}
+	table, err := untaggedTable(fields)
+	*h = headerTable(table)
+	return err
+}
+
+func taggedValue(value interface{}) (interface{}, error) {
+	tag := func(name string, v interface{}) map[string]interface{} {
+		return map[string]interface{}{name: v}
+	}
+	switch v := value.(type) {
+	case nil, bool, string, int64:
+		return v, nil
+	case []byte:
+		return tag("bytes", v), nil
+	case time.Time:
+		return tag("timestamp", v), nil
+	case uint8:
+		return tag("uint8", v), nil
+	case int16:
+		return tag("int16", v), nil
+	case int32:
+		return tag("int32", v), nil
+	case float32:
+		return tag("float32", v), nil
+	case float64:
+		return tag("float64", v), nil
+	case amqp.Decimal:
+		return tag("decimal", map[string]interface{}{"scale": v.Scale, "value": v.Value}), nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			tagged, err := taggedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = tagged
+		}
+		return out, nil
+	case amqp.Table:
+		out := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			tagged, err := taggedValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			out[name] = tagged
+		}
+		return tag("table", out), nil
+	}
+	return nil, fmt.Errorf("Unsupported header type %T.", value)
+}
+
+func untaggedValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			untagged, err := untaggedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = untagged
+		}
+		return out, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for name, tagged := range v {
+				if value, ok, err := untag(name, tagged); ok {
+					return value, err
+				}
+			}
+		}
+		return untaggedTable(v)
+	}
+	return value, nil
+}
+
+func untaggedTable(fields map[string]interface{}) (amqp.Table, error) {
+	if fields == nil {
+		return nil, nil
+	}
+	table := make(amqp.Table, len(fields))
+	for name, item := range fields {
+		value, err := untaggedValue(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		table[name] = value
+	}
+	return table, nil
+}
+
+/*
+Decode a tagged value. ok is false for unknown tags.
+*/
+func untag(name string, tagged interface{}) (value interface{}, ok bool, err error) {
+	text, _ := tagged.(string)
+	number, _ := tagged.(json.Number)
+	integer := func(bits int) (int64, error) {
+		return strconv.ParseInt(string(number), 10, bits)
+	}
+	ok = true
+	switch name {
+	case "bytes":
+		value, err = base64.StdEncoding.DecodeString(text)
+	case "timestamp":
+		value, err = time.Parse(time.RFC3339Nano, text)
+	case "uint8":
+		var n uint64
+		n, err = strconv.ParseUint(string(number), 10, 8)
+		value = uint8(n)
+	case "int16":
+		var n int64
+		n, err = integer(16)
+		value = int16(n)
+	case "int32":
+		var n int64
+		n, err = integer(32)
+		value = int32(n)
+	case "float32":
+		var f float64
+		f, err = strconv.ParseFloat(string(number), 32)
+		value = float32(f)
+	case "float64":
+		value, err = strconv.ParseFloat(string(number), 64)
+	case "decimal":
+		fields, _ := tagged.(map[string]interface{})
+		scale, _ := fields["scale"].(json.Number)
+		digits, _ := fields["value"].(json.Number)
+		var s uint64
+		var n int64
+		if s, err = strconv.ParseUint(string(scale), 10, 8); err == nil {
+			n, err = strconv.ParseInt(string(digits), 10, 32)
+		}
+		value = amqp.Decimal{Scale: uint8(s), Value: int32(n)}
+	case "table":
+		fields, isTable := tagged.(map[string]interface{})
+		if !isTable {
+			return nil, true, fmt.Errorf("Invalid table header.")
+		}
+		value, err = untaggedTable(fields)
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid %s header: %w", name, err)
+	}
+	return
+}
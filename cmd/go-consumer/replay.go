@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+/*
+Publish the messages in an archive.
+*/
+func replay(args []string, out io.Writer) error {
+	flags := newFlagSet("replay")
+	configFile := flags.String("config", "", "The configuration file with the connection to use.")
+	input := flags.String("in", "-", "The archive to read. Defaults to stdin.")
+	exchange := flags.String("exchange", "", "Publish to this exchange instead of the original ones.")
+	key := flags.String("key", "", "Publish with this routing key instead of the original ones.")
+	var rewrites, filters stringsFlag
+	flags.Var(&rewrites, "rewrite", "Replace routing key old with new, as old=new. Can be repeated.")
+	flags.Var(&filters, "filter", "Only replay matching messages, as field=pattern or body~text. Can be repeated.")
+	rate := flags.Float64("rate", 0, "Messages per second. Defaults to unlimited.")
+	confirm := flags.Bool("confirm", true, "Wait for publisher confirms.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *configFile == "" || flags.NArg() != 0 {
+		return errUsage
+	}
+	rewrite := map[string]string{}
+	for _, value := range rewrites {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("%w: invalid rewrite %q", errUsage, value)
+		}
+		rewrite[from] = to
+	}
+	matchers, err := parseFilters(filters)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	archive, err := newArchiveReader(r)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dial(*configFile)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	var confirms *confirmLatencies
+	if *confirm {
+		if err = channel.Confirm(false); err != nil {
+			return err
+		}
+		confirms = newConfirmLatencies()
+		go confirms.listen(channel.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	route := func(r record) (string, string) {
+		ex, rk := r.Exchange, r.RoutingKey
+		if *exchange != "" {
+			ex = *exchange
+		}
+		if to, ok := rewrite[rk]; ok {
+			rk = to
+		}
+		if *key != "" {
+			rk = *key
+		}
+		return ex, rk
+	}
+	sent, skipped, err := replayArchive(ctx, channel, archive, matchers, route, *rate, confirms.sent)
+
+	fmt.Fprintf(out, "Replayed %d messages, skipped %d\n", sent, skipped)
+	if confirms != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+		defer cancel()
+		confirms.wait(waitCtx, sent)
+		confirms.report(out, sent)
+	}
+	return err
+}
+
+/*
+Publish the matching messages in an archive to the
+exchange and routing key chosen by route.
+*/
+func replayArchive(ctx context.Context, ch publishChannel, archive *archiveReader, filters []filter, route func(record) (string, string), rate float64, onSent func()) (sent, skipped int, err error) {
+	pace := newPacer(rate)
+	for {
+		r, err := archive.next()
+		if err == io.EOF {
+			return sent, skipped, nil
+		}
+		if err != nil {
+			return sent, skipped, err
+		}
+		msg, err := r.publishing()
+		if err != nil {
+			return sent, skipped, err
+		}
+		if !matchFilters(filters, r, msg.Body) {
+			skipped++
+			continue
+		}
+		if !pace.wait(ctx) {
+			return sent, skipped, nil
+		}
+		exchange, key := route(r)
+		onSent()
+		if err = ch.Publish(exchange, key, false, false, msg); err != nil {
+			return sent, skipped, err
+		}
+		sent++
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"os/signal"
+	"syscall"
+)
+
+/*
+Move dead lettered messages back to where they came from.
+*/
+func requeue(args []string, out io.Writer) error {
+	flags := newFlagSet("requeue")
+	configFile := flags.String("config", "", "The configuration file with the connection to use.")
+	from := flags.String("from", "", "The dead letter queue to read.")
+	var filters stringsFlag
+	flags.Var(&filters, "filter", "Only requeue matching messages, as field=pattern or body~text. Can be repeated.")
+	dryRun := flags.Bool("dry-run", false, "Print what would be requeued and leave the messages in place.")
+	direct := flags.Bool("direct", false, "Publish straight to the queue the message died in, instead of its original exchange.")
+	count := flags.Int("count", 0, "Stop after this many messages.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *configFile == "" || *from == "" || flags.NArg() != 0 {
+		return errUsage
+	}
+	matchers, err := parseFilters(filters)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	conn, err := dial(*configFile)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err = channel.Confirm(false); err != nil {
+		return err
+	}
+
+	r := &requeuer{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		filters:  matchers,
+		direct:   *direct,
+		dryRun:   *dryRun,
+		out:      out,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err = r.run(ctx, *from, *count)
+	action := "Requeued"
+	if *dryRun {
+		action = "Would requeue"
+	}
+	fmt.Fprintf(out, "%s %d, skipped %d, failed %d\n", action, r.moved, r.skipped, r.failed)
+	return err
+}
+
+type requeueChannel interface {
+	getChannel
+	publishChannel
+}
+
+/*
+Republishes dead lettered messages one at a time.
+
+Each message is published with the mandatory flag and the dead
+lettered copy is acked only after the broker confirms it. A raw
+channel is used rather than a Publisher so returns are seen before
+confirms: with one message in flight, the broker sends basic.return
+before the ack for an unroutable message.
+
+Messages that are skipped or fail are held until the queue is
+empty and then returned to it, so none are fetched twice.
+*/
+type requeuer struct {
+	channel  requeueChannel
+	confirms <-chan amqp.Confirmation
+	returns  <-chan amqp.Return
+	filters  []filter
+	direct   bool
+	dryRun   bool
+	out      io.Writer
+
+	held                   []uint64
+	moved, skipped, failed int
+}
+
+func (r *requeuer) run(ctx context.Context, queue string, count int) (err error) {
+	defer func() {
+		for _, tag := range r.held {
+			if nackErr := r.channel.Nack(tag, false, true); err == nil {
+				err = nackErr
+			}
+		}
+	}()
+	for (count == 0 || r.moved < count) && ctx.Err() == nil {
+		d, ok, err := r.channel.Get(queue, false)
+		if err != nil || !ok {
+			return err
+		}
+		if err = r.requeue(ctx, d); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func (r *requeuer) requeue(ctx context.Context, d amqp.Delivery) error {
+	exchange, key, ok := deadLetterTarget(d, r.direct)
+	if !ok {
+		fmt.Fprintf(r.out, "skipped %s: no x-death header\n", describe(d))
+		return r.hold(d, &r.skipped)
+	}
+	if !matchFilters(r.filters, newRecord(d), d.Body) {
+		return r.hold(d, &r.skipped)
+	}
+	if r.dryRun {
+		fmt.Fprintf(r.out, "would requeue %s to %q with key %q\n", describe(d), exchange, key)
+		return r.hold(d, &r.moved)
+	}
+
+	err := r.channel.Publish(exchange, key, true, false, deliveryPublishing(d))
+	if err != nil {
+		return err
+	}
+	var confirm amqp.Confirmation
+	select {
+	case confirm, ok = <-r.confirms:
+		if !ok {
+			return fmt.Errorf("Channel closed before %s was confirmed.", describe(d))
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("Stopped before %s was confirmed.", describe(d))
+	}
+
+	select {
+	case ret := <-r.returns:
+		fmt.Fprintf(r.out, "failed %s: returned by the broker: %s\n", describe(d), ret.ReplyText)
+		return r.hold(d, &r.failed)
+	default:
+	}
+	if !confirm.Ack {
+		fmt.Fprintf(r.out, "failed %s: nacked by the broker\n", describe(d))
+		return r.hold(d, &r.failed)
+	}
+	fmt.Fprintf(r.out, "requeued %s to %q with key %q\n", describe(d), exchange, key)
+	r.moved++
+	return d.Ack(false)
+}
+
+func (r *requeuer) hold(d amqp.Delivery, counter *int) error {
+	r.held = append(r.held, d.DeliveryTag)
+	*counter++
+	return nil
+}
+
+/*
+Find where a message was published before it was dead lettered,
+from the most recent x-death entry. When direct is set the message
+is sent straight to the queue it died in using the default exchange.
+
+x-death is the only source read. The consumer dead letters messages
+by rejecting them, which can't add headers, so this package has no
+failure headers of its own. Messages moved to a dead letter queue
+some other way, such as republished by an application, are skipped.
+*/
+func deadLetterTarget(d amqp.Delivery, direct bool) (exchange, key string, ok bool) {
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return
+	}
+	death, _ := deaths[0].(amqp.Table)
+	if direct {
+		key, ok = death["queue"].(string)
+		return "", key, ok && key != ""
+	}
+	exchange, ok = death["exchange"].(string)
+	keys, _ := death["routing-keys"].([]interface{})
+	if !ok || len(keys) == 0 {
+		return "", "", false
+	}
+	key, ok = keys[0].(string)
+	return
+}
+
+/*
+Copy a delivery's body and properties into a message to publish.
+*/
+func deliveryPublishing(d amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+/*
+Name a message in output by its id, or its delivery tag without one.
+*/
+func describe(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return fmt.Sprintf("message %q", d.MessageId)
+	}
+	return fmt.Sprintf("delivery %d", d.DeliveryTag)
+}
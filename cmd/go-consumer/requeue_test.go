@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/streadway/amqp"
+	"strings"
+	"testing"
+)
+
+/*
+A dead letter queue that confirms publishes, returning
+or nacking messages sent with some routing keys.
+*/
+type dlqRecorder struct {
+	getRecorder
+	publishRecorder
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	nacked   []uint64
+	tag      uint64
+}
+
+func (d *dlqRecorder) Nack(tag uint64, multiple, requeue bool) error {
+	d.nacked = append(d.nacked, tag)
+	return nil
+}
+
+func (d *dlqRecorder) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	d.publishRecorder.Publish(exchange, key, mandatory, immediate, msg)
+	d.tag++
+	if key == "unroutable" {
+		d.returns <- amqp.Return{ReplyText: "NO_ROUTE"}
+	}
+	d.confirms <- amqp.Confirmation{DeliveryTag: d.tag, Ack: key != "nacked"}
+	return nil
+}
+
+func deadLettered(tag uint64, id, exchange, key string) amqp.Delivery {
+	return amqp.Delivery{
+		DeliveryTag: tag,
+		MessageId:   id,
+		Body:        []byte(id),
+		Headers: amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "orders", "exchange": exchange, "routing-keys": []interface{}{key}, "count": int64(1)},
+		}},
+	}
+}
+
+func newDlqRecorder(deliveries ...amqp.Delivery) *dlqRecorder {
+	return &dlqRecorder{
+		getRecorder: getRecorder{deliveries: deliveries, acks: &ackRecorder{}},
+		confirms:    make(chan amqp.Confirmation, 1),
+		returns:     make(chan amqp.Return, 1),
+	}
+}
+
+func TestDeadLetterTarget(t *testing.T) {
+	d := deadLettered(1, "a", "app", "order.created")
+	if ex, key, ok := deadLetterTarget(d, false); !ok || ex != "app" || key != "order.created" {
+		t.Errorf("Wrong target %s %s %t", ex, key, ok)
+	}
+	if ex, key, ok := deadLetterTarget(d, true); !ok || ex != "" || key != "orders" {
+		t.Errorf("Wrong direct target %s %s %t", ex, key, ok)
+	}
+	if _, _, ok := deadLetterTarget(amqp.Delivery{}, false); ok {
+		t.Error("Messages without x-death have no target")
+	}
+}
+
+func TestRequeuer(t *testing.T) {
+	ch := newDlqRecorder(
+		deadLettered(1, "ok", "app", "order.created"),
+		amqp.Delivery{DeliveryTag: 2, MessageId: "alive"},
+		deadLettered(3, "lost", "app", "unroutable"),
+		deadLettered(4, "refused", "app", "nacked"),
+		deadLettered(5, "skip-me", "app", "order.created"),
+	)
+	filters, _ := parseFilters([]string{"message_id=[olr]*"})
+	var out bytes.Buffer
+	r := &requeuer{channel: ch, confirms: ch.confirms, returns: ch.returns, filters: filters, out: &out}
+	if err := r.run(context.Background(), "orders.dlq", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.moved != 1 || r.skipped != 2 || r.failed != 2 {
+		t.Errorf("Wrong counts moved=%d skipped=%d failed=%d\n%s", r.moved, r.skipped, r.failed, out.String())
+	}
+	if ch.acks.acks != 1 {
+		t.Errorf("Only the confirmed message should be acked, got %d", ch.acks.acks)
+	}
+	if len(ch.nacked) != 4 || ch.nacked[0] != 2 || ch.nacked[3] != 5 {
+		t.Errorf("Other messages should be returned to the queue, got %v", ch.nacked)
+	}
+	if strings.Join(ch.keys, ",") != "app/order.created,app/unroutable,app/nacked" {
+		t.Errorf("Wrong publishes %v", ch.keys)
+	}
+	for _, line := range []string{
+		`requeued message "ok" to "app" with key "order.created"`,
+		`skipped message "alive": no x-death header`,
+		`failed message "lost": returned by the broker: NO_ROUTE`,
+		`failed message "refused": nacked by the broker`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Missing %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestRequeuerDryRun(t *testing.T) {
+	ch := newDlqRecorder(deadLettered(1, "ok", "app", "order.created"))
+	var out bytes.Buffer
+	r := &requeuer{channel: ch, confirms: ch.confirms, returns: ch.returns, dryRun: true, direct: true, out: &out}
+	if err := r.run(context.Background(), "orders.dlq", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(ch.keys) != 0 || ch.acks.acks != 0 || len(ch.nacked) != 1 {
+		t.Error("Dry runs should leave messages in place")
+	}
+	if out.String() != `would requeue message "ok" to "" with key "orders"`+"\n" {
+		t.Errorf("Wrong output %q", out.String())
+	}
+}
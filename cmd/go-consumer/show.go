@@ -0,0 +1,127 @@
+package main
+
+import (
+	"code.google.com/p/goconf/conf"
+	"encoding/json"
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"io"
+	"text/tabwriter"
+)
+
+type showConnection struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	VHost    string `json:"vhost"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type showExchange struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"auto_delete"`
+}
+
+type showQueue struct {
+	Name       string `json:"name"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"auto_delete"`
+	Exclusive  bool   `json:"exclusive"`
+	Requeue    bool   `json:"requeue"`
+	Workers    int    `json:"workers"`
+}
+
+type showBinding struct {
+	Exchange   string `json:"exchange"`
+	Queue      string `json:"queue"`
+	RoutingKey string `json:"routing_key"`
+}
+
+type showTopology struct {
+	Connection showConnection `json:"connection"`
+	Exchanges  []showExchange `json:"exchanges"`
+	Queues     []showQueue    `json:"queues"`
+	Bindings   []showBinding  `json:"bindings"`
+}
+
+/*
+Print the topology a configuration file resolves to,
+with the connection password masked.
+*/
+func show(args []string, out io.Writer) error {
+	flags := newFlagSet("show")
+	asJson := flags.Bool("json", false, "Print JSON instead of tables.")
+	path, err := parseConfigArg(flags, args)
+	if err != nil {
+		return err
+	}
+	config, err := conf.ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	top, err := consumer.NewTopology(config)
+	if err != nil {
+		return err
+	}
+
+	conn := top.Connection()
+	s := showTopology{
+		Connection: showConnection{
+			Host:     conn.Host(),
+			Port:     conn.Port(),
+			VHost:    conn.VHost(),
+			User:     conn.User(),
+			Password: "****",
+		},
+	}
+	seen := map[string]bool{}
+	for _, b := range top.Bindings() {
+		ex, q := b.Exchange(), b.Queue()
+		if !seen[ex.Name()] {
+			seen[ex.Name()] = true
+			s.Exchanges = append(s.Exchanges, showExchange{
+				Name:       ex.Name(),
+				Type:       ex.Kind(),
+				Durable:    ex.Durable(),
+				AutoDelete: ex.AutoDelete(),
+			})
+		}
+		s.Queues = append(s.Queues, showQueue{
+			Name:       q.Name(),
+			Durable:    q.Durable(),
+			AutoDelete: q.AutoDelete(),
+			Exclusive:  q.Exclusive(),
+			Requeue:    q.Requeue(),
+			Workers:    q.Workers(),
+		})
+		s.Bindings = append(s.Bindings, showBinding{
+			Exchange:   ex.Name(),
+			Queue:      q.Name(),
+			RoutingKey: q.RoutingKey(),
+		})
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	fmt.Fprintf(out, "Connection: %s\n", conn.SafeUrl())
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\nEXCHANGE\tTYPE\tDURABLE\tAUTO DELETE")
+	for _, ex := range s.Exchanges {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", ex.Name, ex.Type, ex.Durable, ex.AutoDelete)
+	}
+	fmt.Fprintln(w, "\nQUEUE\tDURABLE\tAUTO DELETE\tEXCLUSIVE\tREQUEUE\tWORKERS")
+	for _, q := range s.Queues {
+		fmt.Fprintf(w, "%s\t%t\t%t\t%t\t%t\t%d\n", q.Name, q.Durable, q.AutoDelete, q.Exclusive, q.Requeue, q.Workers)
+	}
+	fmt.Fprintln(w, "\nEXCHANGE\tQUEUE\tROUTING KEY")
+	for _, b := range s.Bindings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", b.Exchange, b.Queue, b.RoutingKey)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goconf/conf"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"github.com/streadway/amqp"
+	"io"
+	"mime"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+/*
+Flag that can be given more than once.
+*/
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+/*
+Print messages sent to an exchange.
+
+Messages are copied to a temporary queue, so consumers
+of the exchange's queues still receive them.
+*/
+func tail(args []string, out io.Writer) error {
+	flags := newFlagSet("tail")
+	configFile := flags.String("config", "", "The configuration file with the connection to use.")
+	exchange := flags.String("exchange", "", "The exchange to watch.")
+	var keys stringsFlag
+	flags.Var(&keys, "key", "Routing key to bind with. Can be repeated. Defaults to #.")
+	asJson := flags.Bool("json", false, "Print messages as lines of JSON.")
+	count := flags.Int("count", 0, "Stop after this many messages.")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *configFile == "" || *exchange == "" || flags.NArg() != 0 {
+		return errUsage
+	}
+	if len(keys) == 0 {
+		keys = stringsFlag{"#"}
+	}
+
+	conn, err := dial(*configFile)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	q, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = channel.QueueBind(q.Name, key, *exchange, false, nil); err != nil {
+			return err
+		}
+	}
+	deliveries, err := channel.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	enc := json.NewEncoder(out)
+	for seen := 0; *count == 0 || seen < *count; seen++ {
+		var d amqp.Delivery
+		var ok bool
+		select {
+		case d, ok = <-deliveries:
+		case <-ctx.Done():
+			return nil
+		}
+		if !ok {
+			return fmt.Errorf("Connection closed.")
+		}
+		if *asJson {
+			err = enc.Encode(newRecord(d))
+		} else {
+			err = printDelivery(out, d)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Connect to the broker in a configuration file.
+*/
+func dial(configFile string) (*amqp.Connection, error) {
+	config, err := conf.ReadConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	top, err := consumer.NewTopology(config)
+	if err != nil {
+		return nil, err
+	}
+	conn := top.Connection()
+	return amqp.Dial(conn.Url())
+}
+
+/*
+Print a message for people, formatting the body
+based on its content type.
+*/
+func printDelivery(out io.Writer, d amqp.Delivery) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s exchange=%q redelivered=%t\n", d.RoutingKey, d.Exchange, d.Redelivered)
+	r := newRecord(d)
+	properties := map[string]string{
+		"content-type":     r.ContentType,
+		"content-encoding": r.ContentEncoding,
+		"correlation-id":   r.CorrelationId,
+		"reply-to":         r.ReplyTo,
+		"message-id":       r.MessageId,
+		"type":             r.Type,
+		"app-id":           r.AppId,
+	}
+	if r.Timestamp != nil {
+		properties["timestamp"] = r.Timestamp.String()
+	}
+	for name, value := range r.Headers {
+		properties[name] = headerValue(value)
+	}
+	names := make([]string, 0, len(properties))
+	for name, value := range properties {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s: %s\n", name, properties[name])
+	}
+	buf.WriteString("\n")
+	buf.WriteString(formatBody(d))
+	buf.WriteString("\n")
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+func formatBody(d amqp.Delivery) string {
+	msg := &consumer.Message{Delivery: d}
+	body, err := msg.DecodedBody()
+	if err != nil {
+		return fmt.Sprintf("(%v)\n%s", err, hex.Dump(d.Body))
+	}
+	mediaType, _, _ := mime.ParseMediaType(d.ContentType)
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") == nil {
+			return pretty.String() + "\n"
+		}
+	}
+	if isText(body) {
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			return string(body) + "\n"
+		}
+		return string(body)
+	}
+	return hex.Dump(body)
+}
+
+func isText(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, r := range string(body) {
+		if r < ' ' && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/streadway/amqp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRecord(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := newRecord(amqp.Delivery{
+		Exchange:    "events",
+		RoutingKey:  "order.created",
+		ContentType: "application/json",
+		Timestamp:   ts,
+		Headers: amqp.Table{
+			"customer": []byte("42"),
+			"nested":   amqp.Table{"tries": int32(2)},
+		},
+		Body: []byte(`{"id":1}`),
+	})
+	line, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"exchange":"events","routing_key":"order.created","headers":{"customer":{"bytes":"NDI="},"nested":{"table":{"tries":{"int32":2}}}},` +
+		`"content_type":"application/json","timestamp":"2024-01-02T03:04:05Z","body":"{\"id\":1}"}`
+	if string(line) != expected {
+		t.Errorf("Wrong record\n%s", line)
+	}
+
+	r = newRecord(amqp.Delivery{Body: []byte{0xff}})
+	if r.Body != nil || r.BodyBase64 != "/w==" {
+		t.Errorf("Binary bodies should be base64 encoded, got %#v", r)
+	}
+}
+
+func TestPrintDelivery(t *testing.T) {
+	var out bytes.Buffer
+	printDelivery(&out, amqp.Delivery{
+		Exchange:    "events",
+		RoutingKey:  "order.created",
+		ContentType: "application/json",
+		Headers:     amqp.Table{"customer": []byte("42")},
+		Body:        []byte(`{"id":1}`),
+	})
+	expected := `--- order.created exchange="events" redelivered=false
+content-type: application/json
+customer: 42
+
+{
+  "id": 1
+}
+
+`
+	if out.String() != expected {
+		t.Errorf("Wrong output\n%s", out.String())
+	}
+}
+
+func TestFormatBody(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("hello"))
+	w.Close()
+	if body := formatBody(amqp.Delivery{ContentType: "text/plain", ContentEncoding: "gzip", Body: gz.Bytes()}); body != "hello\n" {
+		t.Errorf("Compressed bodies should be decompressed, got %q", body)
+	}
+	if body := formatBody(amqp.Delivery{Body: []byte{0, 1, 2}}); !strings.HasPrefix(body, "00000000  00 01 02") {
+		t.Errorf("Binary bodies should be hex dumped, got %q", body)
+	}
+	if body := formatBody(amqp.Delivery{ContentType: "application/json", Body: []byte("not json")}); body != "not json\n" {
+		t.Errorf("Invalid JSON should be printed as text, got %q", body)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"code.google.com/p/goconf/conf"
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"io"
+)
+
+/*
+Print the problems in a configuration file, failing
+if any of them are errors.
+*/
+func validate(args []string, out io.Writer) error {
+	path, err := parseConfigArg(newFlagSet("validate"), args)
+	if err != nil {
+		return err
+	}
+	config, err := conf.ReadConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, problem := range consumer.ValidateConfig(config) {
+		fmt.Fprintln(out, problem)
+		failed = failed || !problem.Warning
+	}
+	if failed {
+		return errFailed
+	}
+	fmt.Fprintf(out, "%s: OK\n", path)
+	return nil
+}
@@ -0,0 +1,188 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sync"
+)
+
+/*
+Encodes and decodes message bodies for a content type.
+*/
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+/*
+Adapts a pair of functions into a Codec.
+
+Handy for registering third party encoders, for example:
+
+	consumer.RegisterCodec("application/cbor", consumer.CodecFuncs{
+		MarshalFunc:   cbor.Marshal,
+		UnmarshalFunc: cbor.Unmarshal,
+	})
+*/
+type CodecFuncs struct {
+	MarshalFunc   func(v interface{}) ([]byte, error)
+	UnmarshalFunc func(data []byte, v interface{}) error
+}
+
+func (c CodecFuncs) Marshal(v interface{}) ([]byte, error) {
+	return c.MarshalFunc(v)
+}
+
+func (c CodecFuncs) Unmarshal(data []byte, v interface{}) error {
+	return c.UnmarshalFunc(data, v)
+}
+
+/*
+The content type used for messages that don't set one.
+*/
+var DefaultContentType = "application/json"
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"application/json":       jsonCodec{},
+		"text/plain":             textCodec{},
+		"application/msgpack":    msgpackCodec{},
+		"application/x-msgpack":  msgpackCodec{},
+		"application/protobuf":   protoCodec{},
+		"application/x-protobuf": protoCodec{},
+	}
+)
+
+/*
+Register a codec for a content type, replacing any existing codec.
+
+JSON, plain text, msgpack and protobuf codecs are registered by default.
+*/
+func RegisterCodec(contentType string, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[contentType] = codec
+}
+
+/*
+Find the codec for a content type. Parameters such as charset are ignored.
+*/
+func CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = DefaultContentType
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid content type %q: %v", contentType, err)
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("No codec registered for content type %q.", mediaType)
+	}
+	return codec, nil
+}
+
+/*
+Error returned when a message body cannot be decoded.
+
+Handlers that return a DecodeError have their message rejected
+without requeueing so it ends up in the queue's dead letter exchange.
+*/
+type DecodeError struct {
+	ContentType string
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Could not decode %q message: %v", e.ContentType, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+/*
+Plain text bodies can be decoded into *string or *[]byte.
+*/
+type textCodec struct{}
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	switch s := v.(type) {
+	case string:
+		return []byte(s), nil
+	case []byte:
+		return s, nil
+	case fmt.Stringer:
+		return []byte(s.String()), nil
+	}
+	return nil, fmt.Errorf("Cannot encode %T as text.", v)
+}
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	switch s := v.(type) {
+	case *string:
+		*s = string(data)
+	case *[]byte:
+		*s = append((*s)[:0], data...)
+	default:
+		return fmt.Errorf("Cannot decode text into %T.", v)
+	}
+	return nil
+}
+
+/*
+Works with generated protobuf types that have Marshal and Unmarshal
+methods, so the protobuf runtime isn't a dependency of this package.
+
+Only gogo/protobuf style types have these methods. Messages generated
+by protoc-gen-go for google.golang.org/protobuf don't, so register a
+codec wrapping proto.Marshal and proto.Unmarshal for them instead:
+
+	consumer.RegisterCodec("application/x-protobuf", consumer.CodecFuncs{
+		MarshalFunc: func(v interface{}) ([]byte, error) {
+			return proto.Marshal(v.(proto.Message))
+		},
+		UnmarshalFunc: func(data []byte, v interface{}) error {
+			return proto.Unmarshal(data, v.(proto.Message))
+		},
+	})
+*/
+type protoCodec struct{}
+
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type protoUnmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(protoMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message.", v)
+	}
+	return m.Marshal()
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(protoUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message.", v)
+	}
+	return m.Unmarshal(data)
+}
@@ -0,0 +1,111 @@
+package consumer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCodecForDefault(t *testing.T) {
+	codec, err := CodecFor("")
+	if err != nil {
+		t.Error("Should not make an error")
+	}
+	if _, ok := codec.(jsonCodec); !ok {
+		t.Error("Default codec should be JSON")
+	}
+}
+
+func TestCodecForIgnoresParameters(t *testing.T) {
+	codec, err := CodecFor("text/plain; charset=utf-8")
+	if err != nil {
+		t.Errorf("Should not make an error. Got %s", err)
+	}
+	if _, ok := codec.(textCodec); !ok {
+		t.Error("Should find the text codec")
+	}
+}
+
+func TestCodecForUnknown(t *testing.T) {
+	_, err := CodecFor("application/x-unknown")
+	if err == nil {
+		t.Error("Should fail on unknown content types")
+	}
+	if !strings.Contains(err.Error(), "No codec registered") {
+		t.Errorf("Error message is wrong. Got %s", err)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("application/x-upper", CodecFuncs{
+		MarshalFunc: func(v interface{}) ([]byte, error) {
+			return []byte(strings.ToUpper(v.(string))), nil
+		},
+		UnmarshalFunc: func(data []byte, v interface{}) error {
+			*v.(*string) = strings.ToLower(string(data))
+			return nil
+		},
+	})
+	codec, err := CodecFor("application/x-upper")
+	if err != nil {
+		t.Fatal("Registered codec should be found")
+	}
+	out, _ := codec.Marshal("hi")
+	if string(out) != "HI" {
+		t.Error("Marshal is wrong")
+	}
+}
+
+type fakeProto struct {
+	value string
+}
+
+func (p *fakeProto) Marshal() ([]byte, error) {
+	return []byte(p.value), nil
+}
+
+func (p *fakeProto) Unmarshal(data []byte) error {
+	p.value = string(data)
+	return nil
+}
+
+func TestProtoCodec(t *testing.T) {
+	msg := &Message{}
+	msg.ContentType = "application/x-protobuf"
+	msg.Body = []byte("payload")
+	var p fakeProto
+	if err := msg.Decode(&p); err != nil {
+		t.Errorf("Should not make an error. Got %s", err)
+	}
+	if p.value != "payload" {
+		t.Error("Protobuf message was not decoded")
+	}
+	var s string
+	if err := msg.Decode(&s); err == nil {
+		t.Error("Should fail on non protobuf types")
+	}
+}
+
+func TestMessageDecode(t *testing.T) {
+	msg := &Message{}
+	msg.ContentType = "application/json"
+	msg.Body = []byte(`{"id": 3}`)
+	var v struct{ Id int }
+	if err := msg.Decode(&v); err != nil {
+		t.Errorf("Should not make an error. Got %s", err)
+	}
+	if v.Id != 3 {
+		t.Error("Body was not decoded")
+	}
+}
+
+func TestMessageDecodeError(t *testing.T) {
+	msg := &Message{}
+	msg.Body = []byte(`{nope`)
+	var v map[string]interface{}
+	err := msg.Decode(&v)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("Should return a DecodeError. Got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+/*
+Wraps a compressed body in a reader that decompresses it.
+*/
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+/*
+The largest decompressed body accepted when a queue
+doesn't set max_decompressed_size.
+*/
+var DefaultMaxDecompressedSize int64 = 64 << 20
+
+/*
+Error returned when a decompressed body is larger than the queue allows.
+*/
+var ErrBodyTooLarge = errors.New("Decompressed message body exceeds max_decompressed_size.")
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = map[string]Decompressor{
+		"gzip":    gzipReader,
+		"x-gzip":  gzipReader,
+		"deflate": zlibReader,
+	}
+)
+
+/*
+Register a decompressor for a ContentEncoding, replacing any existing one.
+
+gzip and deflate are registered by default. Other encodings can be
+added using third party packages, for example:
+
+	consumer.RegisterDecompressor("zstd", func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	})
+*/
+func RegisterDecompressor(encoding string, d Decompressor) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	decompressors[strings.ToLower(encoding)] = d
+}
+
+/*
+Decompress body according to encoding, reading at most limit bytes.
+*/
+func decompress(encoding string, body []byte, limit int64) ([]byte, error) {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	decompressorsMu.RLock()
+	d, ok := decompressors[encoding]
+	decompressorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("No decompressor registered for content encoding %q.", encoding)
+	}
+
+	r, err := d(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if limit <= 0 {
+		limit = DefaultMaxDecompressedSize
+	}
+	// Read one byte past the limit so oversized bodies can be detected.
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return out, nil
+}
+
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func zlibReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
@@ -0,0 +1,115 @@
+package consumer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/streadway/amqp"
+	"io"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// A small gzip body that expands to 1MB.
+func bomb(t *testing.T) (d amqp.Delivery) {
+	d.ContentEncoding = "gzip"
+	d.ContentType = "text/plain"
+	d.Body = gzipped(t, make([]byte, 1<<20))
+	return
+}
+
+func TestDecodedBodyIdentity(t *testing.T) {
+	msg := &Message{}
+	msg.Body = []byte("plain")
+	body, err := msg.DecodedBody()
+	if err != nil {
+		t.Error("Should not make an error")
+	}
+	if string(body) != "plain" {
+		t.Error("Body should be unchanged")
+	}
+}
+
+func TestDecodedBodyGzip(t *testing.T) {
+	msg := &Message{}
+	msg.ContentEncoding = "gzip"
+	msg.Body = gzipped(t, []byte("hello world"))
+	body, err := msg.DecodedBody()
+	if err != nil {
+		t.Errorf("Should not make an error. Got %s", err)
+	}
+	if string(body) != "hello world" {
+		t.Errorf("Body was not decompressed. Got %q", body)
+	}
+}
+
+func TestDecodedBodyDeflate(t *testing.T) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte("hello deflate"))
+	w.Close()
+
+	msg := &Message{}
+	msg.ContentEncoding = "deflate"
+	msg.Body = buf.Bytes()
+	body, err := msg.DecodedBody()
+	if err != nil {
+		t.Errorf("Should not make an error. Got %s", err)
+	}
+	if string(body) != "hello deflate" {
+		t.Errorf("Body was not decompressed. Got %q", body)
+	}
+}
+
+func TestDecodedBodyTooLarge(t *testing.T) {
+	msg := newMessage(queue{maxDecompressedSize: 100}, bomb(t))
+	_, err := msg.DecodedBody()
+	if err != ErrBodyTooLarge {
+		t.Errorf("Should fail on large bodies. Got %v", err)
+	}
+	var v string
+	if err := msg.Decode(&v); err == nil {
+		t.Error("Decode should fail on large bodies")
+	}
+}
+
+func TestDecodedBodyUnknownEncoding(t *testing.T) {
+	msg := &Message{}
+	msg.ContentEncoding = "br"
+	_, err := msg.DecodedBody()
+	if err == nil {
+		t.Fatal("Should fail on unknown encodings")
+	}
+	if !strings.Contains(err.Error(), "No decompressor registered") {
+		t.Errorf("Error message is wrong. Got %s", err)
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	RegisterDecompressor("X-Reverse", func(r io.Reader) (io.ReadCloser, error) {
+		data, _ := io.ReadAll(r)
+		for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	msg := &Message{}
+	msg.ContentEncoding = "x-reverse"
+	msg.ContentType = "text/plain"
+	msg.Body = []byte("olleh")
+	var v string
+	if err := msg.Decode(&v); err != nil {
+		t.Errorf("Should not make an error. Got %s", err)
+	}
+	if v != "hello" {
+		t.Errorf("Body was not decompressed. Got %q", v)
+	}
+}
@@ -2,23 +2,27 @@ package consumer
 
 import (
 	"code.google.com/p/goconf/conf"
+	"context"
+	"errors"
 	"github.com/streadway/amqp"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 /*
 Declare the exchange based on the config file.
 */
-func bind(conn *amqp.Connection, top topology) (err error) {
+func bind(conn Broker, top topology, logger Logger) (err error) {
 	channel, err := conn.Channel()
 	if err != nil {
 		return
 	}
 	for _, bind := range top.Bindings() {
-		err := declare(channel, bind)
+		err = declare(channel, bind, logger)
 		if err != nil {
 			break
 		}
@@ -26,22 +30,25 @@ func bind(conn *amqp.Connection, top topology) (err error) {
 	return
 }
 
-func declare(channel *amqp.Channel, bind binding) (err error) {
+func declare(channel Channel, bind binding, logger Logger) (err error) {
 	ex := bind.Exchange()
-	log.Printf("Declaring Exchange %s", ex)
-	err = channel.ExchangeDeclare(ex.name, ex.kind, ex.durable, ex.autoDelete, false, false, nil)
+	err = declareExchange(channel, ex, logger)
 	if err != nil {
 		return
 	}
 
 	q := bind.Queue()
-	log.Printf("Declaring Queue %s", q)
+	logger.Info("Declaring queue",
+		"queue", q.name,
+		"durable", q.durable,
+		"auto_delete", q.autoDelete,
+		"exclusive", q.exclusive)
 	_, err = channel.QueueDeclare(q.name, q.durable, q.autoDelete, q.exclusive, false, nil)
 	if err != nil {
 		return
 	}
 
-	log.Printf("Declaring Binding %s routingkey=%s", q.name, q.routingKey)
+	logger.Info("Declaring binding", "queue", q.name, "exchange", ex.name, "routing_key", q.routingKey)
 	err = channel.QueueBind(q.name, q.routingKey, ex.name, false, nil)
 	if err != nil {
 		return
@@ -49,13 +56,23 @@ func declare(channel *amqp.Channel, bind binding) (err error) {
 	return
 }
 
+func declareExchange(channel Channel, ex exchange, logger Logger) error {
+	logger.Info("Declaring exchange",
+		"exchange", ex.name,
+		"type", ex.kind,
+		"durable", ex.durable,
+		"auto_delete", ex.autoDelete)
+	return channel.ExchangeDeclare(ex.name, ex.kind, ex.durable, ex.autoDelete, false, false, nil)
+}
+
 /*
 Create a new consumer using the connection, exchange
 binding and queue configurations in the provide configuration
 file. Once created you can bind consumers to start handling messages
 */
-func Create(configFile string) (c *Consumer, err error) {
-	log.Printf("Creating new consumer for config file: %s", configFile)
+func Create(configFile string, opts ...Option) (c *Consumer, err error) {
+	o := newOptions(opts)
+	o.logger.Info("Creating new consumer", "config", configFile)
 
 	config, err := conf.ReadConfigFile(configFile)
 	if err != nil {
@@ -68,14 +85,74 @@ func Create(configFile string) (c *Consumer, err error) {
 	}
 
 	c = &Consumer{
-		conf: config,
+		conf:     config,
 		topology: topology,
+		logger:   o.logger,
+		dial:     o.dial,
+
+		tracer:      o.tracer,
+		propagators: o.propagators,
+	}
+	if config.HasSection("metrics") {
+		c.metricsConf, err = newMetricsConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		c.metrics = newMetrics()
+	}
+	if config.HasSection("health") {
+		health, err := newHealthConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		c.healthConf = &health
+	}
+	if config.HasSection("admin") {
+		admin, err := newAdminConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		c.adminConf = &admin
 	}
+	c.status = newStatusTracker(topology)
+	c.breakers = newBreakers(topology)
+	c.limiters = newLimiters(topology)
 	return
 }
 
 type worker func(*Message)
 
+/*
+A function that handles a single message.
+
+The context is cancelled once the queue's handler_timeout has elapsed.
+Returning nil acks the message unless the handler has already settled it.
+Returning an error nacks the message following the queue's failure policy.
+*/
+type Handler func(ctx context.Context, msg *Message) error
+
+/*
+Create a Handler that decodes each message into a T before calling fn.
+
+Messages that can't be decoded never reach fn, they are rejected
+without requeueing so the broker can dead-letter them.
+*/
+func TypedHandler[T any](fn func(ctx context.Context, v T) error) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		var v T
+		err := msg.Decode(&v)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, v)
+	}
+}
+
+/*
+Error used when a handler does not finish within the queue's handler_timeout.
+*/
+var ErrHandlerTimeout = errors.New("Handler did not finish before handler_timeout.")
+
 /*
 A consumer that applications use to register
 functions to act as consumers.
@@ -87,10 +164,39 @@ method as well.
 */
 type Consumer struct {
 	conf      *conf.ConfigFile
-	conn      *amqp.Connection
-	channel   *amqp.Channel
+	conn      Broker
+	dial      Dialer
+	channels  map[string]Channel
+	done      chan struct{}
 	topology  topology
 	connected bool
+	mu        sync.Mutex
+	handler   Handler
+	autoAck   bool
+	batch     BatchHandler
+	paused    map[string]pauseReason
+	consuming map[string]<-chan amqp.Delivery
+	running   map[string]chan struct{}
+	breakers  map[string]*breaker
+	limiters  map[string]*limiter
+	keyFuncs  map[string]KeyFunc
+	onBreaker func(queue string, from, to BreakerState)
+	onEvent   func(Event)
+	logger    Logger
+
+	tracer      Tracer
+	propagators []Propagator
+
+	metrics     *metrics
+	metricsConf metricsConfig
+	status      *statusTracker
+	healthConf  *healthConfig
+	adminConf   *adminConfig
+	servers     []*http.Server
+}
+
+func (c *Consumer) log() Logger {
+	return loggerOrDefault(c.logger)
 }
 
 /*
@@ -112,24 +218,48 @@ Create the connection. Declare the exchange.
 Declare the queue. Bind the queue + exchange together.
 */
 func (c *Consumer) Connect() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.connected {
 		return err
 	}
 
 	connData := c.topology.Connection()
-	conn, err := amqp.Dial(connData.Url())
+	conn, err := dialerOrDefault(c.dial)(connData.Url())
 	if err != nil {
 		return
 	}
+	if c.conn != nil {
+		c.log().Info("Reconnected to broker", "host", connData.host, "vhost", connData.vhost)
+		c.metrics.reconnected()
+	}
 
-	err = bind(conn, c.topology)
+	err = bind(conn, c.topology, c.log())
 	if err != nil {
+		conn.Close()
 		return
 	}
 	c.conn = conn
+	c.connected = true
+	c.status.setConnected(true, true)
+	go c.watchConnection(conn.NotifyClose(make(chan *amqp.Error, 1)))
 	return
 }
 
+/*
+Mark the consumer as disconnected when the connection closes.
+*/
+func (c *Consumer) watchConnection(closed <-chan *amqp.Error) {
+	err, ok := <-closed
+	if ok && err != nil {
+		c.log().Error("Connection closed", "error", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	c.status.setConnected(false, false)
+}
+
 /*
 Takes a function that accepts amqp.Delivery and binds
 it to the configured queue.
@@ -138,55 +268,317 @@ The provided function will be called each time a message is
 received and the function is expected to Ack or Nack the message.
 */
 func (c *Consumer) Consume(handler worker) (err error) {
+	return c.consume(func(ctx context.Context, msg *Message) error {
+		handler(msg)
+		return nil
+	}, false)
+}
+
+/*
+Binds a Handler to the configured queues.
+
+Unlike Consume, messages are settled based on the value the
+handler returns, and the handler's context honours the queue's
+handler_timeout.
+*/
+func (c *Consumer) ConsumeContext(handler Handler) (err error) {
+	return c.consume(handler, true)
+}
+
+func (c *Consumer) consume(handler Handler, autoAck bool) (err error) {
 	err = c.Connect()
 	if err != nil {
 		return
 	}
-	channel, err := c.conn.Channel()
+	c.startServers()
+
+	c.mu.Lock()
+	c.channels = make(map[string]Channel)
+	c.done = make(chan struct{})
+	c.handler = handler
+	c.autoAck = autoAck
 	for _, binding := range c.topology.Bindings() {
-		queue := binding.Queue()
-		log.Printf("Consuming from queue: %s", queue.Name())
+		err = c.consumeQueue(binding.Queue())
+		if err != nil {
+			break
+		}
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
 
-		messages, err := channel.Consume(queue.Name(), queue.Tag(), false, queue.Exclusive(), false, false, nil)
+	return c.StartLoop()
+}
+
+/*
+Start consuming from a queue on its own channel.
+Must be called with c.mu held.
+
+Each queue gets a channel so that acking several messages
+at once can't ack messages from other queues.
+*/
+func (c *Consumer) consumeQueue(q queue) (err error) {
+	c.log().Info("Consuming from queue", "queue", q.Name(), "consumer_tag", q.Tag())
+
+	channel := c.channels[q.name]
+	if channel == nil {
+		channel, err = c.conn.Channel()
 		if err != nil {
 			return err
 		}
-		go c.process(handler, messages)
+		c.channels[q.name] = channel
+	}
+	if prefetch := c.prefetch(q); prefetch > 0 {
+		if err = channel.Qos(prefetch, 0, false); err != nil {
+			return err
+		}
+	}
+	messages, err := channel.Consume(q.Name(), q.Tag(), false, q.Exclusive(), false, false, nil)
+	if err != nil {
+		return err
+	}
+	if c.consuming == nil {
+		c.consuming = make(map[string]<-chan amqp.Delivery)
+	}
+	c.consuming[q.Name()] = messages
+	c.status.setState(q.Name(), QueueConsuming)
+	if c.batch != nil {
+		c.startAfterPrevious(q, func() { c.processBatch(q, c.batch, messages) })
+		return nil
+	}
+	if q.partitions > 0 {
+		c.startAfterPrevious(q, func() { c.processPartitioned(q, c.handler, c.autoAck, messages) })
+		return nil
 	}
+	for i := 0; i < q.workers; i++ {
+		go c.process(q, c.handler, c.autoAck, messages)
+	}
+	return nil
+}
 
-	c.StartLoop()
-	return
+/*
+Start fn in a goroutine once the one started by the queue's previous
+consume has returned. Must be called with c.mu held.
+
+After a pause the old goroutine can still be handling deliveries on
+the same channel, and letting a new one settle messages alongside it
+could ack messages that belong to the other, or handle a key's
+messages out of order.
+*/
+func (c *Consumer) startAfterPrevious(q queue, fn func()) {
+	if c.running == nil {
+		c.running = make(map[string]chan struct{})
+	}
+	previous := c.running[q.name]
+	done := make(chan struct{})
+	c.running[q.name] = done
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		fn()
+	}()
 }
 
 /*
 Consumer from the channel - run inside a separate goroutine
+
+A queue with several workers runs one of these per worker,
+all reading from the same channel.
 */
-func (c *Consumer) process(handler worker, messages <-chan amqp.Delivery) {
+func (c *Consumer) process(q queue, handler Handler, autoAck bool, messages <-chan amqp.Delivery) {
+	limiter := c.limiters[q.name]
 	for rawMsg := range messages {
-		msg := &Message{rawMsg}
-		handler(msg)
+		limiter.wait(context.Background())
+		err := c.deliver(q, handler, autoAck, rawMsg)
+		c.observe(q, err)
+	}
+	c.stopped(q, messages)
+}
+
+/*
+Mark a queue as stopped once its delivery channel closes.
+*/
+func (c *Consumer) stopped(q queue, messages <-chan amqp.Delivery) {
+	// Pausing or resuming the queue replaces its delivery channel,
+	// and the queue's state is no longer ours to change.
+	if !c.isConsuming(q.name, messages) {
+		return
+	}
+	c.log().Info("Stopped consuming from queue", "queue", q.name)
+	c.status.setState(q.name, QueueStopped)
+}
+
+/*
+Record a delivery arriving, then handle it.
+*/
+func (c *Consumer) deliver(q queue, handler Handler, autoAck bool, rawMsg amqp.Delivery) error {
+	return c.run(q, handler, autoAck, c.receive(q, rawMsg))
+}
+
+/*
+Record a delivery arriving and wrap it in a Message.
+*/
+func (c *Consumer) receive(q queue, rawMsg amqp.Delivery) *Message {
+	msg := newMessage(q, c.metrics.received(q.name, rawMsg))
+	msg.logger = c.logger
+	msg.metrics = c.metrics
+	c.status.received(q.name)
+	return msg
+}
+
+/*
+Handle a message, recording how long the handler took.
+*/
+func (c *Consumer) run(q queue, handler Handler, autoAck bool, msg *Message) error {
+	c.metrics.handlerStarted(q.name)
+	start := time.Now()
+	err := c.handle(q, handler, autoAck, msg)
+	c.metrics.handlerFinished(q.name, time.Since(start))
+	return err
+}
+
+/*
+Run the handler for a single message and settle it.
+
+When the queue has a handler_timeout the handler runs in its own
+goroutine. If it overruns, its context is cancelled and the message
+is nacked so the prefetch slot is released, even if the handler
+never returns.
+
+Returns the handler's error, or ErrHandlerTimeout.
+*/
+func (c *Consumer) handle(q queue, handler Handler, autoAck bool, msg *Message) (err error) {
+	ctx, span := c.startSpan(context.Background(), q, msg)
+	defer func() {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+
+	if q.handlerTimeout <= 0 {
+		err := handler(ctx, msg)
+		c.settle(q, msg, autoAck, err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.handlerTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(ctx, msg)
+	}()
+
+	select {
+	case err := <-done:
+		c.settle(q, msg, autoAck, err)
+		return err
+	case <-ctx.Done():
+		c.log().Warn("Handler timed out", append(messageFields(q, msg), "timeout", q.handlerTimeout)...)
+		c.fail(q, msg)
+		c.status.failed(q.name, ErrHandlerTimeout)
+		c.emit(Event{
+			Type:        EventHandlerTimeout,
+			Queue:       q.Name(),
+			DeliveryTag: msg.DeliveryTag,
+			Err:         ErrHandlerTimeout,
+		})
+		return ErrHandlerTimeout
+	}
+}
+
+/*
+Ack or nack a message based on the handler's result.
+*/
+func (c *Consumer) settle(q queue, msg *Message, autoAck bool, err error) {
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		c.log().Warn("Rejecting undecodable message", append(messageFields(q, msg), "error", err)...)
+		c.metrics.decodeFailed(q.name)
+		c.status.failed(q.name, err)
+		if !msg.Settled() {
+			msg.Reject(false)
+		}
+		c.emit(Event{
+			Type:        EventDecodeFailed,
+			Queue:       q.Name(),
+			DeliveryTag: msg.DeliveryTag,
+			Err:         err,
+		})
+		return
+	}
+	if err != nil {
+		c.log().Error("Handler failed", append(messageFields(q, msg), "error", err, "requeue", q.requeue)...)
+		c.status.failed(q.name, err)
+		c.fail(q, msg)
+		return
+	}
+	if autoAck && !msg.Settled() {
+		msg.Ack(false)
+	}
+}
+
+/*
+Nack a failed message following the queue's failure policy.
+*/
+func (c *Consumer) fail(q queue, msg *Message) {
+	if msg.Settled() {
+		return
 	}
+	msg.Nack(false, q.requeue)
 }
 
 /*
 Start the loop that keeps the process alive.
 
 Registers signal handlers to cancel consumers, on
-signals.
+signals. SIGUSR1 pauses every queue and SIGUSR2 resumes
+them. Returns an error if the consumer could not
+be stopped cleanly, and returns nil once Stop is
+called from elsewhere.
 */
-func (c *Consumer) StartLoop() {
+func (c *Consumer) StartLoop() error {
 	kill := make(chan os.Signal, 1)
+	pause := make(chan os.Signal, 1)
+	c.mu.Lock()
+	done := c.done
+	c.mu.Unlock()
 
 	// Listen for common kill types
 	signal.Notify(kill, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
-	select {
-	case s := <-kill:
-		log.Printf("Caught signal %s Stopping consumer.", s)
-		err := c.Stop()
-		if err != nil {
-			log.Fatalf("Could not close channel.")
+	signal.Notify(pause, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(kill)
+	defer signal.Stop(pause)
+	for {
+		select {
+		case s := <-pause:
+			var err error
+			if s == syscall.SIGUSR1 {
+				c.log().Info("Caught signal, pausing queues", "signal", s)
+				err = c.PauseAll()
+			} else {
+				c.log().Info("Caught signal, resuming queues", "signal", s)
+				err = c.ResumeAll()
+			}
+			if err != nil {
+				c.log().Error("Could not change queue state", "signal", s, "error", err)
+			}
+		case <-done:
+			return nil
+		case s := <-kill:
+			c.log().Info("Caught signal, stopping consumer", "signal", s)
+			err := c.Stop()
+			if err != nil {
+				c.log().Error("Could not close channel", "error", err)
+				return err
+			}
+			c.log().Info("Channel closed")
+			return nil
 		}
-		log.Print("Channel closed.")
 	}
 }
 
@@ -194,21 +586,82 @@ func (c *Consumer) StartLoop() {
 Disconnect from the AMQP server and stop consuming messages.
 */
 func (c *Consumer) Stop() error {
-	channel, _ := c.conn.Channel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, binding := range c.topology.Bindings() {
 		queue := binding.Queue()
+		channel := c.channels[queue.Name()]
+		if _, paused := c.paused[queue.Name()]; channel == nil || paused {
+			continue
+		}
+		c.log().Info("Cancelling consumer", "queue", queue.Name(), "consumer_tag", queue.Tag())
 		err := channel.Cancel(queue.Tag(), false)
-		if err != nil {
+		// Channels from a connection the broker closed are already gone.
+		if err != nil && err != amqp.ErrClosed {
 			return err
 		}
 	}
-	c.conn.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.channels = nil
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	c.stopServers()
 	return nil
 }
 
 /*
-Simple message type so users of this library don't have to import amqp as well
+Get an http.Handler that serves metrics in the Prometheus text format.
+
+Returns nil when the config file has no [metrics] section. Useful
+for mounting metrics on an application's own HTTP server.
+*/
+func (c *Consumer) MetricsHandler() http.Handler {
+	if c.metrics == nil {
+		return nil
+	}
+	return c.metrics
+}
+
+/*
+Start the metrics, health and admin servers that are configured.
 */
-type Message struct {
-	amqp.Delivery
+func (c *Consumer) startServers() {
+	if c.servers != nil {
+		return
+	}
+	if c.metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle(c.metricsConf.path, c.metrics)
+		c.startServer("metrics", c.metricsConf.listen, mux)
+	}
+	if c.healthConf != nil {
+		c.startServer("health", c.healthConf.listen, c.HealthHandler())
+	}
+	if c.adminConf != nil {
+		c.startServer("admin", c.adminConf.listen, c.AdminHandler())
+	}
+}
+
+func (c *Consumer) startServer(name, listen string, handler http.Handler) {
+	server := &http.Server{Addr: listen, Handler: handler}
+	c.servers = append(c.servers, server)
+
+	c.log().Info("Starting HTTP server", "server", name, "listen", listen)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			c.log().Error("HTTP server failed", "server", name, "listen", listen, "error", err)
+		}
+	}()
+}
+
+func (c *Consumer) stopServers() {
+	for _, server := range c.servers {
+		server.Close()
+	}
+	c.servers = nil
 }
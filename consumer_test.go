@@ -1,7 +1,10 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestCreateMissingFile(t *testing.T) {
@@ -10,3 +13,120 @@ func TestCreateMissingFile(t *testing.T) {
 		t.Error("Should fail no file")
 	}
 }
+
+func TestHandleAcksOnSuccess(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{}
+	q := queue{name: "test", requeue: true}
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		return nil
+	}, true, newTestMessage(r, 1))
+	if len(r.acks) != 1 {
+		t.Error("Message should be acked")
+	}
+}
+
+func TestHandleNacksOnError(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{}
+	q := queue{name: "test", requeue: false}
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		return errors.New("boom")
+	}, true, newTestMessage(r, 1))
+	if len(r.nacks) != 1 {
+		t.Error("Message should be nacked")
+	}
+	if r.requeue {
+		t.Error("Message should not be requeued")
+	}
+}
+
+func TestHandleWithoutAutoAck(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{}
+	q := queue{name: "test", requeue: true}
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		return nil
+	}, false, newTestMessage(r, 1))
+	if len(r.acks) != 0 {
+		t.Error("Message should be left for the handler to ack")
+	}
+}
+
+func TestHandleTimeout(t *testing.T) {
+	r := &ackRecorder{}
+	var events []Event
+	c := &Consumer{}
+	c.OnEvent(func(e Event) {
+		events = append(events, e)
+	})
+	q := queue{name: "test", requeue: true, handlerTimeout: 10 * time.Millisecond}
+	release := make(chan bool)
+	msg := newTestMessage(r, 7)
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		<-ctx.Done()
+		<-release
+		return msg.Ack(false)
+	}, true, msg)
+	close(release)
+
+	if len(r.nacks) != 1 || !r.requeue {
+		t.Error("Timed out message should be nacked and requeued")
+	}
+	if len(events) != 1 {
+		t.Fatal("Timeout event should be emitted")
+	}
+	if events[0].Type != EventHandlerTimeout || events[0].DeliveryTag != 7 {
+		t.Errorf("Event is wrong. Got %s", events[0])
+	}
+	if events[0].Err != ErrHandlerTimeout {
+		t.Error("Event error is wrong")
+	}
+}
+
+func TestTypedHandlerRejectsUndecodable(t *testing.T) {
+	r := &ackRecorder{}
+	var events []Event
+	c := &Consumer{}
+	c.OnEvent(func(e Event) {
+		events = append(events, e)
+	})
+	called := false
+	handler := TypedHandler(func(ctx context.Context, v map[string]int) error {
+		called = true
+		return nil
+	})
+	msg := newTestMessage(r, 1)
+	msg.Body = []byte("not json")
+	c.handle(queue{name: "test", requeue: true}, handler, true, msg)
+
+	if called {
+		t.Error("Handler should not be called")
+	}
+	if len(r.rejects) != 1 || r.requeue {
+		t.Error("Message should be rejected without requeue")
+	}
+	if len(events) != 1 || events[0].Type != EventDecodeFailed {
+		t.Error("Decode failure event should be emitted")
+	}
+}
+
+func TestTypedHandler(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{}
+	var got map[string]int
+	handler := TypedHandler(func(ctx context.Context, v map[string]int) error {
+		got = v
+		return nil
+	})
+	msg := newTestMessage(r, 1)
+	msg.Body = []byte(`{"a": 1}`)
+	c.handle(queue{name: "test"}, handler, true, msg)
+
+	if got["a"] != 1 {
+		t.Error("Handler should receive the decoded value")
+	}
+	if len(r.acks) != 1 {
+		t.Error("Message should be acked")
+	}
+}
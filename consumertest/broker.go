@@ -0,0 +1,292 @@
+/*
+Package consumertest provides an in-memory broker for testing code
+built on the consumer package without a running RabbitMQ server.
+
+	broker := consumertest.NewBroker()
+	c, err := consumer.Create("./consumer.ini", consumer.WithDialer(broker.Dial))
+
+The broker supports direct, fanout, topic and headers exchanges,
+server named, exclusive and auto-delete queues, consumers, basic.get,
+acks, nacks and rejects with requeueing and the redelivered flag, and
+publisher confirms and returns. Consumers on a queue receive messages
+in turn. Prefetch limits, message TTLs, dead lettering, transactions
+and flow control are not supported.
+
+Handlers can also be tested on their own with a Harness, which builds
+messages and records how the handler settled them:
+
+	h := consumertest.NewHarness("orders")
+	h.Run(handler, h.Message([]byte("{}"))).AssertAcked(t)
+*/
+package consumertest
+
+import (
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"github.com/streadway/amqp"
+	"sync"
+)
+
+/*
+An in-memory broker. The zero value is not usable; create
+brokers with NewBroker. A Broker is safe to use from multiple
+goroutines.
+*/
+type Broker struct {
+	mu        sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	conns     map[*Connection]bool
+	ids       int
+}
+
+/*
+Create a broker with the default exchange and the
+standard amq.* exchanges declared.
+*/
+func NewBroker() *Broker {
+	b := &Broker{
+		exchanges: map[string]*exchange{},
+		queues:    map[string]*queue{},
+		conns:     map[*Connection]bool{},
+	}
+	for name, kind := range map[string]string{
+		"":            amqp.ExchangeDirect,
+		"amq.direct":  amqp.ExchangeDirect,
+		"amq.fanout":  amqp.ExchangeFanout,
+		"amq.topic":   amqp.ExchangeTopic,
+		"amq.headers": amqp.ExchangeHeaders,
+	} {
+		b.exchanges[name] = &exchange{name: name, kind: kind, durable: true}
+	}
+	return b
+}
+
+/*
+Connect to the broker. The URL is ignored.
+Pass it to consumer.WithDialer.
+*/
+func (b *Broker) Dial(url string) (consumer.Broker, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn := &Connection{broker: b}
+	b.conns[conn] = true
+	return conn, nil
+}
+
+/*
+Close every connection with a connection-forced error, as
+happens when the server shuts down or the network fails.
+*/
+func (b *Broker) Disconnect() {
+	b.mu.Lock()
+	conns := make([]*Connection, 0, len(b.conns))
+	for conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	b.mu.Unlock()
+	for _, conn := range conns {
+		conn.close(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure", Server: true})
+	}
+}
+
+/*
+Publish a message as if it came from another client.
+
+Returns an error if the exchange doesn't exist. Messages
+that can't be routed are dropped.
+*/
+func (b *Broker) Publish(exchange, key string, msg amqp.Publishing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("no exchange %q", exchange)
+	}
+	b.route(ex, key, msg)
+	return nil
+}
+
+/*
+Get the messages waiting in a queue, oldest first.
+Messages delivered to consumers and not yet acked aren't included.
+*/
+func (b *Broker) Messages(queue string) []amqp.Publishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil
+	}
+	msgs := make([]amqp.Publishing, len(q.messages))
+	for i, m := range q.messages {
+		msgs[i] = m.msg
+	}
+	return msgs
+}
+
+/*
+Count the messages from a queue that are delivered and not yet acked.
+*/
+func (b *Broker) Unacked(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for conn := range b.conns {
+		for _, ch := range conn.channels {
+			for _, u := range ch.unacked {
+				if u.queue.name == queue {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+/*
+Check whether a queue has been declared.
+*/
+func (b *Broker) HasQueue(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.queues[name]
+	return ok
+}
+
+/*
+Check whether an exchange has been declared.
+*/
+func (b *Broker) HasExchange(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.exchanges[name]
+	return ok
+}
+
+/*
+Count the consumers on a queue.
+*/
+func (b *Broker) Consumers(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0
+	}
+	return len(q.consumers)
+}
+
+/*
+Get the prefetch count the first consumer on a queue was started
+with, or 0 when it has none or the queue has no consumers.
+*/
+func (b *Broker) Prefetch(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queue]
+	if !ok || len(q.consumers) == 0 {
+		return 0
+	}
+	return q.consumers[0].prefetch
+}
+
+/*
+Generate a server side name, such as for server named queues.
+Must hold mu.
+*/
+func (b *Broker) newName(prefix string) string {
+	b.ids++
+	return fmt.Sprintf("%s%d", prefix, b.ids)
+}
+
+/*
+A connection to a Broker.
+*/
+type Connection struct {
+	broker   *Broker
+	channels []*Channel
+	notify   []chan *amqp.Error
+	closed   bool
+}
+
+/*
+Open a channel.
+*/
+func (c *Connection) Channel() (consumer.Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &Channel{
+		broker:    b,
+		conn:      c,
+		unacked:   map[uint64]*unacked{},
+		consumers: map[string]*consumerState{},
+	}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+/*
+Register a listener for the connection closing. Like amqp,
+the error is sent when the broker closes the connection and
+the channel is closed either way.
+*/
+func (c *Connection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+/*
+Close the connection and its channels. Unacked messages are requeued
+and the connection's exclusive queues are deleted.
+*/
+func (c *Connection) Close() error {
+	if !c.close(nil) {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+func (c *Connection) close(err *amqp.Error) bool {
+	b := c.broker
+	b.mu.Lock()
+	if c.closed {
+		b.mu.Unlock()
+		return false
+	}
+	c.closed = true
+	delete(b.conns, c)
+	var notify []func()
+	for _, ch := range c.channels {
+		notify = append(notify, ch.closeLocked(err)...)
+	}
+	for name, q := range b.queues {
+		if q.owner == c {
+			b.deleteQueue(name)
+		}
+	}
+	listeners := c.notify
+	c.notify = nil
+	b.mu.Unlock()
+
+	for _, fn := range notify {
+		fn()
+	}
+	for _, receiver := range listeners {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+	return true
+}
@@ -0,0 +1,262 @@
+package consumertest
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+func newChannel(t *testing.T, b *Broker) (*Connection, *Channel) {
+	conn, _ := b.Dial("")
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*Connection), ch.(*Channel)
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("No delivery received")
+	}
+	return amqp.Delivery{}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"order.*", "order.created", true},
+		{"order.*", "order.created.eu", false},
+		{"order.#", "order", true},
+		{"order.#", "order.created.eu", true},
+		{"#", "anything.at.all", true},
+		{"*.created", "order.created", true},
+		{"#.eu", "order.created.eu", true},
+		{"order.*.eu", "order.created.us", false},
+	}
+	for _, tc := range cases {
+		if matches(amqp.ExchangeTopic, binding{key: tc.pattern}, tc.key, nil) != tc.match {
+			t.Errorf("%s matching %s should be %t", tc.pattern, tc.key, tc.match)
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	all := amqp.Table{"x-match": "all", "region": "eu", "tier": int32(1)}
+	if !matchHeaders(all, amqp.Table{"region": []byte("eu"), "tier": int64(1), "other": "x"}) {
+		t.Error("All headers match")
+	}
+	if matchHeaders(all, amqp.Table{"region": "eu"}) {
+		t.Error("All requires every header")
+	}
+	anyArgs := amqp.Table{"x-match": "any", "region": "eu", "tier": "gold"}
+	if !matchHeaders(anyArgs, amqp.Table{"tier": "gold"}) || matchHeaders(anyArgs, amqp.Table{"tier": "silver"}) {
+		t.Error("Any requires one matching header")
+	}
+}
+
+func TestRouting(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	for _, kind := range []string{"direct", "fanout", "topic"} {
+		ch.ExchangeDeclare(kind, kind, true, false, false, false, nil)
+		ch.QueueDeclare(kind+"-a", true, false, false, false, nil)
+		ch.QueueDeclare(kind+"-b", true, false, false, false, nil)
+	}
+	ch.QueueBind("direct-a", "a", "direct", false, nil)
+	ch.QueueBind("direct-b", "b", "direct", false, nil)
+	ch.QueueBind("fanout-a", "", "fanout", false, nil)
+	ch.QueueBind("fanout-b", "", "fanout", false, nil)
+	ch.QueueBind("topic-a", "order.*", "topic", false, nil)
+	ch.QueueBind("topic-b", "#.refunded", "topic", false, nil)
+
+	ch.Publish("direct", "a", false, false, amqp.Publishing{})
+	ch.Publish("fanout", "ignored", false, false, amqp.Publishing{})
+	ch.Publish("topic", "order.refunded", false, false, amqp.Publishing{})
+	ch.Publish("topic", "payment.refunded", false, false, amqp.Publishing{})
+	ch.Publish("", "direct-b", false, false, amqp.Publishing{})
+
+	expected := map[string]int{
+		"direct-a": 1, "direct-b": 1,
+		"fanout-a": 1, "fanout-b": 1,
+		"topic-a": 1, "topic-b": 2,
+	}
+	for name, n := range expected {
+		if got := len(b.Messages(name)); got != n {
+			t.Errorf("%s should have %d messages, got %d", name, n, got)
+		}
+	}
+}
+
+func TestDeclareErrors(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	ch.ExchangeDeclare("app", "topic", true, false, false, false, nil)
+	err := ch.ExchangeDeclare("app", "direct", true, false, false, false, nil)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("Inequivalent exchanges should fail, got %v", err)
+	}
+	if err := ch.ExchangeDeclare("other", "direct", true, false, false, false, nil); err != amqp.ErrClosed {
+		t.Errorf("Failures should close the channel, got %v", err)
+	}
+
+	_, ch = newChannel(t, b)
+	_, err = ch.QueueDeclarePassive("missing", true, false, false, false, nil)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.NotFound {
+		t.Errorf("Passive declares of missing queues should fail, got %v", err)
+	}
+}
+
+func TestAckNackRequeue(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	for _, body := range []string{"a", "b", "c"} {
+		b.Publish("", "work", amqp.Publishing{Body: []byte(body)})
+	}
+	deliveries, _ := ch.Consume("work", "", false, false, false, false, nil)
+
+	a, bb, c := receive(t, deliveries), receive(t, deliveries), receive(t, deliveries)
+	if a.Redelivered || string(a.Body) != "a" || a.DeliveryTag != 1 || c.DeliveryTag != 3 {
+		t.Errorf("Wrong first deliveries %#v", a)
+	}
+	if b.Unacked("work") != 3 {
+		t.Errorf("Expected 3 unacked, got %d", b.Unacked("work"))
+	}
+	a.Ack(false)
+	bb.Nack(false, true)
+	again := receive(t, deliveries)
+	if !again.Redelivered || string(again.Body) != "b" {
+		t.Errorf("Nacked messages should be redelivered, got %#v", again)
+	}
+	c.Reject(false)
+	again.Ack(false)
+	if b.Unacked("work") != 0 || len(b.Messages("work")) != 0 {
+		t.Error("Every message should be settled")
+	}
+	if err := a.Ack(false); err == nil {
+		t.Error("Acking twice should fail")
+	}
+}
+
+func TestAckMultiple(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	for i := 0; i < 3; i++ {
+		b.Publish("", "work", amqp.Publishing{Body: []byte{byte('a' + i)}})
+	}
+	var last amqp.Delivery
+	for i := 0; i < 3; i++ {
+		last, _, _ = ch.Get("work", false)
+	}
+	last.Nack(true, true)
+	msgs := b.Messages("work")
+	if len(msgs) != 3 || string(msgs[0].Body) != "a" || string(msgs[2].Body) != "c" {
+		t.Errorf("Requeued messages should keep their order, got %v", msgs)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	first, _ := ch.Consume("work", "first", true, false, false, false, nil)
+	second, _ := ch.Consume("work", "second", true, false, false, false, nil)
+	b.Publish("", "work", amqp.Publishing{Body: []byte("1")})
+	b.Publish("", "work", amqp.Publishing{Body: []byte("2")})
+	if d := receive(t, first); string(d.Body) != "1" || d.ConsumerTag != "first" {
+		t.Errorf("Wrong first delivery %#v", d)
+	}
+	if d := receive(t, second); string(d.Body) != "2" {
+		t.Errorf("Wrong second delivery %#v", d)
+	}
+}
+
+func TestCancelAndClose(t *testing.T) {
+	b := NewBroker()
+	conn, ch := newChannel(t, b)
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	ch.QueueDeclare("private", false, false, true, false, nil)
+	deliveries, _ := ch.Consume("work", "tag", false, false, false, false, nil)
+	b.Publish("", "work", amqp.Publishing{})
+	b.Publish("", "work", amqp.Publishing{})
+	receive(t, deliveries)
+
+	ch.Cancel("tag", false)
+	for range deliveries {
+	}
+	if b.Consumers("work") != 0 || b.Unacked("work") != 1 || len(b.Messages("work")) != 1 {
+		t.Error("Cancelling should return undelivered messages and keep unacked ones")
+	}
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	b.Disconnect()
+	if err := <-closed; err == nil || err.Code != amqp.ConnectionForced {
+		t.Errorf("Expected a connection forced error, got %v", err)
+	}
+	msgs := b.Messages("work")
+	if len(msgs) != 2 || b.Unacked("work") != 0 {
+		t.Error("Closing should requeue unacked messages")
+	}
+	if b.HasQueue("private") {
+		t.Error("Exclusive queues should be deleted with their connection")
+	}
+	if _, err := conn.Channel(); err != amqp.ErrClosed {
+		t.Errorf("Closed connections can't open channels, got %v", err)
+	}
+}
+
+func TestConfirmsAndReturns(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	ch.QueueDeclare("work", true, false, false, false, nil)
+
+	ch.Publish("", "work", true, false, amqp.Publishing{})
+	ch.Publish("", "nowhere", true, false, amqp.Publishing{MessageId: "lost"})
+	if c := <-confirms; c.DeliveryTag != 1 || !c.Ack {
+		t.Errorf("Wrong confirm %#v", c)
+	}
+	if c := <-confirms; c.DeliveryTag != 2 {
+		t.Errorf("Wrong confirm %#v", c)
+	}
+	if r := <-returns; r.MessageId != "lost" || r.ReplyCode != amqp.NoRoute {
+		t.Errorf("Wrong return %#v", r)
+	}
+
+	ch.Close()
+	if _, ok := <-confirms; ok {
+		t.Error("Closing the channel should close confirm listeners")
+	}
+}
+
+func TestPublishToMissingExchange(t *testing.T) {
+	b := NewBroker()
+	_, ch := newChannel(t, b)
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	done := make(chan error)
+	go func() {
+		done <- ch.Publish("missing", "key", false, false, amqp.Publishing{})
+	}()
+	select {
+	case err := <-done:
+		if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.NotFound {
+			t.Errorf("Expected not found, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publishing to a missing exchange should not block")
+	}
+	if _, ok := <-confirms; ok {
+		t.Error("The failed channel should close its confirm listeners")
+	}
+}
@@ -0,0 +1,525 @@
+package consumertest
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"sort"
+	"sync"
+)
+
+/*
+A channel on a Connection. It is also the Acknowledger
+for the messages delivered on it.
+*/
+type Channel struct {
+	broker    *Broker
+	conn      *Connection
+	closed    bool
+	nextTag   uint64
+	unacked   map[uint64]*unacked
+	consumers map[string]*consumerState
+	prefetch  int
+
+	// Held while publishing so confirms are sent in order.
+	publishMu  sync.Mutex
+	confirming bool
+	published  uint64
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+	closes     []chan *amqp.Error
+}
+
+type unacked struct {
+	queue   *queue
+	message message
+}
+
+/*
+Close the channel with an error, as the broker does for
+errors such as declaring a missing queue. Must hold mu.
+*/
+func (ch *Channel) fail(code int, format string, args ...interface{}) (*amqp.Error, []func()) {
+	err := &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+	return err, ch.closeLocked(err)
+}
+
+/*
+Close a channel after unlocking mu and
+notifying listeners. Used with fail.
+*/
+func (ch *Channel) failed(err *amqp.Error, notify []func()) error {
+	ch.broker.mu.Unlock()
+	for _, fn := range notify {
+		fn()
+	}
+	return err
+}
+
+func (ch *Channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete {
+			return ch.failed(ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name))
+		}
+		b.mu.Unlock()
+		return nil
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		return ch.failed(ch.fail(amqp.CommandInvalid, "COMMAND_INVALID - unknown exchange type '%s'", kind))
+	}
+	b.exchanges[name] = &exchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete}
+	b.mu.Unlock()
+	return nil
+}
+
+func (ch *Channel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.failed(ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", name))
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+func (ch *Channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.newName("amq.gen-")
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.owner != nil && q.owner != ch.conn {
+			return amqp.Queue{}, ch.failed(ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name))
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || (q.owner != nil) != exclusive {
+			return amqp.Queue{}, ch.failed(ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '%s'", name))
+		}
+		defer b.mu.Unlock()
+		return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+	}
+
+	q := &queue{name: name, durable: durable, autoDelete: autoDelete}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	b.mu.Unlock()
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *Channel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.failed(ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name))
+	}
+	if q.owner != nil && q.owner != ch.conn {
+		return amqp.Queue{}, ch.failed(ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name))
+	}
+	defer b.mu.Unlock()
+	return amqp.Queue{Name: name, Messages: len(q.messages), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *Channel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return ch.failed(ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", name))
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return ch.failed(ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange))
+	}
+	for _, bind := range ex.bindings {
+		if bind.queue == name && bind.key == key && fmt.Sprint(bind.args) == fmt.Sprint(args) {
+			b.mu.Unlock()
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, binding{queue: name, key: key, args: args})
+	b.mu.Unlock()
+	return nil
+}
+
+func (ch *Channel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.failed(ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", queue))
+	}
+	if q.owner != nil && q.owner != ch.conn {
+		return nil, ch.failed(ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue))
+	}
+	if consumer == "" {
+		consumer = b.newName("ctag-")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.failed(ch.fail(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer))
+	}
+	if exclusive && len(q.consumers) > 0 {
+		return nil, ch.failed(ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - queue '%s' in use", queue))
+	}
+
+	c := newConsumerState(ch, q, consumer, autoAck)
+	c.prefetch = ch.prefetch
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	b.dispatch(q)
+	b.mu.Unlock()
+	return c.deliveries, nil
+}
+
+/*
+Set the prefetch count for consumers started on the channel
+afterwards. It is recorded for Broker.Prefetch, but not enforced.
+*/
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+/*
+Stop a consumer. Its deliveries channel is closed once
+it has received the deliveries already sent to it.
+*/
+func (ch *Channel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		c.cancel()
+	}
+	return nil
+}
+
+func (ch *Channel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.failed(ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s'", queue))
+	}
+	defer b.mu.Unlock()
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	d := ch.deliver(q, m, "", autoAck)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+/*
+Create a delivery for a message, tracking it until
+it's acked unless autoAck is set. Must hold mu.
+*/
+func (ch *Channel) deliver(q *queue, m message, tag string, autoAck bool) amqp.Delivery {
+	ch.nextTag++
+	if !autoAck {
+		ch.unacked[ch.nextTag] = &unacked{queue: q, message: m}
+	}
+	msg := m.msg
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		ConsumerTag:     tag,
+		DeliveryTag:     ch.nextTag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            msg.Body,
+	}
+}
+
+/*
+Publish a message. Publishing to a missing exchange closes
+the channel. When the channel is in confirm mode every message
+is acked, after being returned if it was mandatory and unroutable.
+*/
+func (ch *Channel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.publishMu.Lock()
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		ch.publishMu.Unlock()
+		return amqp.ErrClosed
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		err, notify := ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s'", exchange)
+		// Closing the listeners takes publishMu, so release it first.
+		ch.publishMu.Unlock()
+		return ch.failed(err, notify)
+	}
+	routed := b.route(ex, key, msg)
+	var tag uint64
+	if ch.confirming {
+		ch.published++
+		tag = ch.published
+	}
+	confirms, returns := ch.confirms, ch.returns
+	b.mu.Unlock()
+
+	if routed == 0 && mandatory {
+		ret := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			Headers:         msg.Headers,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		for _, r := range returns {
+			r <- ret
+		}
+	}
+	if tag > 0 {
+		for _, c := range confirms {
+			c <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+		}
+	}
+	ch.publishMu.Unlock()
+	return nil
+}
+
+func (ch *Channel) Confirm(noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+/*
+Register a listener for publisher confirms. Like amqp, listeners
+must keep receiving or publishing blocks.
+*/
+func (ch *Channel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+/*
+Register a listener for mandatory messages that couldn't be routed.
+*/
+func (ch *Channel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+/*
+Close the channel. Its consumers are cancelled and
+unacked messages are requeued as redelivered.
+*/
+func (ch *Channel) Close() error {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	notify := ch.closeLocked(nil)
+	b.mu.Unlock()
+	for _, fn := range notify {
+		fn()
+	}
+	return nil
+}
+
+/*
+Register a listener for the channel closing. Like amqp, the
+error is sent when the broker closes the channel, and the
+listener is closed either way.
+*/
+func (ch *Channel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.closes = append(ch.closes, c)
+	return c
+}
+
+/*
+Close the channel with err, nil when the client closed it,
+returning functions that close its listeners, to call once
+mu is released. Must hold mu.
+*/
+func (ch *Channel) closeLocked(err *amqp.Error) (notify []func()) {
+	if ch.closed {
+		return nil
+	}
+	ch.closed = true
+	for _, c := range ch.consumers {
+		c.cancel()
+	}
+	ch.settle(ch.nextTag, true, func(u *unacked) {
+		ch.broker.requeue(u.queue, []message{u.message}, true)
+	})
+	confirms, returns, closes := ch.confirms, ch.returns, ch.closes
+	ch.confirms, ch.returns, ch.closes = nil, nil, nil
+	return []func(){func() {
+		for _, c := range closes {
+			if err != nil {
+				c <- err
+			}
+			close(c)
+		}
+		// Wait for publishes in progress before closing their listeners.
+		ch.publishMu.Lock()
+		defer ch.publishMu.Unlock()
+		for _, c := range confirms {
+			close(c)
+		}
+		for _, r := range returns {
+			close(r)
+		}
+	}}
+}
+
+func (ch *Channel) Ack(tag uint64, multiple bool) error {
+	return ch.settleTag(tag, multiple, func(u *unacked) {})
+}
+
+func (ch *Channel) Nack(tag uint64, multiple, requeue bool) error {
+	return ch.settleTag(tag, multiple, func(u *unacked) {
+		if requeue {
+			ch.broker.requeue(u.queue, []message{u.message}, true)
+		}
+	})
+}
+
+func (ch *Channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+/*
+Settle an unacked delivery, or every one up to tag when multiple
+is set. Unknown delivery tags close the channel, as on RabbitMQ.
+*/
+func (ch *Channel) settleTag(tag uint64, multiple bool, fn func(*unacked)) error {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if _, ok := ch.unacked[tag]; !ok && !(multiple && tag == 0) {
+		return ch.failed(ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag))
+	}
+	if multiple && tag == 0 {
+		tag = ch.nextTag
+	}
+	ch.settle(tag, multiple, fn)
+	b.mu.Unlock()
+	return nil
+}
+
+/*
+Remove unacked deliveries and pass them to fn in delivery order,
+so requeued messages keep their order. Must hold mu.
+*/
+func (ch *Channel) settle(tag uint64, multiple bool, fn func(*unacked)) {
+	var tags []uint64
+	for t := range ch.unacked {
+		if t == tag || (multiple && t < tag) {
+			tags = append(tags, t)
+		}
+	}
+	// Requeue in reverse, as each message goes to the front of its queue.
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		fn(u)
+	}
+}
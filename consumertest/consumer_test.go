@@ -0,0 +1,456 @@
+package consumertest_test
+
+import (
+	"context"
+	"errors"
+	"github.com/markstory/go-consumer"
+	"github.com/markstory/go-consumer/consumertest"
+	"github.com/streadway/amqp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const config = `
+[connection]
+host = localhost
+
+[exchange]
+name = app
+type = topic
+
+[queue]
+name = orders
+exclusive = False
+routing_key = order.*
+`
+
+func writeConfig(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "consumer.ini")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func createConsumer(t *testing.T, broker *consumertest.Broker) *consumer.Consumer {
+	c, err := consumer.Create(writeConfig(t), consumer.WithDialer(broker.Dial), consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func eventually(t *testing.T, msg string, fn func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConsumeWithBroker(t *testing.T) {
+	broker := consumertest.NewBroker()
+	c := createConsumer(t, broker)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if !broker.HasExchange("app") || !broker.HasQueue("orders") {
+		t.Fatal("Connect should declare the topology")
+	}
+
+	received := make(chan *consumer.Message, 10)
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeContext(func(ctx context.Context, msg *consumer.Message) error {
+			received <- msg
+			if string(msg.Body) == "fail" && !msg.Redelivered {
+				return errors.New("boom")
+			}
+			return nil
+		})
+	}()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("ok")})
+	broker.Publish("app", "payment.created", amqp.Publishing{Body: []byte("unrouted")})
+	broker.Publish("app", "order.updated", amqp.Publishing{Body: []byte("fail")})
+
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		msg := <-received
+		bodies = append(bodies, string(msg.Body))
+		if i == 2 && !msg.Redelivered {
+			t.Error("Failed messages should be redelivered")
+		}
+	}
+	if bodies[0] != "ok" || bodies[1] != "fail" || bodies[2] != "fail" {
+		t.Errorf("Wrong messages %v", bodies)
+	}
+	eventually(t, "Messages should be acked", func() bool { return broker.Unacked("orders") == 0 })
+
+	pub, err := c.Publisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish(context.Background(), "app", "order.shipped", consumer.Publishing{Body: []byte("published")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; string(msg.Body) != "published" {
+		t.Errorf("Wrong published message %s", msg.Body)
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Consume should return after Stop, got %v", err)
+	}
+	if broker.Consumers("orders") != 0 {
+		t.Error("Stop should cancel consumers")
+	}
+}
+
+func TestRateLimitSetsPrefetch(t *testing.T) {
+	broker := consumertest.NewBroker()
+	c := createConsumer(t, broker)
+	c.Connect()
+	if err := c.SetRateLimit("orders", 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	go c.Consume(func(msg *consumer.Message) {})
+	defer c.Stop()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+	if prefetch := broker.Prefetch("orders"); prefetch != 6 {
+		t.Errorf("Rate limited queues should set a prefetch, got %d", prefetch)
+	}
+}
+
+func TestBreakerLeavesUserPausedQueues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consumer.ini")
+	ini := config + "requeue = False\nbreaker_failure_threshold = 1\nbreaker_cooldown = 10ms\n"
+	if err := os.WriteFile(path, []byte(ini), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broker := consumertest.NewBroker()
+	c, err := consumer.Create(path, consumer.WithDialer(broker.Dial), consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(chan consumer.BreakerState, 10)
+	c.OnBreakerStateChange(func(queue string, from, to consumer.BreakerState) {
+		states <- to
+	})
+	waitState := func(want consumer.BreakerState) {
+		t.Helper()
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Breaker did not become %s", want)
+			}
+		}
+	}
+	c.Connect()
+	go c.ConsumeContext(func(ctx context.Context, msg *consumer.Message) error {
+		if string(msg.Body) == "fail" {
+			return errors.New("database down")
+		}
+		return nil
+	})
+	defer c.Stop()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+
+	// The breaker resumes a queue only it paused.
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("fail")})
+	waitState(consumer.BreakerOpen)
+	eventually(t, "The breaker should pause the queue", func() bool { return broker.Consumers("orders") == 0 })
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("ok")})
+	waitState(consumer.BreakerClosed)
+	eventually(t, "The breaker should resume the queue", func() bool { return broker.Consumers("orders") == 1 })
+
+	// Once paused with Pause, the queue stays paused.
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("fail")})
+	waitState(consumer.BreakerOpen)
+	if err := c.Pause("orders"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "The queue should be paused", func() bool { return broker.Consumers("orders") == 0 })
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("ok")})
+	waitState(consumer.BreakerClosed)
+	if broker.Consumers("orders") != 0 || c.Status().Queues[0].State != consumer.QueuePaused {
+		t.Error("The breaker should not resume a queue paused with Pause")
+	}
+	if err := c.Resume("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if broker.Consumers("orders") != 1 {
+		t.Error("Resume should start consuming again")
+	}
+}
+
+func TestPauseAndResumeWithBroker(t *testing.T) {
+	broker := consumertest.NewBroker()
+	c := createConsumer(t, broker)
+	c.Connect()
+	received := make(chan *consumer.Message, 10)
+	go c.ConsumeContext(func(ctx context.Context, msg *consumer.Message) error {
+		received <- msg
+		return nil
+	})
+	defer c.Stop()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+
+	if err := c.Pause("orders"); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("waiting")})
+	if len(broker.Messages("orders")) != 1 {
+		t.Error("Paused queues should not receive messages")
+	}
+	if err := c.Resume("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; string(msg.Body) != "waiting" {
+		t.Errorf("Wrong message %s", msg.Body)
+	}
+}
+
+func TestResumeWaitsForPreviousBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consumer.ini")
+	if err := os.WriteFile(path, []byte(config+"batch_size = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broker := consumertest.NewBroker()
+	c, err := consumer.Create(path, consumer.WithDialer(broker.Dial), consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Connect()
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	go c.ConsumeBatch(func(ctx context.Context, batch []*consumer.Message) error {
+		started <- string(batch[0].Body)
+		if string(batch[0].Body) == "first" {
+			<-release
+		}
+		return nil
+	})
+	defer c.Stop()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("first")})
+	<-started
+	if err := c.Pause("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Resume("orders"); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("second")})
+	select {
+	case body := <-started:
+		t.Errorf("Batch %s started before the previous batch finished", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case body := <-started:
+		if body != "second" {
+			t.Errorf("Wrong batch %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The next batch should start once the previous one finishes")
+	}
+	eventually(t, "Both batches should be acked", func() bool {
+		return broker.Unacked("orders") == 0 && len(broker.Messages("orders")) == 0
+	})
+}
+
+func TestResumeWaitsForPreviousLanes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consumer.ini")
+	ini := config + "partitions = 4\npartition_key = customer_id\n"
+	if err := os.WriteFile(path, []byte(ini), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broker := consumertest.NewBroker()
+	c, err := consumer.Create(path, consumer.WithDialer(broker.Dial), consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Connect()
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	go c.ConsumeContext(func(ctx context.Context, msg *consumer.Message) error {
+		started <- string(msg.Body)
+		if string(msg.Body) == "first" {
+			<-release
+		}
+		return nil
+	})
+	defer c.Stop()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+
+	headers := amqp.Table{"customer_id": "acme"}
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("first"), Headers: headers})
+	<-started
+	if err := c.Pause("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Resume("orders"); err != nil {
+		t.Fatal(err)
+	}
+	broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("second"), Headers: headers})
+	select {
+	case body := <-started:
+		t.Errorf("Message %s started before the previous message with its key finished", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case body := <-started:
+		if body != "second" {
+			t.Errorf("Wrong message %s", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("New lanes should start once the old ones finish")
+	}
+	eventually(t, "Both messages should be acked", func() bool {
+		return broker.Unacked("orders") == 0 && len(broker.Messages("orders")) == 0
+	})
+}
+
+func TestStopAfterDisconnect(t *testing.T) {
+	broker := consumertest.NewBroker()
+	c := createConsumer(t, broker)
+	c.Connect()
+	done := make(chan error)
+	go func() {
+		done <- c.ConsumeContext(func(ctx context.Context, msg *consumer.Message) error {
+			return nil
+		})
+	}()
+	eventually(t, "Consumer should start", func() bool { return broker.Consumers("orders") == 1 })
+
+	broker.Disconnect()
+	eventually(t, "Consumer should notice the disconnect", func() bool { return !c.Status().Connected })
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop should succeed after the connection is lost, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Consume should return after Stop, got %v", err)
+	}
+}
+
+func TestPublisherRecoversFromChannelErrors(t *testing.T) {
+	broker := consumertest.NewBroker()
+	c := createConsumer(t, broker)
+	c.Connect()
+	pub, err := c.Publisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = pub.Publish(ctx, "missing", "key", consumer.Publishing{})
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.NotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	eventually(t, "Publish should work on a new channel", func() bool {
+		return pub.Publish(ctx, "app", "order.created", consumer.Publishing{}) == nil
+	})
+	if len(broker.Messages("orders")) != 1 {
+		t.Error("Message should be routed")
+	}
+}
+
+func TestPublisherClosed(t *testing.T) {
+	broker := consumertest.NewBroker()
+	dials := 0
+	dial := func(url string) (consumer.Broker, error) {
+		dials++
+		return broker.Dial(url)
+	}
+	pub, err := consumer.CreatePublisher(writeConfig(t), consumer.WithDialer(dial), consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish(context.Background(), "app", "order.created", consumer.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	pub.Close()
+	if err := pub.Publish(context.Background(), "app", "order.created", consumer.Publishing{}); err != consumer.ErrPublisherClosed {
+		t.Errorf("Publishing after Close should fail, got %v", err)
+	}
+	if dials != 1 {
+		t.Errorf("Publishing after Close should not dial again, dialed %d times", dials)
+	}
+}
+
+func TestClientRecoversFromChannelErrors(t *testing.T) {
+	broker := consumertest.NewBroker()
+	if err := createConsumer(t, broker).Connect(); err != nil {
+		t.Fatal(err)
+	}
+	dials := 0
+	dial := func(url string) (consumer.Broker, error) {
+		dials++
+		return broker.Dial(url)
+	}
+	client, err := consumer.CreateClient(writeConfig(t), consumer.WithDialer(dial), consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	pending := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), "app", "order.created", nil)
+		pending <- err
+	}()
+	eventually(t, "Call should publish a request", func() bool {
+		return len(broker.Messages("orders")) == 1
+	})
+	_, err = client.Call(context.Background(), "missing", "key", nil)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.NotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	select {
+	case err := <-pending:
+		if err != consumer.ErrClientClosed {
+			t.Errorf("Pending calls should fail, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending call should not wait forever")
+	}
+
+	eventually(t, "Call should reconnect", func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := client.Call(ctx, "app", "order.created", nil)
+		return err == context.DeadlineExceeded
+	})
+	if len(broker.Messages("orders")) != 2 || dials != 2 {
+		t.Errorf("Call should publish on a new connection, dialed %d times", dials)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = client.Call(ctx, "app", "payment.created", nil)
+	if !errors.Is(err, consumer.ErrCallReturned) {
+		t.Errorf("Unroutable calls should fail straight away, got %v", err)
+	}
+
+	client.Close()
+	if _, err := client.Call(context.Background(), "app", "order.created", nil); err != consumer.ErrClientClosed {
+		t.Errorf("Calling after Close should fail, got %v", err)
+	}
+	if dials != 2 {
+		t.Errorf("Calling after Close should not dial again, dialed %d times", dials)
+	}
+}
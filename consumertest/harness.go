@@ -0,0 +1,398 @@
+package consumertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"github.com/streadway/amqp"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+How a message was settled.
+*/
+type Outcome int
+
+const (
+	Unsettled Outcome = iota
+	Acked
+	Nacked
+	Rejected
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Acked:
+		return "acked"
+	case Nacked:
+		return "nacked"
+	case Rejected:
+		return "rejected"
+	}
+	return "unsettled"
+}
+
+/*
+The ack, nack or reject sent for a message.
+*/
+type Settlement struct {
+	Outcome  Outcome
+	Requeue  bool
+	Multiple bool
+}
+
+func (s Settlement) String() string {
+	switch s.Outcome {
+	case Nacked, Rejected:
+		return fmt.Sprintf("%s (requeue=%t)", s.Outcome, s.Requeue)
+	}
+	return s.Outcome.String()
+}
+
+/*
+A message published through a Harness.
+*/
+type Published struct {
+	Exchange string
+	Key      string
+	Msg      consumer.Publishing
+}
+
+/*
+Runs handlers against hand built messages and records how
+each message was settled and what was published, without
+a broker.
+
+	h := consumertest.NewHarness("orders")
+	msg := h.Message([]byte(`{"id": 1}`), consumertest.WithRoutingKey("order.created"))
+	h.Run(handler, msg).AssertAcked(t)
+
+Handlers that publish follow-up messages can be given the
+harness as their consumer.MessagePublisher. A Harness is
+safe to use from multiple goroutines.
+*/
+type Harness struct {
+	// The queue name reported by Message.Queue.
+	Queue string
+	// The queue's requeue option, used when handlers fail. Defaults to true.
+	Requeue bool
+	// The queue's handler_timeout. Zero means no timeout.
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	nextTag   uint64
+	settled   map[uint64]Settlement
+	published []Published
+}
+
+/*
+Create a harness for handlers consuming from queue.
+*/
+func NewHarness(queue string) *Harness {
+	return &Harness{Queue: queue, Requeue: true, settled: make(map[uint64]Settlement)}
+}
+
+/*
+Changes a message built by Harness.Message.
+*/
+type MessageOption func(*amqp.Delivery)
+
+/*
+Set the message's routing key.
+*/
+func WithRoutingKey(key string) MessageOption {
+	return func(d *amqp.Delivery) {
+		d.RoutingKey = key
+	}
+}
+
+/*
+Set the exchange the message was published to.
+*/
+func WithExchange(exchange string) MessageOption {
+	return func(d *amqp.Delivery) {
+		d.Exchange = exchange
+	}
+}
+
+/*
+Add a header to the message.
+*/
+func WithHeader(name string, value interface{}) MessageOption {
+	return func(d *amqp.Delivery) {
+		if d.Headers == nil {
+			d.Headers = amqp.Table{}
+		}
+		d.Headers[name] = value
+	}
+}
+
+/*
+Set the message's content type.
+*/
+func WithContentType(contentType string) MessageOption {
+	return func(d *amqp.Delivery) {
+		d.ContentType = contentType
+	}
+}
+
+/*
+Set the reply_to and correlation_id of an RPC request.
+*/
+func WithReplyTo(replyTo, correlationId string) MessageOption {
+	return func(d *amqp.Delivery) {
+		d.ReplyTo = replyTo
+		d.CorrelationId = correlationId
+	}
+}
+
+/*
+Mark the message as redelivered.
+*/
+func Redelivered() MessageOption {
+	return func(d *amqp.Delivery) {
+		d.Redelivered = true
+	}
+}
+
+/*
+Build a message with the next delivery tag. Its acks,
+nacks and rejects are recorded by the harness.
+*/
+func (h *Harness) Message(body []byte, opts ...MessageOption) *consumer.Message {
+	h.mu.Lock()
+	h.nextTag++
+	tag := h.nextTag
+	h.mu.Unlock()
+
+	d := amqp.Delivery{
+		Acknowledger: acknowledger{h},
+		DeliveryTag:  tag,
+		ConsumerTag:  h.Queue,
+		Body:         body,
+	}
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return consumer.NewMessage(h.Queue, d)
+}
+
+/*
+Run a Handler and settle the message the way ConsumeContext does.
+
+Returning nil acks the message, a *consumer.DecodeError rejects it
+and any other error nacks it following Requeue. Messages the handler
+settled itself are left alone. When Timeout is set and the handler
+overruns, its context is cancelled and the message is nacked.
+*/
+func (h *Harness) Run(handler consumer.Handler, msg *consumer.Message) Result {
+	return h.run(msg, func() error {
+		err := h.call(handler, msg)
+		var decodeErr *consumer.DecodeError
+		switch {
+		case msg.Settled():
+		case errors.As(err, &decodeErr):
+			msg.Reject(false)
+		case err != nil:
+			msg.Nack(false, h.Requeue)
+		default:
+			msg.Ack(false)
+		}
+		return err
+	})
+}
+
+/*
+Run a handler that settles messages itself, as used with Consume.
+*/
+func (h *Harness) RunFunc(fn func(*consumer.Message), msg *consumer.Message) Result {
+	return h.run(msg, func() error {
+		fn(msg)
+		return nil
+	})
+}
+
+/*
+Run an RPCHandler the way ConsumeRPC does. The reply is published
+through the harness to the default exchange.
+*/
+func (h *Harness) RunRPC(handler consumer.RPCHandler, msg *consumer.Message) Result {
+	return h.Run(consumer.ReplyingHandler(h, handler), msg)
+}
+
+func (h *Harness) run(msg *consumer.Message, fn func() error) Result {
+	h.mu.Lock()
+	start := len(h.published)
+	h.mu.Unlock()
+
+	err := fn()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return Result{
+		Err:        err,
+		Settlement: h.settled[msg.DeliveryTag],
+		Published:  append([]Published(nil), h.published[start:]...),
+	}
+}
+
+func (h *Harness) call(handler consumer.Handler, msg *consumer.Message) error {
+	if h.Timeout <= 0 {
+		return handler(context.Background(), msg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(ctx, msg)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if !msg.Settled() {
+			msg.Nack(false, h.Requeue)
+		}
+		return consumer.ErrHandlerTimeout
+	}
+}
+
+/*
+Record a published message. Lets the harness stand in for
+a Publisher in handlers that publish follow-up messages.
+*/
+func (h *Harness) Publish(ctx context.Context, exchange, key string, msg consumer.Publishing) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.published = append(h.published, Published{Exchange: exchange, Key: key, Msg: msg})
+	return nil
+}
+
+/*
+Get every message published through the harness.
+*/
+func (h *Harness) Published() []Published {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Published(nil), h.published...)
+}
+
+/*
+Get how a message was settled.
+*/
+func (h *Harness) Settlement(msg *consumer.Message) Settlement {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.settled[msg.DeliveryTag]
+}
+
+/*
+Record a settlement for tag, or every unsettled tag up to it.
+*/
+func (h *Harness) settle(tag uint64, s Settlement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !s.Multiple {
+		h.settled[tag] = s
+		return
+	}
+	for t := uint64(1); t <= tag; t++ {
+		if _, ok := h.settled[t]; !ok {
+			h.settled[t] = s
+		}
+	}
+}
+
+/*
+Records acks for messages built by a Harness.
+*/
+type acknowledger struct {
+	h *Harness
+}
+
+func (a acknowledger) Ack(tag uint64, multiple bool) error {
+	a.h.settle(tag, Settlement{Outcome: Acked, Multiple: multiple})
+	return nil
+}
+
+func (a acknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.h.settle(tag, Settlement{Outcome: Nacked, Requeue: requeue, Multiple: multiple})
+	return nil
+}
+
+func (a acknowledger) Reject(tag uint64, requeue bool) error {
+	a.h.settle(tag, Settlement{Outcome: Rejected, Requeue: requeue})
+	return nil
+}
+
+/*
+What happened when a harness ran a handler.
+*/
+type Result struct {
+	// The error returned by the handler.
+	Err error
+	// How the message was settled.
+	Settlement
+	// Messages published while the handler ran.
+	Published []Published
+}
+
+/*
+Fail the test unless the message was acked.
+*/
+func (r Result) AssertAcked(t testing.TB) {
+	t.Helper()
+	if r.Outcome != Acked {
+		t.Errorf("Expected message to be acked, it was %s. Handler error: %v", r.Settlement, r.Err)
+	}
+}
+
+/*
+Fail the test unless the message was nacked with the given requeue flag.
+*/
+func (r Result) AssertNacked(t testing.TB, requeue bool) {
+	t.Helper()
+	if r.Outcome != Nacked || r.Requeue != requeue {
+		t.Errorf("Expected message to be nacked (requeue=%t), it was %s", requeue, r.Settlement)
+	}
+}
+
+/*
+Fail the test unless the message was rejected with the given requeue flag.
+*/
+func (r Result) AssertRejected(t testing.TB, requeue bool) {
+	t.Helper()
+	if r.Outcome != Rejected || r.Requeue != requeue {
+		t.Errorf("Expected message to be rejected (requeue=%t), it was %s", requeue, r.Settlement)
+	}
+}
+
+/*
+Fail the test if the message was settled.
+*/
+func (r Result) AssertUnsettled(t testing.TB) {
+	t.Helper()
+	if r.Outcome != Unsettled {
+		t.Errorf("Expected message to be unsettled, it was %s", r.Settlement)
+	}
+}
+
+/*
+Fail the test unless a message was published to exchange with key,
+and return the first one. RPC replies are published to the "" exchange
+with the request's reply_to as the key.
+*/
+func (r Result) AssertPublished(t testing.TB, exchange, key string) consumer.Publishing {
+	t.Helper()
+	for _, p := range r.Published {
+		if p.Exchange == exchange && p.Key == key {
+			return p.Msg
+		}
+	}
+	t.Errorf("Expected a message published to exchange %q with key %q, got %d other messages", exchange, key, len(r.Published))
+	return consumer.Publishing{}
+}
@@ -0,0 +1,165 @@
+package consumertest
+
+import (
+	"context"
+	"errors"
+	"github.com/markstory/go-consumer"
+	"testing"
+	"time"
+)
+
+// Records assertion failures instead of failing the test.
+type failRecorder struct {
+	testing.TB
+	failed bool
+}
+
+func (f *failRecorder) Helper() {}
+
+func (f *failRecorder) Errorf(format string, args ...interface{}) {
+	f.failed = true
+}
+
+func TestHarnessMessage(t *testing.T) {
+	h := NewHarness("orders")
+	msg := h.Message([]byte("body"),
+		WithRoutingKey("order.created"),
+		WithExchange("app"),
+		WithHeader("tenant", "acme"),
+		WithContentType("text/plain"),
+		WithReplyTo("callback", "abc"),
+		Redelivered())
+	if msg.Queue() != "orders" || string(msg.Body) != "body" || msg.RoutingKey != "order.created" || msg.Exchange != "app" {
+		t.Errorf("Wrong message %#v", msg)
+	}
+	if msg.Headers["tenant"] != "acme" || msg.ContentType != "text/plain" || !msg.Redelivered {
+		t.Errorf("Wrong properties %#v", msg)
+	}
+	if msg.ReplyTo != "callback" || msg.CorrelationId != "abc" {
+		t.Errorf("Wrong reply properties %#v", msg)
+	}
+	if next := h.Message(nil); next.DeliveryTag != msg.DeliveryTag+1 {
+		t.Error("Messages should get increasing delivery tags")
+	}
+}
+
+func TestHarnessRun(t *testing.T) {
+	h := NewHarness("orders")
+	h.Run(func(ctx context.Context, msg *consumer.Message) error {
+		return nil
+	}, h.Message(nil)).AssertAcked(t)
+
+	failing := func(ctx context.Context, msg *consumer.Message) error {
+		return errors.New("boom")
+	}
+	result := h.Run(failing, h.Message(nil))
+	result.AssertNacked(t, true)
+	if result.Err == nil || result.Err.Error() != "boom" {
+		t.Errorf("Handler errors should be returned, got %v", result.Err)
+	}
+	h.Requeue = false
+	h.Run(failing, h.Message(nil)).AssertNacked(t, false)
+
+	h.Run(func(ctx context.Context, msg *consumer.Message) error {
+		var v map[string]interface{}
+		return msg.Decode(&v)
+	}, h.Message([]byte("{"), WithContentType("application/json"))).AssertRejected(t, false)
+
+	h.Run(func(ctx context.Context, msg *consumer.Message) error {
+		msg.Reject(true)
+		return errors.New("already settled")
+	}, h.Message(nil)).AssertRejected(t, true)
+}
+
+func TestHarnessRunFunc(t *testing.T) {
+	h := NewHarness("orders")
+	h.RunFunc(func(msg *consumer.Message) {}, h.Message(nil)).AssertUnsettled(t)
+
+	first := h.Message(nil)
+	second := h.Message(nil)
+	h.RunFunc(func(msg *consumer.Message) {
+		msg.Ack(true)
+	}, second).AssertAcked(t)
+	if s := h.Settlement(first); s.Outcome != Acked || !s.Multiple {
+		t.Errorf("Multiple acks should settle earlier messages, got %s", s)
+	}
+}
+
+func TestHarnessTimeout(t *testing.T) {
+	h := NewHarness("orders")
+	h.Timeout = 10 * time.Millisecond
+	result := h.Run(func(ctx context.Context, msg *consumer.Message) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, h.Message(nil))
+	result.AssertNacked(t, true)
+	if result.Err != consumer.ErrHandlerTimeout {
+		t.Errorf("Expected a timeout error, got %v", result.Err)
+	}
+}
+
+func TestHarnessPublished(t *testing.T) {
+	h := NewHarness("orders")
+	var pub consumer.MessagePublisher = h
+	h.Publish(context.Background(), "app", "before", consumer.Publishing{})
+
+	result := h.Run(func(ctx context.Context, msg *consumer.Message) error {
+		return pub.Publish(ctx, "app", "order.shipped", consumer.Publishing{Body: msg.Body})
+	}, h.Message([]byte("1")))
+	if len(result.Published) != 1 {
+		t.Errorf("Only messages published by the handler should be in the result, got %d", len(result.Published))
+	}
+	if msg := result.AssertPublished(t, "app", "order.shipped"); string(msg.Body) != "1" {
+		t.Errorf("Wrong published message %s", msg.Body)
+	}
+	if len(h.Published()) != 2 {
+		t.Error("The harness should keep every published message")
+	}
+}
+
+func TestHarnessRunRPC(t *testing.T) {
+	h := NewHarness("rpc")
+	result := h.RunRPC(func(ctx context.Context, msg *consumer.Message) (*consumer.Reply, error) {
+		return &consumer.Reply{Body: []byte("pong")}, nil
+	}, h.Message([]byte("ping"), WithReplyTo("callback", "abc")))
+	result.AssertAcked(t)
+	reply := result.AssertPublished(t, "", "callback")
+	if string(reply.Body) != "pong" || reply.CorrelationId != "abc" {
+		t.Errorf("Wrong reply %#v", reply)
+	}
+
+	result = h.RunRPC(func(ctx context.Context, msg *consumer.Message) (*consumer.Reply, error) {
+		return nil, errors.New("boom")
+	}, h.Message(nil, WithReplyTo("callback", "def")))
+	result.AssertAcked(t)
+	if reply := result.AssertPublished(t, "", "callback"); reply.Headers[consumer.RPCErrorHeader] != true {
+		t.Error("Failed requests should reply with an error")
+	}
+}
+
+func TestHarnessAssertionsFail(t *testing.T) {
+	h := NewHarness("orders")
+	result := h.RunFunc(func(msg *consumer.Message) {
+		msg.Nack(false, false)
+	}, h.Message(nil))
+
+	checks := map[string]func(testing.TB){
+		"acked":     result.AssertAcked,
+		"unsettled": result.AssertUnsettled,
+		"requeued":  func(t testing.TB) { result.AssertNacked(t, true) },
+		"rejected":  func(t testing.TB) { result.AssertRejected(t, false) },
+		"published": func(t testing.TB) { result.AssertPublished(t, "app", "key") },
+	}
+	for name, check := range checks {
+		f := &failRecorder{TB: t}
+		check(f)
+		if !f.failed {
+			t.Errorf("Assert %s should fail", name)
+		}
+	}
+	f := &failRecorder{TB: t}
+	result.AssertNacked(f, false)
+	if f.failed {
+		t.Error("AssertNacked should pass")
+	}
+}
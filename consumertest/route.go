@@ -0,0 +1,318 @@
+package consumertest
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	bindings   []binding
+}
+
+type binding struct {
+	queue string
+	key   string
+	args  amqp.Table
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	// The connection an exclusive queue belongs to.
+	owner     *Connection
+	messages  []message
+	consumers []*consumerState
+	next      int
+}
+
+type message struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+}
+
+/*
+Route a message to the queues bound to ex, returning
+how many queues received it. Must hold mu.
+*/
+func (b *Broker) route(ex *exchange, key string, msg amqp.Publishing) int {
+	var names []string
+	if ex.name == "" {
+		names = []string{key}
+	}
+	for _, bind := range ex.bindings {
+		if matches(ex.kind, bind, key, msg.Headers) {
+			names = append(names, bind.queue)
+		}
+	}
+
+	routed := map[string]bool{}
+	for _, name := range names {
+		q, ok := b.queues[name]
+		if !ok || routed[name] {
+			continue
+		}
+		routed[name] = true
+		q.messages = append(q.messages, message{exchange: ex.name, key: key, msg: msg})
+		b.dispatch(q)
+	}
+	return len(routed)
+}
+
+func matches(kind string, bind binding, key string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return matchTopic(strings.Split(bind.key, "."), strings.Split(key, "."))
+	case amqp.ExchangeHeaders:
+		return matchHeaders(bind.args, headers)
+	}
+	return bind.key == key
+}
+
+/*
+Match routing key words against a binding pattern where *
+matches one word and # matches zero or more.
+*/
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	if pattern[0] != "*" && pattern[0] != words[0] {
+		return false
+	}
+	return matchTopic(pattern[1:], words[1:])
+}
+
+/*
+Match headers against a headers exchange binding. Arguments
+starting with x- are ignored, and x-match selects whether all
+(the default) or any of the others must be equal.
+*/
+func matchHeaders(args, headers amqp.Table) bool {
+	any := fmt.Sprint(args["x-match"]) == "any"
+	for name, want := range args {
+		if strings.HasPrefix(name, "x-") {
+			continue
+		}
+		got, ok := headers[name]
+		equal := ok && reflect.DeepEqual(normalize(want), normalize(got))
+		if any && equal {
+			return true
+		}
+		if !any && !equal {
+			return false
+		}
+	}
+	return !any
+}
+
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case int:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	}
+	return value
+}
+
+/*
+Hand out a queue's messages to its consumers in turn. Must hold mu.
+*/
+func (b *Broker) dispatch(q *queue) {
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		q.next = q.next % len(q.consumers)
+		c := q.consumers[q.next]
+		q.next++
+
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+		c.push(c.channel.deliver(q, m, c.tag, c.autoAck), m)
+	}
+}
+
+/*
+Put messages back at the front of a queue, marking them as
+redelivered when a consumer has seen them. Must hold mu.
+*/
+func (b *Broker) requeue(q *queue, msgs []message, redelivered bool) {
+	if _, ok := b.queues[q.name]; !ok {
+		return
+	}
+	for i := range msgs {
+		msgs[i].redelivered = msgs[i].redelivered || redelivered
+	}
+	q.messages = append(msgs, q.messages...)
+	b.dispatch(q)
+}
+
+/*
+Delete a queue and its bindings. Must hold mu.
+*/
+func (b *Broker) deleteQueue(name string) {
+	q, ok := b.queues[name]
+	if !ok {
+		return
+	}
+	delete(b.queues, name)
+	for _, c := range append([]*consumerState(nil), q.consumers...) {
+		c.cancel()
+	}
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bind := range ex.bindings {
+			if bind.queue != name {
+				kept = append(kept, bind)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+/*
+A consumer's deliveries waiting to be received.
+
+Deliveries are buffered and sent by a goroutine so the broker
+never blocks on a slow consumer while holding its lock.
+*/
+type consumerState struct {
+	tag      string
+	channel  *Channel
+	queue    *queue
+	autoAck  bool
+	prefetch int
+
+	deliveries chan amqp.Delivery
+	pending    []pendingDelivery
+	cond       *sync.Cond
+	cancelled  bool
+	done       chan struct{}
+}
+
+type pendingDelivery struct {
+	delivery amqp.Delivery
+	message  message
+}
+
+func newConsumerState(ch *Channel, q *queue, tag string, autoAck bool) *consumerState {
+	c := &consumerState{
+		tag:        tag,
+		channel:    ch,
+		queue:      q,
+		autoAck:    autoAck,
+		deliveries: make(chan amqp.Delivery),
+		cond:       sync.NewCond(&ch.broker.mu),
+		done:       make(chan struct{}),
+	}
+	go c.forward()
+	return c
+}
+
+/*
+Queue a delivery. Must hold mu.
+*/
+func (c *consumerState) push(d amqp.Delivery, m message) {
+	c.pending = append(c.pending, pendingDelivery{d, m})
+	c.cond.Signal()
+}
+
+func (c *consumerState) forward() {
+	defer close(c.deliveries)
+	mu := &c.channel.broker.mu
+	for {
+		mu.Lock()
+		for len(c.pending) == 0 && !c.cancelled {
+			c.cond.Wait()
+		}
+		if c.cancelled {
+			mu.Unlock()
+			return
+		}
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		mu.Unlock()
+
+		select {
+		case c.deliveries <- p.delivery:
+		case <-c.done:
+			mu.Lock()
+			c.unsend([]pendingDelivery{p})
+			mu.Unlock()
+			return
+		}
+	}
+}
+
+/*
+Stop the consumer, returning deliveries it hasn't received
+to the queue. Must hold mu.
+*/
+func (c *consumerState) cancel() {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	c.cond.Signal()
+
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	delete(c.channel.consumers, c.tag)
+	c.unsend(c.pending)
+	c.pending = nil
+	if q.autoDelete && len(q.consumers) == 0 {
+		c.channel.broker.deleteQueue(q.name)
+	}
+}
+
+/*
+Return deliveries that never reached the consumer. Must hold mu.
+*/
+func (c *consumerState) unsend(pending []pendingDelivery) {
+	var msgs []message
+	for _, p := range pending {
+		tag := p.delivery.DeliveryTag
+		if !c.autoAck {
+			// Closing the channel may have requeued it already.
+			if _, ok := c.channel.unacked[tag]; !ok {
+				continue
+			}
+			delete(c.channel.unacked, tag)
+		}
+		msgs = append(msgs, p.message)
+	}
+	if len(msgs) > 0 {
+		c.channel.broker.requeue(c.queue, msgs, false)
+	}
+}
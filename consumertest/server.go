@@ -0,0 +1,785 @@
+package consumertest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+An AMQP 0-9-1 server backed by a Broker, for tests that connect
+with amqp.Dial instead of a Dialer.
+
+	broker := consumertest.NewBroker()
+	server, err := consumertest.NewServer(broker)
+	defer server.Close()
+	conn, err := amqp.Dial(server.URL())
+
+The server implements the methods the consumer package uses:
+opening and closing connections and channels, declaring exchanges
+and queues, binding queues, consuming, cancelling, basic.get, acks,
+nacks and rejects, publishing, and publisher confirms. Other methods
+close the connection with NOT_IMPLEMENTED. Any user name and password
+are accepted and virtual hosts are ignored.
+
+Broker.Disconnect closes every client connection with CONNECTION_FORCED,
+as when a RabbitMQ node is shut down.
+*/
+type Server struct {
+	broker   *Broker
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[*serverConn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+/*
+Start a server for broker on a random port on the loopback interface.
+*/
+func NewServer(broker *Broker) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{broker: broker, listener: listener, conns: map[*serverConn]bool{}}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+/*
+Get the address the server is listening on.
+*/
+func (s *Server) Addr() *net.TCPAddr {
+	return s.listener.Addr().(*net.TCPAddr)
+}
+
+/*
+Get a URL for connecting to the server with amqp.Dial.
+*/
+func (s *Server) URL() string {
+	return fmt.Sprintf("amqp://guest:guest@%s/", s.listener.Addr())
+}
+
+/*
+Stop listening and drop every client connection.
+*/
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := newServerConn(s, netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			netConn.Close()
+			return
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+/*
+A client connection. Frames are read and handled on a single
+goroutine, while deliveries are written by a goroutine per
+consumer, so writes are serialized with writeMu.
+*/
+type serverConn struct {
+	server   *Server
+	netConn  net.Conn
+	reader   *bufio.Reader
+	writeMu  sync.Mutex
+	writer   *bufio.Writer
+	frameMax int
+	conn     *Connection
+	channels map[uint16]*serverChannel
+	done     chan struct{}
+	tags     int
+
+	// Set once the server has sent connection.close. Only
+	// connection.close-ok is handled after that.
+	closing atomic.Bool
+}
+
+func newServerConn(s *Server, netConn net.Conn) *serverConn {
+	return &serverConn{
+		server:   s,
+		netConn:  netConn,
+		reader:   bufio.NewReader(netConn),
+		writer:   bufio.NewWriter(netConn),
+		channels: map[uint16]*serverChannel{},
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *serverConn) serve() {
+	defer c.netConn.Close()
+	heartbeat, err := c.handshake()
+	if err != nil {
+		return
+	}
+	conn, _ := c.server.broker.Dial("")
+	c.conn = conn.(*Connection)
+	closed := c.conn.NotifyClose(make(chan *amqp.Error, 1))
+	defer func() {
+		close(c.done)
+		c.netConn.Close()
+		c.conn.Close()
+		for _, ch := range c.channels {
+			ch.wait()
+		}
+	}()
+	go c.watch(closed)
+	if heartbeat > 0 {
+		go c.heartbeat(heartbeat)
+	}
+
+	for {
+		kind, channel, payload, err := readFrame(c.reader)
+		if err != nil {
+			return
+		}
+		if !c.handle(kind, channel, payload) {
+			return
+		}
+	}
+}
+
+/*
+Negotiate the connection, returning the heartbeat interval the
+client asked for.
+*/
+func (c *serverConn) handshake() (time.Duration, error) {
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, err
+	}
+	if string(header) != protocolHeader {
+		c.netConn.Write([]byte(protocolHeader))
+		return 0, errors.New("Unsupported protocol.")
+	}
+
+	start := newMethod(connectionStart)
+	start.octet(0)
+	start.octet(9)
+	start.table(amqp.Table{
+		"product": "consumertest",
+		"capabilities": amqp.Table{
+			"basic.nack":             true,
+			"consumer_cancel_notify": true,
+			"publisher_confirms":     true,
+		},
+	})
+	start.longstr([]byte("PLAIN AMQPLAIN"))
+	start.longstr([]byte("en_US"))
+	c.send(0, start)
+	if _, err := c.expect(connectionStartOk); err != nil {
+		return 0, err
+	}
+
+	tune := newMethod(connectionTune)
+	tune.short(2047)
+	tune.long(131072)
+	tune.short(0)
+	c.send(0, tune)
+	d, err := c.expect(connectionTuneOk)
+	if err != nil {
+		return 0, err
+	}
+	d.short()
+	c.frameMax = int(d.long())
+	heartbeat := time.Duration(d.short()) * time.Second
+
+	if _, err := c.expect(connectionOpen); err != nil {
+		return 0, err
+	}
+	openOk := newMethod(connectionOpenOk)
+	openOk.shortstr("")
+	return heartbeat, c.send(0, openOk)
+}
+
+/*
+Read the next method, failing if it isn't id.
+*/
+func (c *serverConn) expect(id uint32) (*decoder, error) {
+	for {
+		kind, _, payload, err := readFrame(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if kind == frameHeartbeat {
+			continue
+		}
+		d := &decoder{buf: payload}
+		if kind != frameMethod || d.long() != id || d.err != nil {
+			return nil, errMalformed
+		}
+		return d, nil
+	}
+}
+
+/*
+Close the connection when the broker closes it, for
+example when Broker.Disconnect is called.
+*/
+func (c *serverConn) watch(closed <-chan *amqp.Error) {
+	err, ok := <-closed
+	if !ok || err == nil {
+		return
+	}
+	c.close(err.Code, err.Reason, 0)
+	// Give the client a moment to reply with close-ok.
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		c.netConn.Close()
+	}
+}
+
+func (c *serverConn) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			writeFrame(c.writer, frameHeartbeat, 0, nil)
+			c.writer.Flush()
+			c.writeMu.Unlock()
+		}
+	}
+}
+
+/*
+Send connection.close. The connection ends when the
+client replies with close-ok.
+*/
+func (c *serverConn) close(code int, reason string, method uint32) {
+	if c.closing.Swap(true) {
+		return
+	}
+	e := newMethod(connectionClose)
+	e.short(uint16(code))
+	e.shortstr(reason)
+	e.short(uint16(method >> 16))
+	e.short(uint16(method))
+	c.send(0, e)
+}
+
+/*
+Send a method frame.
+*/
+func (c *serverConn) send(channel uint16, method *encoder) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := writeFrame(c.writer, frameMethod, channel, method.Bytes()); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+/*
+Send a method frame followed by a content header and body frames.
+*/
+func (c *serverConn) sendContent(channel uint16, method *encoder, msg amqp.Publishing, body []byte) error {
+	header := &encoder{}
+	header.contentHeader(len(body), msg)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := writeFrame(c.writer, frameMethod, channel, method.Bytes()); err != nil {
+		return err
+	}
+	if err := writeFrame(c.writer, frameHeader, channel, header.Bytes()); err != nil {
+		return err
+	}
+	size := len(body)
+	if c.frameMax > 8 {
+		size = c.frameMax - 8
+	}
+	for len(body) > 0 {
+		n := size
+		if n > len(body) {
+			n = len(body)
+		}
+		if err := writeFrame(c.writer, frameBody, channel, body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return c.writer.Flush()
+}
+
+/*
+Handle a frame. Returns false when the connection should end.
+*/
+func (c *serverConn) handle(kind byte, channel uint16, payload []byte) bool {
+	if kind == frameHeartbeat {
+		return true
+	}
+	if channel == 0 {
+		if kind != frameMethod {
+			c.close(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - content on channel 0", 0)
+			return true
+		}
+		d := &decoder{buf: payload}
+		switch id := d.long(); id {
+		case connectionClose:
+			c.send(0, newMethod(connectionCloseOk))
+			return false
+		case connectionCloseOk:
+			return false
+		default:
+			c.close(amqp.NotImplemented, "NOT_IMPLEMENTED - unsupported method", id)
+			return true
+		}
+	}
+	if c.closing.Load() {
+		return true
+	}
+
+	ch := c.channels[channel]
+	if kind != frameMethod {
+		if ch == nil || ch.publishing == nil {
+			c.close(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - content without basic.publish", 0)
+			return true
+		}
+		ch.content(kind, payload)
+		return true
+	}
+
+	d := &decoder{buf: payload}
+	id := d.long()
+	if id == channelOpen {
+		c.openChannel(channel, ch)
+		return true
+	}
+	if ch == nil {
+		c.close(amqp.ChannelError, fmt.Sprintf("CHANNEL_ERROR - expected 'channel.open' on channel %d", channel), id)
+		return true
+	}
+	ch.method(id, d)
+	return true
+}
+
+func (c *serverConn) openChannel(id uint16, existing *serverChannel) {
+	if existing != nil {
+		c.close(amqp.ChannelError, fmt.Sprintf("CHANNEL_ERROR - second 'channel.open' on channel %d", id), channelOpen)
+		return
+	}
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return
+	}
+	sc := &serverChannel{
+		conn:      c,
+		id:        id,
+		ch:        ch.(*Channel),
+		forwards:  map[string]chan struct{}{},
+		cancelled: map[string]bool{},
+	}
+	sc.returns = sc.ch.NotifyReturn(make(chan amqp.Return, 1))
+	c.channels[id] = sc
+
+	openOk := newMethod(channelOpenOk)
+	openOk.longstr(nil)
+	c.send(id, openOk)
+}
+
+/*
+A channel on a client connection.
+*/
+type serverChannel struct {
+	conn       *serverConn
+	id         uint16
+	ch         *Channel
+	publishing *publishing
+	returns    chan amqp.Return
+	confirms   chan amqp.Confirmation
+
+	// Set once the server has sent channel.close. Everything
+	// but channel.close-ok is discarded after that.
+	closing bool
+
+	mu        sync.Mutex
+	forwards  map[string]chan struct{}
+	cancelled map[string]bool
+}
+
+/*
+A basic.publish waiting for its content.
+*/
+type publishing struct {
+	exchange  string
+	key       string
+	mandatory bool
+	immediate bool
+	size      int
+	header    bool
+	msg       amqp.Publishing
+}
+
+func (ch *serverChannel) method(id uint32, d *decoder) {
+	if ch.closing {
+		if id == channelCloseOk {
+			delete(ch.conn.channels, ch.id)
+		}
+		return
+	}
+
+	var err error
+	switch id {
+	case channelClose:
+		ch.ch.Close()
+		ch.wait()
+		delete(ch.conn.channels, ch.id)
+		ch.conn.send(ch.id, newMethod(channelCloseOk))
+
+	case channelFlow:
+		active := d.octet()&1 != 0
+		flowOk := newMethod(channelFlowOk)
+		flowOk.bit(active)
+		ch.conn.send(ch.id, flowOk)
+
+	case exchangeDeclare:
+		d.short()
+		name, kind := d.shortstr(), d.shortstr()
+		bits := d.octet()
+		args := d.table()
+		passive, durable, autoDelete, internal, noWait := bits&1 != 0, bits&2 != 0, bits&4 != 0, bits&8 != 0, bits&16 != 0
+		if passive {
+			err = ch.ch.ExchangeDeclarePassive(name, kind, durable, autoDelete, internal, noWait, args)
+		} else {
+			err = ch.ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+		}
+		if err == nil && !noWait {
+			ch.conn.send(ch.id, newMethod(exchangeDeclareOk))
+		}
+
+	case queueDeclare:
+		d.short()
+		name := d.shortstr()
+		bits := d.octet()
+		args := d.table()
+		passive, durable, exclusive, autoDelete, noWait := bits&1 != 0, bits&2 != 0, bits&4 != 0, bits&8 != 0, bits&16 != 0
+		var q amqp.Queue
+		if passive {
+			q, err = ch.ch.QueueDeclarePassive(name, durable, autoDelete, exclusive, noWait, args)
+		} else {
+			q, err = ch.ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+		}
+		if err == nil && !noWait {
+			declareOk := newMethod(queueDeclareOk)
+			declareOk.shortstr(q.Name)
+			declareOk.long(uint32(q.Messages))
+			declareOk.long(uint32(q.Consumers))
+			ch.conn.send(ch.id, declareOk)
+		}
+
+	case queueBind:
+		d.short()
+		queue, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+		noWait := d.octet()&1 != 0
+		args := d.table()
+		err = ch.ch.QueueBind(queue, key, exchange, noWait, args)
+		if err == nil && !noWait {
+			ch.conn.send(ch.id, newMethod(queueBindOk))
+		}
+
+	case basicQos:
+		size, count := d.long(), d.short()
+		global := d.octet()&1 != 0
+		err = ch.ch.Qos(int(count), int(size), global)
+		if err == nil {
+			ch.conn.send(ch.id, newMethod(basicQosOk))
+		}
+
+	case basicConsume:
+		d.short()
+		queue, tag := d.shortstr(), d.shortstr()
+		bits := d.octet()
+		args := d.table()
+		noLocal, noAck, exclusive, noWait := bits&1 != 0, bits&2 != 0, bits&4 != 0, bits&8 != 0
+		err = ch.consume(queue, tag, noLocal, noAck, exclusive, noWait, args)
+
+	case basicCancel:
+		tag := d.shortstr()
+		noWait := d.octet()&1 != 0
+		ch.cancel(tag, noWait)
+
+	case basicPublish:
+		d.short()
+		exchange, key := d.shortstr(), d.shortstr()
+		bits := d.octet()
+		ch.publishing = &publishing{exchange: exchange, key: key, mandatory: bits&1 != 0, immediate: bits&2 != 0}
+
+	case basicGet:
+		d.short()
+		queue := d.shortstr()
+		noAck := d.octet()&1 != 0
+		err = ch.get(queue, noAck)
+
+	case basicAck:
+		tag := d.longlong()
+		err = ch.ch.Ack(tag, d.octet()&1 != 0)
+
+	case basicReject:
+		tag := d.longlong()
+		err = ch.ch.Reject(tag, d.octet()&1 != 0)
+
+	case basicNack:
+		tag := d.longlong()
+		bits := d.octet()
+		err = ch.ch.Nack(tag, bits&1 != 0, bits&2 != 0)
+
+	case confirmSelect:
+		noWait := d.octet()&1 != 0
+		err = ch.ch.Confirm(noWait)
+		if err == nil && ch.confirms == nil {
+			ch.confirms = ch.ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		}
+		if err == nil && !noWait {
+			ch.conn.send(ch.id, newMethod(confirmSelectOk))
+		}
+
+	default:
+		ch.conn.close(amqp.NotImplemented, "NOT_IMPLEMENTED - unsupported method", id)
+		return
+	}
+
+	if d.err != nil {
+		ch.conn.close(amqp.FrameError, "FRAME_ERROR - malformed method arguments", id)
+		return
+	}
+	ch.failed(err, id)
+}
+
+/*
+Send channel.close for an error from the broker, which has
+already closed its side of the channel.
+*/
+func (ch *serverChannel) failed(err error, method uint32) {
+	// ErrClosed means the connection is being closed by the broker.
+	amqpErr, ok := err.(*amqp.Error)
+	if !ok || err == amqp.ErrClosed {
+		return
+	}
+	ch.closing = true
+	ch.wait()
+	e := newMethod(channelClose)
+	e.short(uint16(amqpErr.Code))
+	e.shortstr(amqpErr.Reason)
+	e.short(uint16(method >> 16))
+	e.short(uint16(method))
+	ch.conn.send(ch.id, e)
+}
+
+func (ch *serverChannel) consume(queue, tag string, noLocal, noAck, exclusive, noWait bool, args amqp.Table) error {
+	if tag == "" {
+		ch.conn.tags++
+		tag = fmt.Sprintf("amq.ctag-%d", ch.conn.tags)
+	}
+	deliveries, err := ch.ch.Consume(queue, tag, noAck, exclusive, noLocal, noWait, args)
+	if err != nil {
+		return err
+	}
+	// Deliveries are only forwarded once consume-ok has been sent.
+	if !noWait {
+		consumeOk := newMethod(basicConsumeOk)
+		consumeOk.shortstr(tag)
+		ch.conn.send(ch.id, consumeOk)
+	}
+	done := make(chan struct{})
+	ch.mu.Lock()
+	ch.forwards[tag] = done
+	ch.mu.Unlock()
+	go ch.forward(tag, deliveries, done)
+	return nil
+}
+
+/*
+Send a consumer's deliveries to the client. When the broker cancels
+the consumer, because its queue was deleted, the client is told with
+basic.cancel.
+*/
+func (ch *serverChannel) forward(tag string, deliveries <-chan amqp.Delivery, done chan struct{}) {
+	defer close(done)
+	for d := range deliveries {
+		deliver := newMethod(basicDeliver)
+		deliver.shortstr(tag)
+		deliver.longlong(d.DeliveryTag)
+		deliver.bit(d.Redelivered)
+		deliver.shortstr(d.Exchange)
+		deliver.shortstr(d.RoutingKey)
+		ch.conn.sendContent(ch.id, deliver, deliveryProperties(d), d.Body)
+	}
+
+	ch.mu.Lock()
+	cancelled := ch.cancelled[tag]
+	delete(ch.forwards, tag)
+	ch.mu.Unlock()
+	b := ch.ch.broker
+	b.mu.Lock()
+	closed := ch.ch.closed
+	b.mu.Unlock()
+	if cancelled || closed {
+		return
+	}
+	cancel := newMethod(basicCancel)
+	cancel.shortstr(tag)
+	cancel.bit(true)
+	ch.conn.send(ch.id, cancel)
+}
+
+/*
+Cancel a consumer, replying once its deliveries have been sent.
+*/
+func (ch *serverChannel) cancel(tag string, noWait bool) {
+	ch.mu.Lock()
+	ch.cancelled[tag] = true
+	done := ch.forwards[tag]
+	ch.mu.Unlock()
+
+	ch.ch.Cancel(tag, noWait)
+	if done != nil {
+		<-done
+	}
+	if !noWait {
+		cancelOk := newMethod(basicCancelOk)
+		cancelOk.shortstr(tag)
+		ch.conn.send(ch.id, cancelOk)
+	}
+}
+
+/*
+Wait for the channel's consumers to finish sending deliveries.
+*/
+func (ch *serverChannel) wait() {
+	ch.mu.Lock()
+	var pending []chan struct{}
+	for _, done := range ch.forwards {
+		pending = append(pending, done)
+	}
+	ch.mu.Unlock()
+	for _, done := range pending {
+		<-done
+	}
+}
+
+func (ch *serverChannel) get(queue string, noAck bool) error {
+	d, ok, err := ch.ch.Get(queue, noAck)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		empty := newMethod(basicGetEmpty)
+		empty.shortstr("")
+		ch.conn.send(ch.id, empty)
+		return nil
+	}
+	getOk := newMethod(basicGetOk)
+	getOk.longlong(d.DeliveryTag)
+	getOk.bit(d.Redelivered)
+	getOk.shortstr(d.Exchange)
+	getOk.shortstr(d.RoutingKey)
+	getOk.long(d.MessageCount)
+	ch.conn.sendContent(ch.id, getOk, deliveryProperties(d), d.Body)
+	return nil
+}
+
+/*
+Handle a content header or body frame for the pending publish.
+*/
+func (ch *serverChannel) content(kind byte, payload []byte) {
+	p := ch.publishing
+	if kind == frameHeader {
+		d := &decoder{buf: payload}
+		d.short()
+		d.short()
+		p.size = int(d.longlong())
+		p.msg = d.properties()
+		p.header = true
+		if d.err != nil {
+			ch.conn.close(amqp.FrameError, "FRAME_ERROR - malformed content header", basicPublish)
+			return
+		}
+	} else if kind == frameBody && p.header {
+		p.msg.Body = append(p.msg.Body, payload...)
+	} else {
+		ch.conn.close(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - expected a content header", basicPublish)
+		return
+	}
+	if len(p.msg.Body) >= p.size {
+		ch.publishing = nil
+		ch.publish(p)
+	}
+}
+
+/*
+Publish a message once its content has arrived. Returns and
+confirms are sent straight away, as the broker has already
+queued them by the time Publish returns.
+*/
+func (ch *serverChannel) publish(p *publishing) {
+	err := ch.ch.Publish(p.exchange, p.key, p.mandatory, p.immediate, p.msg)
+	if err != nil {
+		ch.failed(err, basicPublish)
+		return
+	}
+	select {
+	case r := <-ch.returns:
+		ret := newMethod(basicReturn)
+		ret.short(r.ReplyCode)
+		ret.shortstr(r.ReplyText)
+		ret.shortstr(r.Exchange)
+		ret.shortstr(r.RoutingKey)
+		ch.conn.sendContent(ch.id, ret, returnProperties(r), r.Body)
+	default:
+	}
+	select {
+	case confirm := <-ch.confirms:
+		id := uint32(basicAck)
+		if !confirm.Ack {
+			id = basicNack
+		}
+		ack := newMethod(id)
+		ack.longlong(confirm.DeliveryTag)
+		ack.bit(false)
+		ch.conn.send(ch.id, ack)
+	default:
+	}
+}
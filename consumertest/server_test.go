@@ -0,0 +1,133 @@
+//go:build integration
+
+package consumertest
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+func dialServer(t *testing.T) (*Broker, *amqp.Connection) {
+	broker := NewBroker()
+	server, err := NewServer(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	conn, err := amqp.Dial(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return broker, conn
+}
+
+func TestServerPublishConfirmsAndReturns(t *testing.T) {
+	broker, conn := dialServer(t)
+	ch, _ := conn.Channel()
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	ch.Publish("", "work", true, false, amqp.Publishing{Body: []byte("routed"), Priority: 2})
+	ch.Publish("", "nowhere", true, false, amqp.Publishing{MessageId: "lost"})
+	for tag := uint64(1); tag <= 2; tag++ {
+		if c := <-confirms; c.DeliveryTag != tag || !c.Ack {
+			t.Errorf("Wrong confirm %#v", c)
+		}
+	}
+	if r := <-returns; r.MessageId != "lost" || r.ReplyCode != amqp.NoRoute {
+		t.Errorf("Wrong return %#v", r)
+	}
+	msgs := broker.Messages("work")
+	if len(msgs) != 1 || string(msgs[0].Body) != "routed" || msgs[0].Priority != 2 {
+		t.Errorf("Wrong queued messages %v", msgs)
+	}
+}
+
+func TestServerGetAndNack(t *testing.T) {
+	broker, conn := dialServer(t)
+	ch, _ := conn.Channel()
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	if _, ok, err := ch.Get("work", false); ok || err != nil {
+		t.Errorf("Empty queues should have nothing to get, got %t %v", ok, err)
+	}
+	broker.Publish("", "work", amqp.Publishing{Body: []byte("a")})
+
+	d, ok, err := ch.Get("work", false)
+	if !ok || err != nil || string(d.Body) != "a" || d.Redelivered {
+		t.Fatalf("Wrong get %#v %v", d, err)
+	}
+	d.Nack(false, true)
+	d, _, _ = ch.Get("work", false)
+	if !d.Redelivered {
+		t.Error("Nacked messages should be redelivered")
+	}
+	d.Ack(false)
+	ch.Close()
+	if broker.Unacked("work") != 0 || len(broker.Messages("work")) != 0 {
+		t.Error("Message should be acked")
+	}
+}
+
+func TestServerChannelErrors(t *testing.T) {
+	_, conn := dialServer(t)
+	ch, _ := conn.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	_, err := ch.QueueDeclarePassive("missing", true, false, false, false, nil)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.NotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	<-closed
+
+	ch, err = conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel errors should leave the connection open, got %v", err)
+	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	ch.QueueDelete("work", false, false, false)
+	select {
+	case err := <-connClosed:
+		if err == nil || err.Code != amqp.NotImplemented {
+			t.Errorf("Unsupported methods should close the connection, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Connection should close")
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	broker, conn := dialServer(t)
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	broker.Disconnect()
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.ConnectionForced {
+			t.Errorf("Expected connection forced, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Connection should close")
+	}
+}
+
+func TestServerPublishToMissingExchange(t *testing.T) {
+	_, conn := dialServer(t)
+	ch, _ := conn.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	ch.Publish("missing", "key", false, false, amqp.Publishing{})
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.NotFound {
+			t.Errorf("Expected not found, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The channel should be closed")
+	}
+	if _, err := conn.Channel(); err != nil {
+		t.Errorf("The connection should still work, got %v", err)
+	}
+}
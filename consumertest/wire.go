@@ -0,0 +1,539 @@
+package consumertest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/streadway/amqp"
+	"io"
+	"math"
+	"time"
+)
+
+const protocolHeader = "AMQP\x00\x00\x09\x01"
+
+// Frame types.
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// Methods are identified by their class id and method id packed into one value.
+const (
+	connectionStart   = 10<<16 | 10
+	connectionStartOk = 10<<16 | 11
+	connectionTune    = 10<<16 | 30
+	connectionTuneOk  = 10<<16 | 31
+	connectionOpen    = 10<<16 | 40
+	connectionOpenOk  = 10<<16 | 41
+	connectionClose   = 10<<16 | 50
+	connectionCloseOk = 10<<16 | 51
+
+	channelOpen    = 20<<16 | 10
+	channelOpenOk  = 20<<16 | 11
+	channelFlow    = 20<<16 | 20
+	channelFlowOk  = 20<<16 | 21
+	channelClose   = 20<<16 | 40
+	channelCloseOk = 20<<16 | 41
+
+	exchangeDeclare   = 40<<16 | 10
+	exchangeDeclareOk = 40<<16 | 11
+
+	queueDeclare   = 50<<16 | 10
+	queueDeclareOk = 50<<16 | 11
+	queueBind      = 50<<16 | 20
+	queueBindOk    = 50<<16 | 21
+
+	basicQos       = 60<<16 | 10
+	basicQosOk     = 60<<16 | 11
+	basicConsume   = 60<<16 | 20
+	basicConsumeOk = 60<<16 | 21
+	basicCancel    = 60<<16 | 30
+	basicCancelOk  = 60<<16 | 31
+	basicPublish   = 60<<16 | 40
+	basicReturn    = 60<<16 | 50
+	basicDeliver   = 60<<16 | 60
+	basicGet       = 60<<16 | 70
+	basicGetOk     = 60<<16 | 71
+	basicGetEmpty  = 60<<16 | 72
+	basicAck       = 60<<16 | 80
+	basicReject    = 60<<16 | 90
+	basicNack      = 60<<16 | 120
+
+	confirmSelect   = 85<<16 | 10
+	confirmSelectOk = 85<<16 | 11
+)
+
+// Content header property flags.
+const (
+	flagContentType     = 0x8000
+	flagContentEncoding = 0x4000
+	flagHeaders         = 0x2000
+	flagDeliveryMode    = 0x1000
+	flagPriority        = 0x0800
+	flagCorrelationId   = 0x0400
+	flagReplyTo         = 0x0200
+	flagExpiration      = 0x0100
+	flagMessageId       = 0x0080
+	flagTimestamp       = 0x0040
+	flagType            = 0x0020
+	flagUserId          = 0x0010
+	flagAppId           = 0x0008
+	flagReserved        = 0x0004
+)
+
+var errMalformed = errors.New("Malformed AMQP frame.")
+
+/*
+Read a frame, returning its type, channel and payload.
+*/
+func readFrame(r io.Reader) (kind byte, channel uint16, payload []byte, err error) {
+	var header [7]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	kind = header[0]
+	channel = binary.BigEndian.Uint16(header[1:3])
+	payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[len(payload)-1] != frameEnd {
+		err = errMalformed
+	}
+	payload = payload[:len(payload)-1]
+	return
+}
+
+func writeFrame(w io.Writer, kind byte, channel uint16, payload []byte) error {
+	var header [7]byte
+	header[0] = kind
+	binary.BigEndian.PutUint16(header[1:3], channel)
+	binary.BigEndian.PutUint32(header[3:7], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{frameEnd})
+	return err
+}
+
+/*
+Reads method arguments and content headers. The first
+error is kept and later reads return zero values.
+*/
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) octet() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) short() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) long() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) longlong() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.take(int(d.octet())))
+}
+
+func (d *decoder) longstr() []byte {
+	return d.take(int(d.long()))
+}
+
+func (d *decoder) table() amqp.Table {
+	nested := &decoder{buf: d.longstr(), err: d.err}
+	table := amqp.Table{}
+	for nested.err == nil && len(nested.buf) > 0 {
+		name := nested.shortstr()
+		table[name] = nested.field()
+	}
+	d.err = nested.err
+	return table
+}
+
+func (d *decoder) field() interface{} {
+	switch d.octet() {
+	case 't':
+		return d.octet() != 0
+	case 'b':
+		return d.octet()
+	case 's':
+		return int16(d.short())
+	case 'I':
+		return int32(d.long())
+	case 'l':
+		return int64(d.longlong())
+	case 'f':
+		return math.Float32frombits(d.long())
+	case 'd':
+		return math.Float64frombits(d.longlong())
+	case 'D':
+		scale := d.octet()
+		return amqp.Decimal{Scale: scale, Value: int32(d.long())}
+	case 'S':
+		return string(d.longstr())
+	case 'A':
+		nested := &decoder{buf: d.longstr(), err: d.err}
+		var values []interface{}
+		for nested.err == nil && len(nested.buf) > 0 {
+			values = append(values, nested.field())
+		}
+		d.err = nested.err
+		return values
+	case 'T':
+		return time.Unix(int64(d.longlong()), 0)
+	case 'F':
+		return d.table()
+	case 'x':
+		return append([]byte(nil), d.longstr()...)
+	case 'V':
+		return nil
+	}
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	return nil
+}
+
+/*
+Read the properties from a content header.
+*/
+func (d *decoder) properties() (msg amqp.Publishing) {
+	flags := d.short()
+	if flags&flagContentType != 0 {
+		msg.ContentType = d.shortstr()
+	}
+	if flags&flagContentEncoding != 0 {
+		msg.ContentEncoding = d.shortstr()
+	}
+	if flags&flagHeaders != 0 {
+		msg.Headers = d.table()
+	}
+	if flags&flagDeliveryMode != 0 {
+		msg.DeliveryMode = d.octet()
+	}
+	if flags&flagPriority != 0 {
+		msg.Priority = d.octet()
+	}
+	if flags&flagCorrelationId != 0 {
+		msg.CorrelationId = d.shortstr()
+	}
+	if flags&flagReplyTo != 0 {
+		msg.ReplyTo = d.shortstr()
+	}
+	if flags&flagExpiration != 0 {
+		msg.Expiration = d.shortstr()
+	}
+	if flags&flagMessageId != 0 {
+		msg.MessageId = d.shortstr()
+	}
+	if flags&flagTimestamp != 0 {
+		msg.Timestamp = time.Unix(int64(d.longlong()), 0)
+	}
+	if flags&flagType != 0 {
+		msg.Type = d.shortstr()
+	}
+	if flags&flagUserId != 0 {
+		msg.UserId = d.shortstr()
+	}
+	if flags&flagAppId != 0 {
+		msg.AppId = d.shortstr()
+	}
+	if flags&flagReserved != 0 {
+		d.shortstr()
+	}
+	return
+}
+
+/*
+Builds method arguments and content headers.
+*/
+type encoder struct {
+	bytes.Buffer
+}
+
+/*
+Start encoding a method's arguments.
+*/
+func newMethod(id uint32) *encoder {
+	e := &encoder{}
+	e.long(id)
+	return e
+}
+
+func (e *encoder) octet(v byte) {
+	e.WriteByte(v)
+}
+
+func (e *encoder) short(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) long(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) longlong(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) bit(v bool) {
+	if v {
+		e.octet(1)
+	} else {
+		e.octet(0)
+	}
+}
+
+func (e *encoder) shortstr(s string) {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	e.octet(byte(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) longstr(s []byte) {
+	e.long(uint32(len(s)))
+	e.Write(s)
+}
+
+func (e *encoder) table(table amqp.Table) {
+	nested := &encoder{}
+	for name, value := range table {
+		nested.shortstr(name)
+		nested.field(value)
+	}
+	e.longstr(nested.Bytes())
+}
+
+func (e *encoder) field(value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		e.octet('t')
+		e.bit(v)
+	case byte:
+		e.octet('b')
+		e.octet(v)
+	case int16:
+		e.octet('s')
+		e.short(uint16(v))
+	case int:
+		e.octet('I')
+		e.long(uint32(v))
+	case int32:
+		e.octet('I')
+		e.long(uint32(v))
+	case int64:
+		e.octet('l')
+		e.longlong(uint64(v))
+	case float32:
+		e.octet('f')
+		e.long(math.Float32bits(v))
+	case float64:
+		e.octet('d')
+		e.longlong(math.Float64bits(v))
+	case amqp.Decimal:
+		e.octet('D')
+		e.octet(v.Scale)
+		e.long(uint32(v.Value))
+	case string:
+		e.octet('S')
+		e.longstr([]byte(v))
+	case []interface{}:
+		nested := &encoder{}
+		for _, item := range v {
+			nested.field(item)
+		}
+		e.octet('A')
+		e.longstr(nested.Bytes())
+	case time.Time:
+		e.octet('T')
+		e.longlong(uint64(v.Unix()))
+	case amqp.Table:
+		e.octet('F')
+		e.table(v)
+	case []byte:
+		e.octet('x')
+		e.longstr(v)
+	default:
+		e.octet('V')
+	}
+}
+
+/*
+Encode a content header for a body of size bytes.
+*/
+func (e *encoder) contentHeader(size int, msg amqp.Publishing) {
+	var flags uint16
+	if msg.ContentType != "" {
+		flags |= flagContentType
+	}
+	if msg.ContentEncoding != "" {
+		flags |= flagContentEncoding
+	}
+	if len(msg.Headers) > 0 {
+		flags |= flagHeaders
+	}
+	if msg.DeliveryMode != 0 {
+		flags |= flagDeliveryMode
+	}
+	if msg.Priority != 0 {
+		flags |= flagPriority
+	}
+	if msg.CorrelationId != "" {
+		flags |= flagCorrelationId
+	}
+	if msg.ReplyTo != "" {
+		flags |= flagReplyTo
+	}
+	if msg.Expiration != "" {
+		flags |= flagExpiration
+	}
+	if msg.MessageId != "" {
+		flags |= flagMessageId
+	}
+	if !msg.Timestamp.IsZero() {
+		flags |= flagTimestamp
+	}
+	if msg.Type != "" {
+		flags |= flagType
+	}
+	if msg.UserId != "" {
+		flags |= flagUserId
+	}
+	if msg.AppId != "" {
+		flags |= flagAppId
+	}
+
+	// Class id, then the unused weight field.
+	e.short(60)
+	e.short(0)
+	e.longlong(uint64(size))
+	e.short(flags)
+	if flags&flagContentType != 0 {
+		e.shortstr(msg.ContentType)
+	}
+	if flags&flagContentEncoding != 0 {
+		e.shortstr(msg.ContentEncoding)
+	}
+	if flags&flagHeaders != 0 {
+		e.table(msg.Headers)
+	}
+	if flags&flagDeliveryMode != 0 {
+		e.octet(msg.DeliveryMode)
+	}
+	if flags&flagPriority != 0 {
+		e.octet(msg.Priority)
+	}
+	if flags&flagCorrelationId != 0 {
+		e.shortstr(msg.CorrelationId)
+	}
+	if flags&flagReplyTo != 0 {
+		e.shortstr(msg.ReplyTo)
+	}
+	if flags&flagExpiration != 0 {
+		e.shortstr(msg.Expiration)
+	}
+	if flags&flagMessageId != 0 {
+		e.shortstr(msg.MessageId)
+	}
+	if flags&flagTimestamp != 0 {
+		e.longlong(uint64(msg.Timestamp.Unix()))
+	}
+	if flags&flagType != 0 {
+		e.shortstr(msg.Type)
+	}
+	if flags&flagUserId != 0 {
+		e.shortstr(msg.UserId)
+	}
+	if flags&flagAppId != 0 {
+		e.shortstr(msg.AppId)
+	}
+}
+
+/*
+Get the properties of a delivery, to send them to a client.
+*/
+func deliveryProperties(d amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+	}
+}
+
+func returnProperties(r amqp.Return) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         r.Headers,
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		CorrelationId:   r.CorrelationId,
+		ReplyTo:         r.ReplyTo,
+		Expiration:      r.Expiration,
+		MessageId:       r.MessageId,
+		Timestamp:       r.Timestamp,
+		Type:            r.Type,
+		UserId:          r.UserId,
+		AppId:           r.AppId,
+	}
+}
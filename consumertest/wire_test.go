@@ -0,0 +1,96 @@
+package consumertest
+
+import (
+	"bytes"
+	"github.com/streadway/amqp"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, frameMethod, 3, []byte("payload"))
+	kind, channel, payload, err := readFrame(&buf)
+	if err != nil || kind != frameMethod || channel != 3 || string(payload) != "payload" {
+		t.Errorf("Wrong frame %d %d %q %v", kind, channel, payload, err)
+	}
+
+	buf.Reset()
+	writeFrame(&buf, frameBody, 1, []byte("x"))
+	raw := buf.Bytes()
+	raw[len(raw)-1] = 0
+	if _, _, _, err := readFrame(bytes.NewReader(raw)); err != errMalformed {
+		t.Errorf("A bad frame end should fail, got %v", err)
+	}
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	table := amqp.Table{
+		"bool":    true,
+		"byte":    byte(7),
+		"short":   int16(-3),
+		"int":     int32(42),
+		"long":    int64(1 << 40),
+		"float":   float32(1.5),
+		"double":  2.25,
+		"decimal": amqp.Decimal{Scale: 2, Value: 1234},
+		"string":  "text",
+		"array":   []interface{}{"a", int32(1)},
+		"time":    ts,
+		"nested":  amqp.Table{"x-death": []interface{}{amqp.Table{"queue": "orders"}}},
+		"bytes":   []byte{1, 2},
+		"void":    nil,
+	}
+	e := &encoder{}
+	e.table(table)
+	d := &decoder{buf: e.Bytes()}
+	got := d.table()
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if !reflect.DeepEqual(got, table) {
+		t.Errorf("Tables don't match\n%#v\n%#v", got, table)
+	}
+
+	d = &decoder{buf: e.Bytes()[:10]}
+	d.table()
+	if d.err != errMalformed {
+		t.Error("Truncated tables should fail")
+	}
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	msg := amqp.Publishing{
+		Headers:         amqp.Table{"attempt": int32(2)},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		Priority:        3,
+		CorrelationId:   "corr",
+		ReplyTo:         "callback",
+		Expiration:      "60000",
+		MessageId:       "id",
+		Timestamp:       time.Unix(1700000000, 0),
+		Type:            "order.created",
+		UserId:          "guest",
+		AppId:           "app",
+	}
+	e := &encoder{}
+	e.contentHeader(12, msg)
+	d := &decoder{buf: e.Bytes()}
+	if d.short() != 60 || d.short() != 0 || d.longlong() != 12 {
+		t.Error("Wrong content header fields")
+	}
+	if got := d.properties(); d.err != nil || !reflect.DeepEqual(got, msg) {
+		t.Errorf("Properties don't match\n%#v\n%#v", got, msg)
+	}
+
+	e = &encoder{}
+	e.contentHeader(0, amqp.Publishing{})
+	d = &decoder{buf: e.Bytes()[12:]}
+	if d.short() != 0 {
+		t.Error("Empty properties should set no flags")
+	}
+}
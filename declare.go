@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+)
+
+/*
+Something declared on the broker by Declare.
+*/
+type Declaration struct {
+	// One of "exchange", "queue" or "binding".
+	Kind string
+	Name string
+	// False when the exchange or queue was already present.
+	// Bindings are always reported as created.
+	Created bool
+}
+
+/*
+Declare the exchanges, queues and bindings in the configuration
+file and report which ones were created.
+
+A separate connection is used and closed before returning, so
+exclusive queues are removed again once Declare returns.
+*/
+func (c *Consumer) Declare() (decls []Declaration, err error) {
+	connData := c.topology.Connection()
+	conn, err := dialerOrDefault(c.dial)(connData.Url())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return declareAll(conn, c.topology, c.log())
+}
+
+func declareAll(conn Broker, top topology, logger Logger) (decls []Declaration, err error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	seen := map[string]bool{}
+	for _, bind := range top.Bindings() {
+		ex, q := bind.Exchange(), bind.Queue()
+		exExists, err := exists(conn, func(ch Channel) error {
+			return ch.ExchangeDeclarePassive(ex.name, ex.kind, ex.durable, ex.autoDelete, false, false, nil)
+		})
+		if err != nil {
+			return decls, err
+		}
+		qExists, err := exists(conn, func(ch Channel) error {
+			_, err := ch.QueueDeclarePassive(q.name, q.durable, q.autoDelete, q.exclusive, false, nil)
+			return err
+		})
+		if err != nil {
+			return decls, err
+		}
+
+		err = declare(channel, bind, logger)
+		if err != nil {
+			return decls, err
+		}
+		if !seen[ex.name] {
+			decls = append(decls, Declaration{Kind: "exchange", Name: ex.name, Created: !exExists})
+			seen[ex.name] = true
+		}
+		decls = append(decls,
+			Declaration{Kind: "queue", Name: q.name, Created: !qExists},
+			Declaration{Kind: "binding", Name: ex.name + " -> " + q.name + " (" + q.routingKey + ")", Created: true},
+		)
+	}
+	return
+}
+
+/*
+Run a passive declare on its own channel, as the broker closes
+the channel when the exchange or queue is missing. Exclusive
+queues owned by another connection are locked, but do exist.
+*/
+func exists(conn Broker, passive func(Channel) error) (bool, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	err = passive(channel)
+	if amqpErr, ok := err.(*amqp.Error); ok {
+		switch amqpErr.Code {
+		case amqp.NotFound:
+			return false, nil
+		case amqp.ResourceLocked:
+			return true, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	channel.Close()
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package consumer
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+// Returns err from passive declares.
+type passiveChannel struct {
+	Channel
+	err error
+}
+
+func (c *passiveChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, c.err
+}
+
+func (c *passiveChannel) Close() error {
+	return nil
+}
+
+type channelBroker struct {
+	Broker
+	channel Channel
+}
+
+func (b *channelBroker) Channel() (Channel, error) {
+	return b.channel, nil
+}
+
+func TestExists(t *testing.T) {
+	cases := []struct {
+		err    error
+		exists bool
+		fails  bool
+	}{
+		{nil, true, false},
+		{&amqp.Error{Code: amqp.NotFound}, false, false},
+		{&amqp.Error{Code: amqp.ResourceLocked}, true, false},
+		{&amqp.Error{Code: amqp.AccessRefused}, false, true},
+		{errors.New("boom"), false, true},
+	}
+	for _, tc := range cases {
+		conn := &channelBroker{channel: &passiveChannel{err: tc.err}}
+		exists, err := exists(conn, func(ch Channel) error {
+			_, err := ch.QueueDeclarePassive("orders", true, false, true, false, nil)
+			return err
+		})
+		if exists != tc.exists || (err != nil) != tc.fails {
+			t.Errorf("%v: got exists=%t err=%v", tc.err, exists, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package consumer
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Remembers which messages have been handled successfully.
+*/
+type DedupStore interface {
+	// Whether key has already been recorded.
+	Seen(ctx context.Context, key string) (bool, error)
+	// Record that the message for key was handled.
+	Record(ctx context.Context, key string) error
+}
+
+/*
+Wrap a handler so messages that were already handled are acked and skipped.
+
+The key for each message comes from keyFunc, for example MessageIdKey,
+HeaderKey or BodyHashKey. Messages with an empty key are always handled.
+A message is only recorded after next succeeds, so failed messages can
+be retried. Failing to record a handled message is logged and counted
+rather than returned, so the message is still acked.
+*/
+func Dedup(store DedupStore, keyFunc KeyFunc, next Handler) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		key := keyFunc(msg)
+		if key == "" {
+			return next(ctx, msg)
+		}
+		seen, err := store.Seen(ctx, key)
+		if err != nil {
+			return err
+		}
+		if seen {
+			if !msg.Settled() {
+				return msg.Ack(false)
+			}
+			return nil
+		}
+		err = next(ctx, msg)
+		if err != nil {
+			return err
+		}
+		err = store.Record(ctx, key)
+		if err != nil {
+			loggerOrDefault(msg.logger).Warn("Could not record handled message", "queue", msg.queue, "key", key, "error", err)
+			msg.metrics.dedupFailed(msg.queue)
+		}
+		return nil
+	}
+}
+
+/*
+Use the message's MessageId as its key.
+*/
+func MessageIdKey(msg *Message) string {
+	return msg.MessageId
+}
+
+/*
+Use a SHA-256 hash of the message body as its key.
+*/
+func BodyHashKey(msg *Message) string {
+	sum := sha256.Sum256(msg.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+A DedupStore that keeps the most recently recorded keys in memory.
+
+Keys are forgotten once ttl has passed, or when more than size keys
+have been recorded, oldest first.
+*/
+type MemoryStore struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	keys  map[string]*list.Element
+	now   func() time.Time
+}
+
+type memoryEntry struct {
+	key     string
+	expires time.Time
+}
+
+/*
+Create a MemoryStore holding at most size keys for ttl each.
+A size of zero means no limit.
+*/
+func NewMemoryStore(size int, ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+func (s *MemoryStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.keys[key]
+	if !ok {
+		return false, nil
+	}
+	if s.now().After(el.Value.(*memoryEntry).expires) {
+		s.order.Remove(el)
+		delete(s.keys, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) Record(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(key, s.now().Add(s.ttl))
+	return nil
+}
+
+func (s *MemoryStore) record(key string, expires time.Time) {
+	if el, ok := s.keys[key]; ok {
+		el.Value.(*memoryEntry).expires = expires
+		s.order.MoveToFront(el)
+		return
+	}
+	s.keys[key] = s.order.PushFront(&memoryEntry{key: key, expires: expires})
+	for s.size > 0 && s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.keys, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+/*
+A DedupStore that survives restarts by appending keys to a file.
+
+Keys are kept in memory as a MemoryStore and each recorded key is
+written to the file and synced before Record returns. Expired keys
+are dropped from the file when it is opened.
+*/
+type FileStore struct {
+	*MemoryStore
+	mu   sync.Mutex
+	file *os.File
+}
+
+/*
+Open or create the file at path, loading the keys that haven't expired.
+*/
+func OpenFileStore(path string, size int, ttl time.Duration) (*FileStore, error) {
+	store := &FileStore{MemoryStore: NewMemoryStore(size, ttl)}
+	err := store.load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite the file with only the live keys so it doesn't grow forever.
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	for el := store.order.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*memoryEntry)
+		fmt.Fprintf(w, "%d\t%s\n", entry.expires.Unix(), entry.key)
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *FileStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := s.now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		unix, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		expires := time.Unix(unix, 0)
+		if expires.After(now) {
+			s.MemoryStore.record(parts[1], expires)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *FileStore) Record(ctx context.Context, key string) error {
+	if strings.ContainsAny(key, "\t\n") {
+		return fmt.Errorf("Dedup keys cannot contain tabs or newlines. Got %q", key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := s.now().Add(s.ttl)
+	_, err := fmt.Fprintf(s.file, "%d\t%s\n", expires.Unix(), key)
+	if err != nil {
+		return err
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.MemoryStore.mu.Lock()
+	defer s.MemoryStore.mu.Unlock()
+	s.MemoryStore.record(key, expires)
+	return nil
+}
+
+/*
+Close the underlying file.
+*/
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
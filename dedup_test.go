@@ -0,0 +1,153 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupSkipsHandledMessages(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	store := NewMemoryStore(10, time.Hour)
+	calls := 0
+	handler := Dedup(store, MessageIdKey, func(ctx context.Context, msg *Message) error {
+		calls++
+		return nil
+	})
+
+	for i := 1; i <= 2; i++ {
+		msg := newTestMessage(r, uint64(i))
+		msg.MessageId = "abc"
+		c.handle(queue{name: "test"}, handler, true, msg)
+	}
+	if calls != 1 {
+		t.Errorf("Duplicate should be skipped. Handler called %d times", calls)
+	}
+	if len(r.acks) != 2 {
+		t.Error("Both messages should be acked")
+	}
+}
+
+func TestDedupRecordsOnlySuccess(t *testing.T) {
+	store := NewMemoryStore(10, time.Hour)
+	fail := true
+	handler := Dedup(store, BodyHashKey, func(ctx context.Context, msg *Message) error {
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	msg := newTestMessage(&ackRecorder{}, 1)
+	msg.Body = []byte("payload")
+	if handler(context.Background(), msg) == nil {
+		t.Error("Handler error should be returned")
+	}
+	if seen, _ := store.Seen(context.Background(), BodyHashKey(msg)); seen {
+		t.Error("Failed messages should not be recorded")
+	}
+	fail = false
+	handler(context.Background(), msg)
+	if seen, _ := store.Seen(context.Background(), BodyHashKey(msg)); !seen {
+		t.Error("Successful messages should be recorded")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Seen(ctx context.Context, key string) (bool, error) {
+	return false, nil
+}
+
+func (failingStore) Record(ctx context.Context, key string) error {
+	return errors.New("disk full")
+}
+
+func TestDedupRecordFailure(t *testing.T) {
+	r := &ackRecorder{}
+	m := newMetrics()
+	c := &Consumer{metrics: m, logger: NopLogger()}
+	q := queue{name: "orders"}
+	handler := Dedup(failingStore{}, MessageIdKey, func(ctx context.Context, msg *Message) error {
+		return nil
+	})
+	msg := c.receive(q, amqp.Delivery{Acknowledger: r, DeliveryTag: 1, MessageId: "abc"})
+	if err := c.handle(q, handler, true, msg); err != nil {
+		t.Errorf("Store failures should not fail the handler, got %v", err)
+	}
+	if len(r.acks) != 1 || len(r.nacks) != 0 {
+		t.Error("Handled messages should be acked when the store fails")
+	}
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `consumer_dedup_record_failures_total{queue="orders"} 1`) {
+		t.Errorf("Store failures should be counted:\n%s", buf.String())
+	}
+}
+
+func TestDedupEmptyKey(t *testing.T) {
+	store := NewMemoryStore(10, time.Hour)
+	calls := 0
+	handler := Dedup(store, MessageIdKey, func(ctx context.Context, msg *Message) error {
+		calls++
+		return nil
+	})
+	handler(context.Background(), newTestMessage(&ackRecorder{}, 1))
+	handler(context.Background(), newTestMessage(&ackRecorder{}, 2))
+	if calls != 2 {
+		t.Error("Messages without a key should always be handled")
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := NewMemoryStore(2, time.Minute)
+	store.now = func() time.Time {
+		return now
+	}
+	store.Record(ctx, "a")
+	store.Record(ctx, "b")
+	store.Record(ctx, "c")
+	if seen, _ := store.Seen(ctx, "a"); seen {
+		t.Error("Oldest key should be evicted")
+	}
+	if seen, _ := store.Seen(ctx, "c"); !seen {
+		t.Error("Newest key should be kept")
+	}
+	now = now.Add(2 * time.Minute)
+	if seen, _ := store.Seen(ctx, "c"); seen {
+		t.Error("Expired keys should be forgotten")
+	}
+}
+
+func TestFileStoreSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	store, err := OpenFileStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("Should open. Got %s", err)
+	}
+	store.Record(ctx, "abc")
+	if err := store.Record(ctx, "bad\nkey"); err == nil {
+		t.Error("Keys with newlines should fail")
+	}
+	store.Close()
+
+	store, err = OpenFileStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("Should reopen. Got %s", err)
+	}
+	defer store.Close()
+	if seen, _ := store.Seen(ctx, "abc"); !seen {
+		t.Error("Recorded keys should survive a reopen")
+	}
+	if seen, _ := store.Seen(ctx, "def"); seen {
+		t.Error("Unknown keys should not be seen")
+	}
+}
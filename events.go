@@ -0,0 +1,49 @@
+package consumer
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+The kinds of events a Consumer emits.
+*/
+const (
+	EventHandlerTimeout = "handler_timeout"
+	EventDecodeFailed   = "decode_failed"
+)
+
+/*
+Something noteworthy that happened while consuming.
+*/
+type Event struct {
+	Type        string
+	Queue       string
+	DeliveryTag uint64
+	Err         error
+	Time        time.Time
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%#v", e)
+}
+
+/*
+Register a function to be called for each event the consumer emits.
+
+The function is called synchronously from the goroutine that
+processes the queue, so it should return quickly.
+*/
+func (c *Consumer) OnEvent(fn func(Event)) {
+	c.onEvent = fn
+}
+
+func (c *Consumer) emit(e Event) {
+	if c.onEvent == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	c.onEvent(e)
+}
@@ -0,0 +1,342 @@
+//go:build integration
+
+package consumer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/markstory/go-consumer"
+	"github.com/markstory/go-consumer/consumertest"
+	"github.com/streadway/amqp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// These tests run the consumer against consumertest.Server over a real
+// AMQP connection. Run them with:
+//
+//	go test -tags integration ./...
+
+const integrationConfig = `
+[connection]
+host = 127.0.0.1
+port = %d
+
+[exchange-orders]
+name = app
+type = topic
+
+[queue-orders]
+name = orders
+exclusive = False
+routing_key = order.*
+prefetch = 5
+
+[exchange-audit]
+name = audit
+type = fanout
+durable = False
+
+[queue-audit]
+name = audit
+durable = False
+auto_delete = True
+exclusive = True
+`
+
+type integration struct {
+	broker *consumertest.Broker
+	server *consumertest.Server
+	config string
+}
+
+func newIntegration(t *testing.T) *integration {
+	broker := consumertest.NewBroker()
+	server, err := consumertest.NewServer(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	config := filepath.Join(t.TempDir(), "consumer.ini")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(integrationConfig, server.Addr().Port)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &integration{broker: broker, server: server, config: config}
+}
+
+func (it *integration) consumer(t *testing.T) *consumer.Consumer {
+	c, err := consumer.Create(it.config, consumer.WithLogger(consumer.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+/*
+Start consuming in the background, returning a channel
+that receives Consume's result.
+*/
+func (it *integration) consume(t *testing.T, c *consumer.Consumer, handler consumer.Handler) chan error {
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.ConsumeContext(handler)
+	}()
+	waitFor(t, "Consumers should start", func() bool {
+		return it.broker.Consumers("orders") == 1 && it.broker.Consumers("audit") == 1
+	})
+	return done
+}
+
+func waitFor(t *testing.T, msg string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func stop(t *testing.T, c *consumer.Consumer, done chan error) {
+	t.Helper()
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Consume should return nil after Stop, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Consume did not return after Stop")
+	}
+}
+
+func TestIntegrationDeclaresTopology(t *testing.T) {
+	it := newIntegration(t)
+	c := it.consumer(t)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	for _, name := range []string{"app", "audit"} {
+		if !it.broker.HasExchange(name) {
+			t.Errorf("Exchange %s should be declared", name)
+		}
+	}
+	for _, name := range []string{"orders", "audit"} {
+		if !it.broker.HasQueue(name) {
+			t.Errorf("Queue %s should be declared", name)
+		}
+	}
+
+	it.broker.Publish("app", "order.created", amqp.Publishing{})
+	it.broker.Publish("app", "payment.created", amqp.Publishing{})
+	it.broker.Publish("audit", "anything", amqp.Publishing{})
+	if len(it.broker.Messages("orders")) != 1 || len(it.broker.Messages("audit")) != 1 {
+		t.Error("Queues should be bound with their routing keys")
+	}
+	if status := c.Status(); !status.Connected || !status.Declared {
+		t.Errorf("Wrong status %#v", status)
+	}
+}
+
+func TestIntegrationDeclareConflict(t *testing.T) {
+	it := newIntegration(t)
+	conn, _ := it.broker.Dial("")
+	ch, _ := conn.Channel()
+	ch.ExchangeDeclare("app", "direct", true, false, false, false, nil)
+	conn.Close()
+
+	err := it.consumer(t).Connect()
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("Redeclaring an exchange with another type should fail, got %v", err)
+	}
+}
+
+func TestIntegrationConsume(t *testing.T) {
+	it := newIntegration(t)
+	c := it.consumer(t)
+
+	received := make(chan *consumer.Message, 10)
+	done := it.consume(t, c, func(ctx context.Context, msg *consumer.Message) error {
+		received <- msg
+		if string(msg.Body) == "fail" && !msg.Redelivered {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	pub, err := c.Publisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	body := make([]byte, 300000)
+	for _, msg := range []consumer.Publishing{
+		{Body: []byte("ok"), Headers: amqp.Table{"tenant": "acme"}, MessageId: "1"},
+		{Body: body},
+		{Body: []byte("fail")},
+	} {
+		if err := pub.Publish(ctx, "app", "order.created", msg); err != nil {
+			t.Fatalf("Publish should be confirmed, got %v", err)
+		}
+	}
+
+	first := <-received
+	if string(first.Body) != "ok" || first.Headers["tenant"] != "acme" || first.MessageId != "1" || first.Queue() != "orders" {
+		t.Errorf("Wrong first message %#v", first.Delivery)
+	}
+	if large := <-received; len(large.Body) != len(body) {
+		t.Errorf("Large bodies should arrive whole, got %d bytes", len(large.Body))
+	}
+	if failed := <-received; string(failed.Body) != "fail" || failed.Redelivered {
+		t.Error("Wrong failing message")
+	}
+	if retried := <-received; string(retried.Body) != "fail" || !retried.Redelivered {
+		t.Error("Failed messages should be redelivered")
+	}
+	waitFor(t, "Messages should be acked", func() bool {
+		return it.broker.Unacked("orders") == 0 && len(it.broker.Messages("orders")) == 0
+	})
+
+	stop(t, c, done)
+	if it.broker.Consumers("orders") != 0 {
+		t.Error("Stop should cancel consumers")
+	}
+	if it.broker.HasQueue("audit") {
+		t.Error("Exclusive queues should be deleted once the connection closes")
+	}
+}
+
+func TestIntegrationPublishAfterInvalidHeaders(t *testing.T) {
+	it := newIntegration(t)
+	c := it.consumer(t)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	pub, err := c.Publisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bad := consumer.Publishing{Headers: amqp.Table{"n": uint64(1)}}
+	if err := pub.Publish(ctx, "app", "order.created", bad); err == nil {
+		t.Error("Publishing invalid headers should fail")
+	}
+	if err := pub.Publish(ctx, "app", "order.created", consumer.Publishing{Body: []byte("ok")}); err != nil {
+		t.Errorf("Publishing after a failed publish should be confirmed, got %v", err)
+	}
+	if msgs := it.broker.Messages("orders"); len(msgs) != 1 || string(msgs[0].Body) != "ok" {
+		t.Errorf("Wrong queued messages %v", msgs)
+	}
+}
+
+func TestIntegrationStopRequeuesUnacked(t *testing.T) {
+	it := newIntegration(t)
+	c := it.consumer(t)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *consumer.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Consume(func(msg *consumer.Message) {
+			received <- msg
+		})
+	}()
+	waitFor(t, "Consumers should start", func() bool { return it.broker.Consumers("orders") == 1 })
+
+	it.broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("held")})
+	<-received
+	if it.broker.Unacked("orders") != 1 {
+		t.Error("The message should be waiting for an ack")
+	}
+
+	stop(t, c, done)
+	msgs := it.broker.Messages("orders")
+	if len(msgs) != 1 || string(msgs[0].Body) != "held" {
+		t.Errorf("Unacked messages should be requeued on shutdown, got %v", msgs)
+	}
+}
+
+func TestIntegrationPauseResume(t *testing.T) {
+	it := newIntegration(t)
+	c := it.consumer(t)
+	received := make(chan *consumer.Message, 10)
+	done := it.consume(t, c, func(ctx context.Context, msg *consumer.Message) error {
+		received <- msg
+		return nil
+	})
+
+	if err := c.Pause("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if it.broker.Consumers("orders") != 0 {
+		t.Error("Pausing should cancel the queue's consumer")
+	}
+	it.broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("later")})
+	if err := c.Resume("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; string(msg.Body) != "later" {
+		t.Errorf("Wrong message %s", msg.Body)
+	}
+	if prefetch := it.broker.Prefetch("orders"); prefetch != 5 {
+		t.Errorf("The resumed consumer should keep its prefetch, got %d", prefetch)
+	}
+	stop(t, c, done)
+}
+
+func TestIntegrationReconnect(t *testing.T) {
+	it := newIntegration(t)
+	c := it.consumer(t)
+	received := make(chan *consumer.Message, 10)
+	handler := func(ctx context.Context, msg *consumer.Message) error {
+		received <- msg
+		return nil
+	}
+	done := it.consume(t, c, handler)
+
+	it.broker.Disconnect()
+	waitFor(t, "The consumer should notice the connection closing", func() bool {
+		return !c.Status().Connected
+	})
+	if it.broker.HasQueue("audit") {
+		t.Error("Exclusive queues should be deleted with the connection")
+	}
+
+	// Consuming again reconnects and declares the topology.
+	stop(t, c, done)
+	done = it.consume(t, c, handler)
+	if !c.Status().Connected || !it.broker.HasQueue("audit") {
+		t.Error("Reconnecting should declare the topology again")
+	}
+
+	it.broker.Publish("app", "order.created", amqp.Publishing{Body: []byte("after")})
+	select {
+	case msg := <-received:
+		if string(msg.Body) != "after" {
+			t.Errorf("Wrong message %s", msg.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages should be consumed after reconnecting")
+	}
+	waitFor(t, "The message should be acked", func() bool {
+		return it.broker.Unacked("orders") == 0 && len(it.broker.Messages("orders")) == 0
+	})
+	stop(t, c, done)
+}
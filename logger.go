@@ -0,0 +1,147 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+/*
+Receives the log messages for consumer lifecycle events.
+
+keyvals are alternating keys and values, such as
+"queue", "orders", "delivery_tag", 12.
+*/
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+/*
+Logs to a standard library logger as "LEVEL msg key=value ...".
+
+This is the default logger, writing to log.Default().
+*/
+func StdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Debug(msg string, keyvals ...interface{}) { s.print("DEBUG", msg, keyvals) }
+func (s stdLogger) Info(msg string, keyvals ...interface{})  { s.print("INFO", msg, keyvals) }
+func (s stdLogger) Warn(msg string, keyvals ...interface{})  { s.print("WARN", msg, keyvals) }
+func (s stdLogger) Error(msg string, keyvals ...interface{}) { s.print("ERROR", msg, keyvals) }
+
+func (s stdLogger) print(level, msg string, keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], value)
+	}
+	s.l.Print(b.String())
+}
+
+/*
+Logs to a log/slog logger.
+*/
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Debug(msg string, keyvals ...interface{}) { s.log(slog.LevelDebug, msg, keyvals) }
+func (s slogLogger) Info(msg string, keyvals ...interface{})  { s.log(slog.LevelInfo, msg, keyvals) }
+func (s slogLogger) Warn(msg string, keyvals ...interface{})  { s.log(slog.LevelWarn, msg, keyvals) }
+func (s slogLogger) Error(msg string, keyvals ...interface{}) { s.log(slog.LevelError, msg, keyvals) }
+
+func (s slogLogger) log(level slog.Level, msg string, keyvals []interface{}) {
+	s.l.Log(context.Background(), level, msg, keyvals...)
+}
+
+/*
+Discards all log messages.
+*/
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+var defaultLogger = StdLogger(log.Default())
+
+/*
+Customizes consumers, publishers and clients when they are created.
+*/
+type Option func(*options)
+
+type options struct {
+	logger      Logger
+	tracer      Tracer
+	propagators []Propagator
+	dial        Dialer
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: defaultLogger}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+/*
+Send log messages to l instead of the standard library logger.
+A nil logger discards log messages.
+*/
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		if l == nil {
+			l = NopLogger()
+		}
+		o.logger = l
+	}
+}
+
+/*
+Use the default logger when one hasn't been set, so zero
+value structs can still log.
+*/
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+/*
+Log fields describing a message.
+*/
+func messageFields(q queue, msg *Message) []interface{} {
+	return []interface{}{
+		"queue", q.name,
+		"exchange", msg.Exchange,
+		"routing_key", msg.RoutingKey,
+		"delivery_tag", msg.DeliveryTag,
+	}
+}
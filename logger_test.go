@@ -0,0 +1,96 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Keeps every log line so tests can inspect them.
+type logRecorder struct {
+	lines []string
+}
+
+func (r *logRecorder) record(level, msg string, keyvals []interface{}) {
+	var buf bytes.Buffer
+	StdLogger(log.New(&buf, "", 0)).(stdLogger).print(level, msg, keyvals)
+	r.lines = append(r.lines, strings.TrimSpace(buf.String()))
+}
+
+func (r *logRecorder) Debug(msg string, keyvals ...interface{}) { r.record("DEBUG", msg, keyvals) }
+func (r *logRecorder) Info(msg string, keyvals ...interface{})  { r.record("INFO", msg, keyvals) }
+func (r *logRecorder) Warn(msg string, keyvals ...interface{})  { r.record("WARN", msg, keyvals) }
+func (r *logRecorder) Error(msg string, keyvals ...interface{}) { r.record("ERROR", msg, keyvals) }
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := StdLogger(log.New(&buf, "", 0))
+	logger.Info("Declaring queue", "queue", "orders", "durable", true, "odd")
+	expected := "INFO Declaring queue queue=orders durable=true odd=MISSING\n"
+	if buf.String() != expected {
+		t.Errorf("Log line is wrong. Got %q", buf.String())
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := SlogLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+	logger.Warn("Handler timed out", "queue", "orders")
+	out := buf.String()
+	if !strings.Contains(out, "level=WARN") || !strings.Contains(out, "queue=orders") {
+		t.Errorf("Log line is wrong. Got %q", out)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	r := &logRecorder{}
+	o := newOptions([]Option{WithLogger(r)})
+	if o.logger != r {
+		t.Error("Logger option was not applied")
+	}
+	if newOptions(nil).logger != defaultLogger {
+		t.Error("Default logger should be used")
+	}
+}
+
+func TestWithNilLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consumer.ini")
+	config := "[connection]\nhost = localhost\n\n[exchange]\nname = app\n\n[queue]\nname = orders\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(path, WithLogger(nil)); err != nil {
+		t.Error(err)
+	}
+	if _, err := CreatePublisher(path, WithLogger(nil)); err != nil {
+		t.Error(err)
+	}
+	if _, err := CreateClient(path, WithLogger(nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlerErrorIsLogged(t *testing.T) {
+	r := &logRecorder{}
+	c := &Consumer{logger: r}
+	msg := newTestMessage(&ackRecorder{}, 4)
+	msg.Exchange = "events"
+	msg.RoutingKey = "order.created"
+	c.handle(queue{name: "orders", requeue: true}, func(ctx context.Context, msg *Message) error {
+		return errors.New("boom")
+	}, true, msg)
+
+	if len(r.lines) != 1 {
+		t.Fatalf("Expected one log line. Got %v", r.lines)
+	}
+	expected := "ERROR Handler failed queue=orders exchange=events routing_key=order.created delivery_tag=4 error=boom requeue=true"
+	if r.lines[0] != expected {
+		t.Errorf("Log line is wrong. Got %q", r.lines[0])
+	}
+}
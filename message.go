@@ -0,0 +1,129 @@
+package consumer
+
+import (
+	"errors"
+	"github.com/streadway/amqp"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Error returned when a message is acked, nacked or rejected more than once.
+*/
+var ErrAlreadySettled = errors.New("Message has already been acked, nacked or rejected.")
+
+/*
+Simple message type so users of this library don't have to import amqp as well
+*/
+type Message struct {
+	amqp.Delivery
+	queue          string
+	settled        int32
+	maxBodySize    int64
+	decodedBody    []byte
+	decodedBodyErr error
+	decodeOnce     sync.Once
+	// The consumer's logger and metrics, for handler middleware.
+	logger  Logger
+	metrics *metrics
+}
+
+func newMessage(q queue, d amqp.Delivery) *Message {
+	return &Message{Delivery: d, queue: q.name, maxBodySize: q.maxDecompressedSize}
+}
+
+/*
+Wrap a delivery from the named queue in a Message.
+
+Useful when building messages for tests. Ack, Nack and Reject are
+sent to the delivery's Acknowledger, so set one to record them.
+*/
+func NewMessage(queue string, d amqp.Delivery) *Message {
+	return &Message{Delivery: d, queue: queue}
+}
+
+/*
+Get the name of the queue the message was consumed from.
+*/
+func (m *Message) Queue() string {
+	return m.queue
+}
+
+/*
+Acknowledge the message.
+
+Returns ErrAlreadySettled if the message was already acked, nacked
+or rejected, for example because its handler timed out.
+*/
+func (m *Message) Ack(multiple bool) error {
+	if !m.settle() {
+		return ErrAlreadySettled
+	}
+	return m.Delivery.Ack(multiple)
+}
+
+/*
+Negatively acknowledge the message.
+*/
+func (m *Message) Nack(multiple, requeue bool) error {
+	if !m.settle() {
+		return ErrAlreadySettled
+	}
+	return m.Delivery.Nack(multiple, requeue)
+}
+
+/*
+Reject the message.
+*/
+func (m *Message) Reject(requeue bool) error {
+	if !m.settle() {
+		return ErrAlreadySettled
+	}
+	return m.Delivery.Reject(requeue)
+}
+
+/*
+Whether the message has been acked, nacked or rejected.
+*/
+func (m *Message) Settled() bool {
+	return atomic.LoadInt32(&m.settled) == 1
+}
+
+func (m *Message) settle() bool {
+	return atomic.CompareAndSwapInt32(&m.settled, 0, 1)
+}
+
+/*
+Get the message body with its ContentEncoding removed.
+
+Compressed bodies are decompressed using the decompressor registered
+for the encoding. Bodies that decompress to more than the queue's
+max_decompressed_size return ErrBodyTooLarge. The result is cached,
+so calling this repeatedly is cheap.
+*/
+func (m *Message) DecodedBody() ([]byte, error) {
+	m.decodeOnce.Do(func() {
+		m.decodedBody, m.decodedBodyErr = decompress(m.ContentEncoding, m.Body, m.maxBodySize)
+	})
+	return m.decodedBody, m.decodedBodyErr
+}
+
+/*
+Decode the message body into v using the codec registered
+for the message's ContentType.
+*/
+func (m *Message) Decode(v interface{}) error {
+	body, err := m.DecodedBody()
+	if err != nil {
+		return &DecodeError{ContentType: m.ContentType, Err: err}
+	}
+	codec, err := CodecFor(m.ContentType)
+	if err != nil {
+		return &DecodeError{ContentType: m.ContentType, Err: err}
+	}
+	err = codec.Unmarshal(body, v)
+	if err != nil {
+		return &DecodeError{ContentType: m.ContentType, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+// Records the calls made by Message's ack methods.
+type ackRecorder struct {
+	acks     []uint64
+	nacks    []uint64
+	rejects  []uint64
+	requeue  bool
+	multiple bool
+}
+
+func (r *ackRecorder) Ack(tag uint64, multiple bool) error {
+	r.acks = append(r.acks, tag)
+	r.multiple = multiple
+	return nil
+}
+
+func (r *ackRecorder) Nack(tag uint64, multiple bool, requeue bool) error {
+	r.nacks = append(r.nacks, tag)
+	r.requeue = requeue
+	r.multiple = multiple
+	return nil
+}
+
+func (r *ackRecorder) Reject(tag uint64, requeue bool) error {
+	r.rejects = append(r.rejects, tag)
+	r.requeue = requeue
+	return nil
+}
+
+func newTestMessage(r *ackRecorder, tag uint64) *Message {
+	return &Message{Delivery: amqp.Delivery{Acknowledger: r, DeliveryTag: tag}}
+}
+
+func TestMessageAck(t *testing.T) {
+	r := &ackRecorder{}
+	msg := newTestMessage(r, 1)
+	if msg.Settled() {
+		t.Error("New messages should not be settled")
+	}
+	if err := msg.Ack(false); err != nil {
+		t.Errorf("Ack should not fail. Got %s", err)
+	}
+	if !msg.Settled() {
+		t.Error("Message should be settled after ack")
+	}
+	if len(r.acks) != 1 || r.acks[0] != 1 {
+		t.Error("Ack was not sent")
+	}
+}
+
+func TestMessageSettleOnlyOnce(t *testing.T) {
+	r := &ackRecorder{}
+	msg := newTestMessage(r, 1)
+	msg.Nack(false, true)
+	if err := msg.Ack(false); err != ErrAlreadySettled {
+		t.Errorf("Second settle should fail. Got %v", err)
+	}
+	if err := msg.Reject(false); err != ErrAlreadySettled {
+		t.Errorf("Second settle should fail. Got %v", err)
+	}
+	if len(r.acks) != 0 || len(r.rejects) != 0 || len(r.nacks) != 1 {
+		t.Error("Only the first settle should reach the acknowledger")
+	}
+}
+
+func TestMessageQueue(t *testing.T) {
+	msg := newMessage(queue{name: "orders"}, amqp.Delivery{})
+	if msg.Queue() != "orders" {
+		t.Errorf("Wrong queue %q", msg.Queue())
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	r := &ackRecorder{}
+	msg := NewMessage("orders", amqp.Delivery{Acknowledger: r, DeliveryTag: 3})
+	if msg.Queue() != "orders" {
+		t.Errorf("Wrong queue %s", msg.Queue())
+	}
+	msg.Reject(true)
+	if len(r.rejects) != 1 || r.rejects[0] != 3 || !r.requeue {
+		t.Error("Reject should use the delivery's acknowledger")
+	}
+}
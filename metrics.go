@@ -0,0 +1,247 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Upper bounds, in seconds, of the handler duration histogram buckets.
+*/
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	metricReceived       = "consumer_messages_received_total"
+	metricAcked          = "consumer_messages_acked_total"
+	metricNacked         = "consumer_messages_nacked_total"
+	metricRejected       = "consumer_messages_rejected_total"
+	metricRedelivered    = "consumer_messages_redelivered_total"
+	metricDecodeFailures = "consumer_decode_failures_total"
+	metricInFlight       = "consumer_messages_in_flight"
+	metricDuration       = "consumer_handler_duration_seconds"
+	metricReconnects     = "consumer_reconnects_total"
+	metricBreakerState   = "consumer_breaker_state"
+	metricDedupFailures  = "consumer_dedup_record_failures_total"
+)
+
+var metricHelp = []struct {
+	name string
+	kind string
+	help string
+}{
+	{metricReceived, "counter", "Messages delivered to the consumer."},
+	{metricAcked, "counter", "Messages acked."},
+	{metricNacked, "counter", "Messages nacked."},
+	{metricRejected, "counter", "Messages rejected."},
+	{metricRedelivered, "counter", "Messages delivered with the redelivered flag set."},
+	{metricDecodeFailures, "counter", "Messages that could not be decoded."},
+	{metricInFlight, "gauge", "Messages currently being handled."},
+	{metricDuration, "histogram", "Time spent in message handlers."},
+	{metricReconnects, "counter", "Times the consumer reconnected to the broker."},
+	{metricBreakerState, "gauge", "Circuit breaker state. 0 is closed, 1 is open and 2 is half-open."},
+	{metricDedupFailures, "counter", "Handled messages the dedup store failed to record."},
+}
+
+/*
+Records consumer activity and renders it in the Prometheus text format.
+
+All methods are safe to call on a nil *metrics, which
+is what consumers without a [metrics] section use.
+*/
+type metrics struct {
+	mu         sync.Mutex
+	values     map[string]map[string]float64
+	durations  map[string]*histogram
+	reconnects float64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		values:    make(map[string]map[string]float64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+func (m *metrics) add(name, queue string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][queue] += delta
+}
+
+/*
+Record a delivery arriving and return it with an
+acknowledger that counts acks, nacks and rejects.
+*/
+func (m *metrics) received(queue string, d amqp.Delivery) amqp.Delivery {
+	if m == nil {
+		return d
+	}
+	m.add(metricReceived, queue, 1)
+	if d.Redelivered {
+		m.add(metricRedelivered, queue, 1)
+	}
+	d.Acknowledger = &countingAcknowledger{d.Acknowledger, m, queue}
+	return d
+}
+
+func (m *metrics) handlerStarted(queue string) {
+	m.add(metricInFlight, queue, 1)
+}
+
+func (m *metrics) handlerFinished(queue string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.add(metricInFlight, queue, -1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.durations[queue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(DurationBuckets))}
+		m.durations[queue] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range DurationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *metrics) decodeFailed(queue string) {
+	m.add(metricDecodeFailures, queue, 1)
+}
+
+func (m *metrics) dedupFailed(queue string) {
+	m.add(metricDedupFailures, queue, 1)
+}
+
+func (m *metrics) breakerState(queue string, state BreakerState) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[metricBreakerState] == nil {
+		m.values[metricBreakerState] = make(map[string]float64)
+	}
+	m.values[metricBreakerState][queue] = float64(state)
+}
+
+func (m *metrics) reconnected() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconnects++
+}
+
+/*
+Write all metrics in the Prometheus text exposition format.
+*/
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	for _, meta := range metricHelp {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", meta.name, meta.help, meta.name, meta.kind)
+		switch meta.name {
+		case metricReconnects:
+			fmt.Fprintf(cw, "%s %v\n", meta.name, m.reconnects)
+		case metricDuration:
+			for _, queue := range sortedKeys(m.durations) {
+				h := m.durations[queue]
+				for i, bound := range DurationBuckets {
+					fmt.Fprintf(cw, "%s_bucket{queue=%q,le=\"%v\"} %d\n", meta.name, queue, bound, h.counts[i])
+				}
+				fmt.Fprintf(cw, "%s_bucket{queue=%q,le=\"+Inf\"} %d\n", meta.name, queue, h.count)
+				fmt.Fprintf(cw, "%s_sum{queue=%q} %v\n", meta.name, queue, h.sum)
+				fmt.Fprintf(cw, "%s_count{queue=%q} %d\n", meta.name, queue, h.count)
+			}
+		default:
+			values := m.values[meta.name]
+			for _, queue := range sortedKeys(values) {
+				fmt.Fprintf(cw, "%s{queue=%q} %v\n", meta.name, queue, values[queue])
+			}
+		}
+	}
+	return cw.n, cw.err
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+/*
+Counts acks, nacks and rejects before passing them on. A multiple
+ack or nack counts as one, as the acknowledger can't tell how many
+deliveries it covers.
+*/
+type countingAcknowledger struct {
+	amqp.Acknowledger
+	metrics *metrics
+	queue   string
+}
+
+func (a *countingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.metrics.add(metricAcked, a.queue, 1)
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *countingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.metrics.add(metricNacked, a.queue, 1)
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *countingAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.metrics.add(metricRejected, a.queue, 1)
+	return a.Acknowledger.Reject(tag, requeue)
+}
@@ -0,0 +1,82 @@
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsNilIsSafe(t *testing.T) {
+	var m *metrics
+	d := m.received("test", amqp.Delivery{})
+	if d.Acknowledger != nil {
+		t.Error("Nil metrics should not wrap deliveries")
+	}
+	m.handlerStarted("test")
+	m.handlerFinished("test", time.Second)
+	m.decodeFailed("test")
+	m.dedupFailed("test")
+	m.reconnected()
+}
+
+func TestMetricsCountsOutcomes(t *testing.T) {
+	m := newMetrics()
+	r := &ackRecorder{}
+	q := queue{name: "orders", requeue: true}
+	c := &Consumer{metrics: m, logger: NopLogger()}
+
+	ok := newMessage(q, m.received("orders", amqp.Delivery{Acknowledger: r, DeliveryTag: 1}))
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		return nil
+	}, true, ok)
+	failed := newMessage(q, m.received("orders", amqp.Delivery{Acknowledger: r, DeliveryTag: 2, Redelivered: true}))
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		return errors.New("boom")
+	}, true, failed)
+
+	if len(r.acks) != 1 || len(r.nacks) != 1 {
+		t.Error("Acks and nacks should reach the real acknowledger")
+	}
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`consumer_messages_received_total{queue="orders"} 2`,
+		`consumer_messages_acked_total{queue="orders"} 1`,
+		`consumer_messages_nacked_total{queue="orders"} 1`,
+		`consumer_messages_redelivered_total{queue="orders"} 1`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Missing %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newMetrics()
+	m.handlerStarted("orders")
+	m.handlerFinished("orders", 30*time.Millisecond)
+	m.reconnected()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE consumer_handler_duration_seconds histogram",
+		`consumer_handler_duration_seconds_bucket{queue="orders",le="0.025"} 0`,
+		`consumer_handler_duration_seconds_bucket{queue="orders",le="0.05"} 1`,
+		`consumer_handler_duration_seconds_bucket{queue="orders",le="+Inf"} 1`,
+		`consumer_handler_duration_seconds_count{queue="orders"} 1`,
+		`consumer_messages_in_flight{queue="orders"} 0`,
+		"consumer_reconnects_total 1",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Missing %q in output:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,932 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Encodes and decodes MessagePack bodies with reflection, so a
+msgpack library isn't a dependency of this package.
+
+Structs are written as maps keyed by field name. Names can be
+changed with a `msgpack` struct tag, falling back to the `json`
+tag, and both support "-" and omitempty. time.Time values use
+the timestamp extension type. Decoding into an interface{}
+produces nil, bool, int64, uint64 (for values above
+math.MaxInt64), float64, string, []byte, []interface{},
+map[string]interface{} (or map[interface{}]interface{} when a
+key isn't a string) and time.Time values.
+*/
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Cannot decode msgpack into %T, a non-nil pointer is required.", v)
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("Unexpected data after msgpack value at offset %d.", d.pos)
+	}
+	return nil
+}
+
+const msgpackTimestamp = -1
+
+var timeType = reflect.TypeOf(time.Time{})
+
+type msgpackEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf.WriteByte(0xc0)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf.WriteByte(0xc3)
+		} else {
+			e.buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf.WriteByte(0xca)
+		e.write(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.buf.WriteByte(0xcb)
+		e.write(math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.encodeBytes(b)
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf.WriteByte(0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("Cannot encode %s as msgpack.", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) write(n uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		e.buf.WriteByte(byte(n >> (8 * uint(i))))
+	}
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.buf.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		e.buf.WriteByte(0xd0)
+		e.write(uint64(n), 1)
+	case n >= math.MinInt16:
+		e.buf.WriteByte(0xd1)
+		e.write(uint64(n), 2)
+	case n >= math.MinInt32:
+		e.buf.WriteByte(0xd2)
+		e.write(uint64(n), 4)
+	default:
+		e.buf.WriteByte(0xd3)
+		e.write(uint64(n), 8)
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		e.buf.WriteByte(0xcc)
+		e.write(n, 1)
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(0xcd)
+		e.write(n, 2)
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(0xce)
+		e.write(n, 4)
+	default:
+		e.buf.WriteByte(0xcf)
+		e.write(n, 8)
+	}
+}
+
+/*
+Write a length prefix, using the fix format when the
+length fits in its bits, then 8, 16 or 32 bit formats.
+*/
+func (e *msgpackEncoder) encodeLength(n int, fix byte, fixMax int, formats [3]byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		e.buf.WriteByte(fix | byte(n))
+	case formats[0] != 0 && n <= math.MaxUint8:
+		e.buf.WriteByte(formats[0])
+		e.write(uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.buf.WriteByte(formats[1])
+		e.write(uint64(n), 2)
+	default:
+		e.buf.WriteByte(formats[2])
+		e.write(uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	e.encodeLength(len(s), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb})
+	e.buf.WriteString(s)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	e.encodeLength(len(b), 0, 0, [3]byte{0xc4, 0xc5, 0xc6})
+	e.buf.Write(b)
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	e.encodeLength(v.Len(), 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	// Sort the encoded entries so the same map always encodes the same way.
+	type entry struct {
+		key, value []byte
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var k, val msgpackEncoder
+		if err := k.encode(iter.Key()); err != nil {
+			return err
+		}
+		if err := val.encode(iter.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{k.buf.Bytes(), val.buf.Bytes()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	e.encodeLength(len(entries), 0x80, 15, [3]byte{0, 0xde, 0xdf})
+	for _, en := range entries {
+		e.buf.Write(en.key)
+		e.buf.Write(en.value)
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	fields := msgpackFields(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && fv.IsZero()) {
+			continue
+		}
+		values = append(values, fv)
+		names = append(names, f.name)
+	}
+	e.encodeLength(len(values), 0x80, 15, [3]byte{0, 0xde, 0xdf})
+	for i, fv := range values {
+		e.encodeString(names[i])
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case nsec == 0 && sec >= 0 && sec <= math.MaxUint32:
+		e.buf.Write([]byte{0xd6, 0xff})
+		e.write(uint64(sec), 4)
+	case sec >= 0 && sec < 1<<34:
+		e.buf.Write([]byte{0xd7, 0xff})
+		e.write(nsec<<34|uint64(sec), 8)
+	default:
+		e.buf.Write([]byte{0xc7, 12, 0xff})
+		e.write(nsec, 4)
+		e.write(uint64(sec), 8)
+	}
+}
+
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+/*
+List the exported fields of a struct type, including fields
+promoted from embedded structs. When names collide the least
+nested field wins.
+*/
+func msgpackFields(t reflect.Type) []msgpackField {
+	var fields []msgpackField
+	byName := map[string]int{}
+	for _, f := range reflect.VisibleFields(t) {
+		tag, ok := f.Tag.Lookup("msgpack")
+		if !ok {
+			tag = f.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				// Its fields are listed on their own.
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		field := msgpackField{
+			name:      name,
+			index:     f.Index,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		}
+		if i, ok := byName[name]; ok {
+			if len(f.Index) < len(fields[i].index) {
+				fields[i] = field
+			}
+			continue
+		}
+		byName[name] = len(fields)
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+/*
+Get a possibly promoted field, reporting false when
+it's reached through a nil embedded pointer.
+*/
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+/*
+Limits that stop hostile bodies from exhausting memory or the
+stack. Lengths come from the data, so collections only preallocate
+up to msgpackMaxPrealloc items and grow as items are read.
+*/
+const (
+	msgpackMaxDepth    = 100
+	msgpackMaxPrealloc = 1024
+)
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *msgpackDecoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid msgpack at offset %d: %s", d.pos, fmt.Sprintf(format, args...))
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, d.errorf("unexpected end of data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+/*
+Get the capacity to preallocate for a collection of length items.
+Every item takes at least one byte, so it is capped by the bytes
+left as well as msgpackMaxPrealloc.
+*/
+func (d *msgpackDecoder) capacity(length int) int {
+	if left := len(d.data) - d.pos; length > left {
+		length = left
+	}
+	if length > msgpackMaxPrealloc {
+		length = msgpackMaxPrealloc
+	}
+	return length
+}
+
+/*
+Descend into an array or map. Callers undo this with leave
+once the collection has been read.
+*/
+func (d *msgpackDecoder) enter() error {
+	if d.depth >= msgpackMaxDepth {
+		return d.errorf("nesting is deeper than %d levels", msgpackMaxDepth)
+	}
+	d.depth++
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, d.errorf("unexpected end of data")
+	}
+	return d.data[d.pos], nil
+}
+
+/*
+The kinds of value a msgpack type byte introduces.
+*/
+type msgpackKind int
+
+const (
+	mpNil msgpackKind = iota
+	mpBool
+	mpInt
+	mpUint
+	mpFloat
+	mpString
+	mpBinary
+	mpArray
+	mpMap
+	mpExt
+)
+
+/*
+A decoded value header. Scalars are decoded fully, while
+strings, binaries, arrays, maps and extensions carry their
+length and are read by the caller.
+*/
+type msgpackHeader struct {
+	kind    msgpackKind
+	b       bool
+	i       int64
+	u       uint64
+	f       float64
+	length  int
+	extType int8
+}
+
+func (d *msgpackDecoder) header() (h msgpackHeader, err error) {
+	c, err := d.peek()
+	if err != nil {
+		return h, err
+	}
+	d.pos++
+	switch {
+	case c <= 0x7f:
+		return msgpackHeader{kind: mpUint, u: uint64(c)}, nil
+	case c >= 0xe0:
+		return msgpackHeader{kind: mpInt, i: int64(int8(c))}, nil
+	case c&0xf0 == 0x80:
+		return msgpackHeader{kind: mpMap, length: int(c & 0x0f)}, nil
+	case c&0xf0 == 0x90:
+		return msgpackHeader{kind: mpArray, length: int(c & 0x0f)}, nil
+	case c&0xe0 == 0xa0:
+		return msgpackHeader{kind: mpString, length: int(c & 0x1f)}, nil
+	}
+
+	lengthOf := func(kind msgpackKind, size int) (msgpackHeader, error) {
+		n, err := d.readUint(size)
+		if err != nil {
+			return h, err
+		}
+		if n > uint64(len(d.data)-d.pos) {
+			return h, d.errorf("length %d is larger than the data", n)
+		}
+		return msgpackHeader{kind: kind, length: int(n)}, nil
+	}
+	extOf := func(length int) (msgpackHeader, error) {
+		t, err := d.readUint(1)
+		return msgpackHeader{kind: mpExt, length: length, extType: int8(t)}, err
+	}
+
+	switch c {
+	case 0xc0:
+		return msgpackHeader{kind: mpNil}, nil
+	case 0xc2, 0xc3:
+		return msgpackHeader{kind: mpBool, b: c == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6:
+		return lengthOf(mpBinary, 1<<(c-0xc4))
+	case 0xc7, 0xc8, 0xc9:
+		h, err := lengthOf(mpExt, 1<<(c-0xc7))
+		if err != nil {
+			return h, err
+		}
+		return extOf(h.length)
+	case 0xca:
+		n, err := d.readUint(4)
+		return msgpackHeader{kind: mpFloat, f: float64(math.Float32frombits(uint32(n)))}, err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return msgpackHeader{kind: mpFloat, f: math.Float64frombits(n)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.readUint(1 << (c - 0xcc))
+		return msgpackHeader{kind: mpUint, u: n}, err
+	case 0xd0:
+		n, err := d.readUint(1)
+		return msgpackHeader{kind: mpInt, i: int64(int8(n))}, err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return msgpackHeader{kind: mpInt, i: int64(int16(n))}, err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return msgpackHeader{kind: mpInt, i: int64(int32(n))}, err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return msgpackHeader{kind: mpInt, i: int64(n)}, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return extOf(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		return lengthOf(mpString, 1<<(c-0xd9))
+	case 0xdc, 0xdd:
+		return lengthOf(mpArray, 2<<(c-0xdc))
+	case 0xde, 0xdf:
+		return lengthOf(mpMap, 2<<(c-0xde))
+	}
+	d.pos--
+	return h, d.errorf("unknown type byte 0x%x", c)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if c, err := d.peek(); err == nil && c == 0xc0 {
+			d.pos++
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		val, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(val))
+		}
+		return nil
+	}
+
+	start := d.pos
+	h, err := d.header()
+	if err != nil {
+		return err
+	}
+	mismatch := func() error {
+		d.pos = start
+		return d.errorf("cannot decode %s into %s", h.kind, v.Type())
+	}
+	if h.kind == mpNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Type() == timeType {
+		if h.kind != mpExt || h.extType != msgpackTimestamp {
+			return mismatch()
+		}
+		t, err := d.readTime(h.length)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch h.kind {
+	case mpBool:
+		if v.Kind() != reflect.Bool {
+			return mismatch()
+		}
+		v.SetBool(h.b)
+	case mpInt, mpUint:
+		return d.setInteger(v, h, mismatch)
+	case mpFloat:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(h.f)
+		default:
+			return mismatch()
+		}
+	case mpString, mpBinary:
+		b, err := d.read(h.length)
+		if err != nil {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), b...))
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			if len(b) != v.Len() {
+				return mismatch()
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+		default:
+			return mismatch()
+		}
+	case mpArray:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		switch v.Kind() {
+		case reflect.Slice:
+			s := reflect.MakeSlice(v.Type(), 0, d.capacity(h.length))
+			for i := 0; i < h.length; i++ {
+				item := reflect.New(v.Type().Elem()).Elem()
+				if err := d.decode(item); err != nil {
+					return err
+				}
+				s = reflect.Append(s, item)
+			}
+			v.Set(s)
+		case reflect.Array:
+			if h.length != v.Len() {
+				return mismatch()
+			}
+			for i := 0; i < h.length; i++ {
+				if err := d.decode(v.Index(i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return mismatch()
+		}
+	case mpMap:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(v, h.length)
+		case reflect.Struct:
+			return d.decodeStruct(v, h.length)
+		default:
+			return mismatch()
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) setInteger(v reflect.Value, h msgpackHeader, mismatch func() error) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := h.i
+		if h.kind == mpUint {
+			if h.u > math.MaxInt64 {
+				return mismatch()
+			}
+			n = int64(h.u)
+		}
+		if v.OverflowInt(n) {
+			return mismatch()
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := h.u
+		if h.kind == mpInt {
+			if h.i < 0 {
+				return mismatch()
+			}
+			n = uint64(h.i)
+		}
+		if v.OverflowUint(n) {
+			return mismatch()
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if h.kind == mpInt {
+			v.SetFloat(float64(h.i))
+		} else {
+			v.SetFloat(float64(h.u))
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeMap(v reflect.Value, length int) error {
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, d.capacity(length)))
+	}
+	for i := 0; i < length; i++ {
+		key := reflect.New(t.Key()).Elem()
+		if err := d.decode(key); err != nil {
+			return err
+		}
+		val := reflect.New(t.Elem()).Elem()
+		if err := d.decode(val); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, val)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeStruct(v reflect.Value, length int) error {
+	fields := msgpackFields(v.Type())
+	for i := 0; i < length; i++ {
+		var name string
+		if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+		f, ok := findField(fields, name)
+		if !ok {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		fv := v
+		for j, x := range f.index {
+			if j > 0 && fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(x)
+		}
+		if err := d.decode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Match a key to a field exactly, or case insensitively
+like encoding/json does.
+*/
+func findField(fields []msgpackField, name string) (msgpackField, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return msgpackField{}, false
+}
+
+func (d *msgpackDecoder) decodeAny() (interface{}, error) {
+	h, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	switch h.kind {
+	case mpNil:
+		return nil, nil
+	case mpBool:
+		return h.b, nil
+	case mpInt:
+		return h.i, nil
+	case mpUint:
+		if h.u > math.MaxInt64 {
+			return h.u, nil
+		}
+		return int64(h.u), nil
+	case mpFloat:
+		return h.f, nil
+	case mpString:
+		b, err := d.read(h.length)
+		return string(b), err
+	case mpBinary:
+		b, err := d.read(h.length)
+		return append([]byte(nil), b...), err
+	case mpArray:
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		s := make([]interface{}, 0, d.capacity(h.length))
+		for i := 0; i < h.length; i++ {
+			item, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, item)
+		}
+		return s, nil
+	case mpMap:
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		keys := make([]interface{}, 0, d.capacity(h.length))
+		values := make([]interface{}, 0, d.capacity(h.length))
+		stringKeys := true
+		for i := 0; i < h.length; i++ {
+			key, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := key.(string); !ok {
+				stringKeys = false
+			}
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+		if stringKeys {
+			m := make(map[string]interface{}, len(keys))
+			for i, k := range keys {
+				m[k.(string)] = values[i]
+			}
+			return m, nil
+		}
+		m := make(map[interface{}]interface{}, len(keys))
+		for i, k := range keys {
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, d.errorf("map key of type %T is not supported", k)
+			}
+			m[k] = values[i]
+		}
+		return m, nil
+	case mpExt:
+		if h.extType != msgpackTimestamp {
+			return nil, d.errorf("unsupported extension type %d", h.extType)
+		}
+		return d.readTime(h.length)
+	}
+	return nil, d.errorf("unexpected %s", h.kind)
+}
+
+func (d *msgpackDecoder) readTime(length int) (time.Time, error) {
+	b, err := d.read(length)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch length {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+	case 8:
+		n := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(n&(1<<34-1)), int64(n>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(binary.BigEndian.Uint32(b))), nil
+	}
+	return time.Time{}, d.errorf("invalid timestamp length %d", length)
+}
+
+/*
+Skip over the next value, used for unknown struct fields.
+*/
+func (d *msgpackDecoder) skip() error {
+	h, err := d.header()
+	if err != nil {
+		return err
+	}
+	if h.kind == mpArray || h.kind == mpMap {
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+	}
+	switch h.kind {
+	case mpString, mpBinary, mpExt:
+		_, err = d.read(h.length)
+	case mpArray:
+		for i := 0; i < h.length && err == nil; i++ {
+			err = d.skip()
+		}
+	case mpMap:
+		for i := 0; i < 2*h.length && err == nil; i++ {
+			err = d.skip()
+		}
+	}
+	return err
+}
+
+func (k msgpackKind) String() string {
+	switch k {
+	case mpNil:
+		return "nil"
+	case mpBool:
+		return "bool"
+	case mpInt, mpUint:
+		return "integer"
+	case mpFloat:
+		return "float"
+	case mpString:
+		return "string"
+	case mpBinary:
+		return "binary"
+	case mpArray:
+		return "array"
+	case mpMap:
+		return "map"
+	}
+	return "extension"
+}
@@ -0,0 +1,211 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackEncoding(t *testing.T) {
+	// The example from msgpack.org.
+	v := struct {
+		Compact bool `msgpack:"compact"`
+		Schema  int  `msgpack:"schema"`
+	}{true, 0}
+	out, err := msgpackCodec{}.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("\x82\xa7compact\xc3\xa6schema\x00")
+	if !bytes.Equal(out, want) {
+		t.Errorf("Wrong encoding %x", out)
+	}
+}
+
+func TestMsgpackIntegers(t *testing.T) {
+	cases := []struct {
+		n    int64
+		want string
+	}{
+		{0, "00"},
+		{127, "7f"},
+		{128, "cc80"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0df"},
+		{256, "cd0100"},
+		{-129, "d1ff7f"},
+		{1 << 16, "ce00010000"},
+		{math.MinInt64, "d38000000000000000"},
+	}
+	for _, tc := range cases {
+		out, _ := msgpackCodec{}.Marshal(tc.n)
+		if hex.EncodeToString(out) != tc.want {
+			t.Errorf("%d encoded as %x, want %s", tc.n, out, tc.want)
+		}
+		var n int64
+		if err := (msgpackCodec{}).Unmarshal(out, &n); err != nil || n != tc.n {
+			t.Errorf("%d decoded as %d: %v", tc.n, n, err)
+		}
+	}
+}
+
+type msgpackBase struct {
+	Id      int
+	Ignored string `msgpack:"-"`
+}
+
+type msgpackOrder struct {
+	msgpackBase
+	Customer string            `json:"customer"`
+	Total    float64           `msgpack:"total"`
+	Count    uint8             `msgpack:"count"`
+	Tags     []string          `msgpack:"tags"`
+	Lines    map[string]int    `msgpack:"lines"`
+	Raw      []byte            `msgpack:"raw"`
+	Note     *string           `msgpack:"note"`
+	Empty    string            `msgpack:"empty,omitempty"`
+	Created  time.Time         `msgpack:"created"`
+	Meta     map[string]string `msgpack:"meta"`
+	Extra    interface{}       `msgpack:"extra"`
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	note := "leave at the door"
+	in := msgpackOrder{
+		msgpackBase: msgpackBase{Id: 42, Ignored: "secret"},
+		Customer:    strings.Repeat("c", 300),
+		Total:       -12.5,
+		Count:       200,
+		Tags:        []string{"new", "gift"},
+		Lines:       map[string]int{"widget": 3, "gadget": -70000},
+		Raw:         []byte{0, 1, 0xff},
+		Note:        &note,
+		Created:     time.Unix(1700000000, 123456789),
+		Extra:       []interface{}{int64(1), "two"},
+	}
+	out, err := msgpackCodec{}.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got msgpackOrder
+	if err := (msgpackCodec{}).Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Ignored != "" {
+		t.Error("Fields tagged - should be skipped")
+	}
+	in.Ignored = ""
+	if !got.Created.Equal(in.Created) {
+		t.Errorf("Time is wrong, got %v", got.Created)
+	}
+	got.Created = in.Created
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("Round trip is wrong.\ngot  %#v\nwant %#v", got, in)
+	}
+
+	var generic map[string]interface{}
+	if err := (msgpackCodec{}).Unmarshal(out, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic["Id"] != int64(42) || generic["customer"] != in.Customer || generic["total"] != -12.5 {
+		t.Errorf("Generic decode is wrong: %v", generic)
+	}
+	if _, ok := generic["empty"]; ok {
+		t.Error("Empty omitempty fields should be left out")
+	}
+	if !bytes.Equal(generic["raw"].([]byte), in.Raw) || generic["meta"] != nil {
+		t.Errorf("Binary and nil values are wrong: %#v %#v", generic["raw"], generic["meta"])
+	}
+}
+
+func TestMsgpackTimestamps(t *testing.T) {
+	for _, ts := range []time.Time{
+		time.Unix(1700000000, 0),
+		time.Unix(1700000000, 1),
+		time.Unix(-1, 500),
+		time.Unix(1<<35, 0),
+	} {
+		out, _ := msgpackCodec{}.Marshal(ts)
+		var got time.Time
+		if err := (msgpackCodec{}).Unmarshal(out, &got); err != nil || !got.Equal(ts) {
+			t.Errorf("%v decoded as %v: %v", ts, got, err)
+		}
+	}
+}
+
+func TestMsgpackDecodeErrors(t *testing.T) {
+	var n int8
+	var s string
+	var v struct{ Name string }
+	cases := []struct {
+		data   string
+		target interface{}
+	}{
+		{"\xcd\x01\x00", &n},         // 256 overflows int8
+		{"\xa3ab", &s},               // truncated string
+		{"\x01\x02", &n},             // trailing data
+		{"\xc3", &s},                 // bool into string
+		{"\xdd\xff\xff\xff\xff", &v}, // huge array length
+		{"\xc1", &s},                 // reserved type byte
+		{"\x81\xa4Name\x01", &v},     // int into string field
+		{"\x01", n},                  // not a pointer
+	}
+	for _, tc := range cases {
+		if err := (msgpackCodec{}).Unmarshal([]byte(tc.data), tc.target); err == nil {
+			t.Errorf("%x should fail to decode into %T", tc.data, tc.target)
+		}
+	}
+}
+
+func TestMsgpackDecodeHostileNesting(t *testing.T) {
+	// About 100KB of array32 headers, each claiming 65536 items.
+	data := bytes.Repeat([]byte("\xdd\x00\x01\x00\x00"), 20000)
+	// An unknown struct field holding the same arrays is skipped.
+	field := append([]byte("\x81\xa5other"), data...)
+	cases := []struct {
+		data   []byte
+		target interface{}
+	}{
+		{data, new(interface{})},
+		{data, new([][]interface{})},
+		{field, new(struct{ Name string })},
+	}
+	for _, tc := range cases {
+		err := (msgpackCodec{}).Unmarshal(tc.data, tc.target)
+		if err == nil || !strings.Contains(err.Error(), "nesting is deeper") {
+			t.Errorf("Deep nesting should fail to decode into %T, got %v", tc.target, err)
+		}
+	}
+
+	msg := &Message{}
+	msg.ContentType = "application/msgpack"
+	msg.Body = data
+	var decodeErr *DecodeError
+	if err := msg.Decode(new(interface{})); !errors.As(err, &decodeErr) {
+		t.Errorf("Deep nesting should be a DecodeError, got %v", err)
+	}
+}
+
+func TestMsgpackSkipsUnknownFields(t *testing.T) {
+	var v struct{ Name string }
+	data := "\x83\xa5other\x92\x01\x81\xa1k\xa1v\xa4name\xa3bob\xa3bin\xc4\x02ab"
+	if err := (msgpackCodec{}).Unmarshal([]byte(data), &v); err != nil || v.Name != "bob" {
+		t.Errorf("Unknown fields should be skipped, got %q %v", v.Name, err)
+	}
+}
+
+func TestMessageDecodeMsgpack(t *testing.T) {
+	msg := &Message{}
+	msg.ContentType = "application/msgpack"
+	msg.Body = []byte("\x81\xa2id\x03")
+	var v struct{ Id int }
+	if err := msg.Decode(&v); err != nil || v.Id != 3 {
+		t.Errorf("Body was not decoded, got %d %v", v.Id, err)
+	}
+}
@@ -0,0 +1,127 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"github.com/streadway/amqp"
+	"hash/fnv"
+	"sync"
+)
+
+/*
+Extracts the ordering key from a message.
+
+Messages with the same key are handled one at a time, in the
+order they arrived.
+*/
+type KeyFunc func(msg *Message) string
+
+/*
+Build a KeyFunc that reads a header.
+
+Messages without the header all share the empty key.
+*/
+func HeaderKey(header string) KeyFunc {
+	return func(msg *Message) string {
+		value, ok := msg.Headers[header]
+		if !ok || value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+}
+
+/*
+Set the function used to pick the partition for messages on a queue.
+
+Overrides the queue's partition_key option. Must be called
+before consuming starts.
+*/
+func (c *Consumer) SetPartitionKey(queueName string, fn KeyFunc) error {
+	if _, err := c.findQueue(queueName); err != nil {
+		return err
+	}
+	if c.keyFuncs == nil {
+		c.keyFuncs = make(map[string]KeyFunc)
+	}
+	c.keyFuncs[queueName] = fn
+	return nil
+}
+
+/*
+Get the key function for a queue, or nil when the queue
+has neither a partition_key nor a SetPartitionKey function.
+*/
+func (c *Consumer) keyFunc(q queue) KeyFunc {
+	if fn, ok := c.keyFuncs[q.name]; ok {
+		return fn
+	}
+	if q.partitionKey == "" {
+		return nil
+	}
+	return HeaderKey(q.partitionKey)
+}
+
+/*
+How many messages can wait on a lane before a busy
+lane holds up deliveries for the others.
+*/
+const laneBuffer = 16
+
+/*
+Pick the lane for a key.
+*/
+func partition(key string, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(lanes))
+}
+
+/*
+Spread deliveries over serial lanes by key - run inside a separate goroutine
+
+Each lane handles its messages in arrival order, while lanes run in
+parallel. Messages are acked individually, so lanes finishing out of
+order never ack each other's messages.
+
+Without a key function there is no order to keep, so messages
+are handed to the lanes in turn rather than all sharing one.
+
+When a paused queue is resumed, the new lanes start once the old
+ones have finished, so a key's messages stay in order.
+*/
+func (c *Consumer) processPartitioned(q queue, handler Handler, autoAck bool, messages <-chan amqp.Delivery) {
+	limiter := c.limiters[q.name]
+	keyFunc := c.keyFunc(q)
+
+	var wg sync.WaitGroup
+	lanes := make([]chan *Message, q.partitions)
+	for i := range lanes {
+		lanes[i] = make(chan *Message, laneBuffer)
+		wg.Add(1)
+		go func(lane <-chan *Message) {
+			defer wg.Done()
+			for msg := range lane {
+				err := c.run(q, handler, autoAck, msg)
+				c.observe(q, err)
+			}
+		}(lanes[i])
+	}
+
+	next := 0
+	for rawMsg := range messages {
+		limiter.wait(context.Background())
+		msg := c.receive(q, rawMsg)
+		lane := next % len(lanes)
+		if keyFunc != nil {
+			lane = partition(keyFunc(msg), len(lanes))
+		}
+		next++
+		lanes[lane] <- msg
+	}
+	for _, lane := range lanes {
+		close(lane)
+	}
+	wg.Wait()
+	c.stopped(q, messages)
+}
@@ -0,0 +1,126 @@
+package consumer
+
+import (
+	"context"
+	"github.com/streadway/amqp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeaderKey(t *testing.T) {
+	key := HeaderKey("customer_id")
+	msg := &Message{}
+	if key(msg) != "" {
+		t.Error("Missing headers should use the empty key")
+	}
+	msg.Headers = amqp.Table{"customer_id": int32(42)}
+	if key(msg) != "42" {
+		t.Errorf("Key is wrong. Got %q", key(msg))
+	}
+}
+
+func TestPartitionIsStable(t *testing.T) {
+	for _, key := range []string{"", "a", "customer-1", "customer-2"} {
+		lane := partition(key, 8)
+		if lane < 0 || lane >= 8 {
+			t.Errorf("Lane out of range for %q", key)
+		}
+		if partition(key, 8) != lane {
+			t.Errorf("Lane should be stable for %q", key)
+		}
+	}
+}
+
+func TestSetPartitionKey(t *testing.T) {
+	c := newStatusConsumer()
+	if err := c.SetPartitionKey("nope", nil); err == nil {
+		t.Error("Should fail on unknown queues")
+	}
+	c.SetPartitionKey("back-events", func(msg *Message) string {
+		return msg.RoutingKey
+	})
+	q := c.topology.Bindings()[0].Queue()
+	msg := &Message{}
+	msg.RoutingKey = "order.created"
+	if c.keyFunc(q)(msg) != "order.created" {
+		t.Error("Custom key function should be used")
+	}
+}
+
+func TestProcessPartitionedKeepsOrderPerKey(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	q := queue{name: "orders", partitions: 4, partitionKey: "customer"}
+
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	handler := func(ctx context.Context, msg *Message) error {
+		seq, _ := strconv.Atoi(string(msg.Body))
+		// Earlier messages take longer, so lanes finish out of order.
+		time.Sleep(time.Duration(10-seq%10) * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		key := msg.Headers["customer"].(string)
+		seen[key] = append(seen[key], seq)
+		return nil
+	}
+
+	messages := make(chan amqp.Delivery, 30)
+	for i := 0; i < 30; i++ {
+		messages <- amqp.Delivery{
+			Acknowledger: r,
+			DeliveryTag:  uint64(i + 1),
+			Headers:      amqp.Table{"customer": "c" + strconv.Itoa(i%3)},
+			Body:         []byte(strconv.Itoa(i)),
+		}
+	}
+	close(messages)
+	c.processPartitioned(q, handler, false, messages)
+
+	for key, seqs := range seen {
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] < seqs[i-1] {
+				t.Errorf("Messages for %s were handled out of order: %v", key, seqs)
+				break
+			}
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("Every key should be handled. Got %v", seen)
+	}
+}
+
+func TestProcessPartitionedWithoutKey(t *testing.T) {
+	r := &ackRecorder{}
+	c := &Consumer{logger: NopLogger()}
+	q := queue{name: "orders", partitions: 4}
+
+	var mu sync.Mutex
+	var active, most int
+	handler := func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		active++
+		if active > most {
+			most = active
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+
+	messages := make(chan amqp.Delivery, 8)
+	for i := 0; i < 8; i++ {
+		messages <- amqp.Delivery{Acknowledger: r, DeliveryTag: uint64(i + 1)}
+	}
+	close(messages)
+	c.processPartitioned(q, handler, false, messages)
+
+	if most != 4 {
+		t.Errorf("Messages without a key should use every lane. At most %d ran at once", most)
+	}
+}
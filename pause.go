@@ -0,0 +1,203 @@
+package consumer
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"net/http"
+	"strings"
+)
+
+/*
+Returned by Pause and Resume before Consume has been called.
+*/
+var ErrNotConsuming = fmt.Errorf("Consumer is not consuming.")
+
+/*
+Why a queue was paused. A queue paused by its circuit breaker
+is resumed when the breaker closes, unless it was also paused
+by a call to Pause.
+*/
+type pauseReason int
+
+const (
+	pausedByUser pauseReason = iota + 1
+	pausedByBreaker
+)
+
+/*
+Stop consuming from a single queue.
+
+The queue's consumer tag is cancelled while the connection and
+the other queues keep running. Messages already delivered are
+still handled. Pausing a paused queue does nothing, except that
+a queue paused by its circuit breaker then stays paused when the
+breaker closes.
+*/
+func (c *Consumer) Pause(queueName string) error {
+	return c.pause(queueName, pausedByUser)
+}
+
+func (c *Consumer) pause(queueName string, reason pauseReason) error {
+	q, err := c.findQueue(queueName)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	channel := c.channels[q.name]
+	if channel == nil {
+		return ErrNotConsuming
+	}
+	if _, ok := c.paused[q.name]; ok {
+		if reason == pausedByUser {
+			c.paused[q.name] = reason
+		}
+		return nil
+	}
+
+	c.log().Info("Pausing queue", "queue", q.name, "consumer_tag", q.Tag())
+	err = channel.Cancel(q.Tag(), false)
+	if err != nil {
+		return err
+	}
+	if c.paused == nil {
+		c.paused = make(map[string]pauseReason)
+	}
+	c.paused[q.name] = reason
+	delete(c.consuming, q.name)
+	c.status.setState(q.name, QueuePaused)
+	return nil
+}
+
+/*
+Start consuming from a paused queue again, using the same consumer tag.
+
+Resuming a queue that isn't paused does nothing.
+*/
+func (c *Consumer) Resume(queueName string) error {
+	return c.resume(queueName, pausedByUser)
+}
+
+/*
+Resume a queue. The breaker only resumes queues it paused.
+*/
+func (c *Consumer) resume(queueName string, reason pauseReason) error {
+	q, err := c.findQueue(queueName)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channels[q.name] == nil {
+		return ErrNotConsuming
+	}
+	paused, ok := c.paused[q.name]
+	if !ok || (reason == pausedByBreaker && paused != pausedByBreaker) {
+		return nil
+	}
+
+	c.log().Info("Resuming queue", "queue", q.name, "consumer_tag", q.Tag())
+	err = c.consumeQueue(q)
+	if err != nil {
+		return err
+	}
+	delete(c.paused, q.name)
+	return nil
+}
+
+/*
+Pause every queue.
+*/
+func (c *Consumer) PauseAll() error {
+	for _, bind := range c.topology.Bindings() {
+		q := bind.Queue()
+		err := c.Pause(q.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Resume every paused queue.
+*/
+func (c *Consumer) ResumeAll() error {
+	for _, bind := range c.topology.Bindings() {
+		q := bind.Queue()
+		err := c.Resume(q.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Whether messages is the current delivery channel for a queue.
+*/
+func (c *Consumer) isConsuming(queueName string, messages <-chan amqp.Delivery) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.consuming[queueName] == messages
+}
+
+func (c *Consumer) findQueue(queueName string) (q queue, err error) {
+	for _, bind := range c.topology.Bindings() {
+		if bind.queue.name == queueName {
+			return bind.Queue(), nil
+		}
+	}
+	return q, fmt.Errorf("Unknown queue %q.", queueName)
+}
+
+/*
+Get an http.Handler serving POST /queues/<name>/pause and
+POST /queues/<name>/resume.
+
+The handler does no authentication, so only serve it where the
+callers are trusted. It is served by the [admin] server, which
+listens on localhost by default.
+*/
+func (c *Consumer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queues/", c.handleQueueAdmin)
+	return mux
+}
+
+/*
+Serves POST /queues/<name>/pause and POST /queues/<name>/resume.
+*/
+func (c *Consumer) handleQueueAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/queues/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	queueName, action := parts[0], parts[1]
+	if _, err := c.findQueue(queueName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch action {
+	case "pause":
+		err = c.Pause(queueName)
+	case "resume":
+		err = c.Resume(queueName)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
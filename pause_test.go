@@ -0,0 +1,67 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPauseNotConsuming(t *testing.T) {
+	c := newStatusConsumer()
+	if err := c.Pause("back-events"); err != ErrNotConsuming {
+		t.Errorf("Should fail before consuming. Got %v", err)
+	}
+	if err := c.Resume("back-events"); err != ErrNotConsuming {
+		t.Errorf("Should fail before consuming. Got %v", err)
+	}
+}
+
+func TestPauseUnknownQueue(t *testing.T) {
+	c := newStatusConsumer()
+	if err := c.Pause("nope"); err == nil {
+		t.Error("Should fail on unknown queues")
+	}
+}
+
+func TestIsConsuming(t *testing.T) {
+	c := newStatusConsumer()
+	current := make(chan amqp.Delivery)
+	old := make(chan amqp.Delivery)
+	c.consuming = map[string]<-chan amqp.Delivery{"back-events": current}
+	if !c.isConsuming("back-events", current) {
+		t.Error("Current channel should be consuming")
+	}
+	if c.isConsuming("back-events", old) {
+		t.Error("Replaced channels should not be consuming")
+	}
+}
+
+func TestQueueAdminHandler(t *testing.T) {
+	c := newStatusConsumer()
+	handler := c.AdminHandler()
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/queues/back-events/pause", 405},
+		{"POST", "/queues/nope/pause", 404},
+		{"POST", "/queues/back-events/explode", 404},
+		{"POST", "/queues/back-events", 404},
+		{"POST", "/queues/back-events/pause", 409},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s %s should respond with %d. Got %d", tc.method, tc.path, tc.code, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	c.HealthHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/queues/back-events/pause", nil))
+	if rec.Code != 404 {
+		t.Errorf("The health server should not pause queues. Got %d", rec.Code)
+	}
+}
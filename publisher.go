@@ -0,0 +1,343 @@
+package consumer
+
+import (
+	"code.google.com/p/goconf/conf"
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"sync"
+)
+
+/*
+Outgoing message type so users of this library don't have to import amqp as well
+*/
+type Publishing = amqp.Publishing
+
+/*
+A message the broker could not route and returned to the publisher.
+*/
+type Return = amqp.Return
+
+var (
+	// Returned when the broker nacks a published message.
+	ErrPublishNacked = errors.New("Message was nacked by the broker.")
+	// Returned when publishing on a closed publisher, or when the
+	// channel closes before the broker confirms a message.
+	ErrPublisherClosed = errors.New("Publisher is closed.")
+)
+
+/*
+Publishes messages to the exchanges defined in a config file.
+
+Every message is published with publisher confirms enabled and
+Publish waits for the broker to ack or nack it. When the broker
+closes the channel, for example after publishing to a missing
+exchange, the next Publish opens a new one. A Publisher is safe
+to use from multiple goroutines.
+*/
+type Publisher struct {
+	topology  topology
+	conn      Broker
+	dial      Dialer
+	ownsConn  bool
+	closed    bool
+	channel   Channel
+	confirms  *confirmTracker
+	mu        sync.Mutex
+	mandatory bool
+	onReturn  func(Return)
+	logger    Logger
+
+	propagators []Propagator
+}
+
+/*
+Create a new publisher using the connection and exchange
+configurations in the provided configuration file.
+*/
+func CreatePublisher(configFile string, opts ...Option) (p *Publisher, err error) {
+	o := newOptions(opts)
+	o.logger.Info("Creating new publisher", "config", configFile)
+
+	config, err := conf.ReadConfigFile(configFile)
+	if err != nil {
+		return
+	}
+
+	topology, err := NewTopology(config)
+	if err != nil {
+		return
+	}
+	p = &Publisher{topology: topology, dial: o.dial, ownsConn: true, logger: o.logger, propagators: o.propagators}
+	return
+}
+
+/*
+Get a publisher that shares the consumer's connection.
+
+The consumer will connect if it hasn't already. Closing the
+publisher leaves the consumer's connection open.
+*/
+func (c *Consumer) Publisher() (p *Publisher, err error) {
+	err = c.Connect()
+	if err != nil {
+		return
+	}
+	p = &Publisher{topology: c.topology, conn: c.conn, logger: c.logger, propagators: c.propagators}
+	err = p.Connect()
+	if err != nil {
+		p = nil
+	}
+	return
+}
+
+/*
+Register a function to receive messages that the broker could not route.
+
+Once registered, messages are published with the mandatory flag set.
+Must be called before the first message is published.
+*/
+func (p *Publisher) OnReturn(fn func(Return)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onReturn = fn
+	p.mandatory = fn != nil
+}
+
+/*
+Connect to the AMQP server, declare the configured
+exchanges and put the channel into confirm mode.
+*/
+func (p *Publisher) Connect() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPublisherClosed
+	}
+	if p.channel != nil {
+		return
+	}
+
+	if p.conn == nil {
+		err = p.dialLocked()
+		if err != nil {
+			return
+		}
+	}
+
+	channel, err := p.conn.Channel()
+	if err != nil && p.ownsConn {
+		// The connection may have been lost, so dial a new one.
+		p.conn.Close()
+		err = p.dialLocked()
+		if err != nil {
+			return
+		}
+		channel, err = p.conn.Channel()
+	}
+	if err != nil {
+		return
+	}
+	for _, bind := range p.topology.Bindings() {
+		err = declareExchange(channel, bind.Exchange(), loggerOrDefault(p.logger))
+		if err != nil {
+			return
+		}
+	}
+	err = channel.Confirm(false)
+	if err != nil {
+		return
+	}
+
+	p.confirms = newConfirmTracker()
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation, 64))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 16))
+	go p.confirms.listen(confirmations)
+	go p.listenReturns(returns)
+	go p.watchChannel(channel, channel.NotifyClose(make(chan *amqp.Error, 1)))
+
+	p.channel = channel
+	return
+}
+
+func (p *Publisher) dialLocked() (err error) {
+	connData := p.topology.Connection()
+	p.conn, err = dialerOrDefault(p.dial)(connData.Url())
+	if err != nil {
+		p.conn = nil
+	}
+	return
+}
+
+/*
+Forget the channel once the broker closes it, so the
+next Publish opens a new one.
+*/
+func (p *Publisher) watchChannel(channel Channel, closed <-chan *amqp.Error) {
+	err, ok := <-closed
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.channel != channel {
+		return
+	}
+	if ok && err != nil {
+		loggerOrDefault(p.logger).Warn("Publisher channel closed", "error", err)
+	}
+	p.channel = nil
+	p.confirms = nil
+}
+
+/*
+Publish a message and wait for the broker to confirm it.
+
+If ctx carries a span context, such as the context passed to a
+handler, it is added to the message headers.
+
+Returns ErrPublishNacked if the broker nacks the message, or the
+context's error if it is done before a confirmation arrives.
+*/
+func (p *Publisher) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	err := p.Connect()
+	if err != nil {
+		return err
+	}
+
+	// Delivery tags are assigned in publish order, so hold the lock
+	// until the message has been handed to the channel and tagged.
+	// A failed Publish doesn't use up a tag, so only tag afterwards.
+	p.mu.Lock()
+	if p.channel == nil {
+		p.mu.Unlock()
+		return ErrPublisherClosed
+	}
+	msg.Headers = inject(ctx, p.propagators, msg.Headers)
+	confirms := p.confirms
+	err = p.channel.Publish(exchange, key, p.mandatory, false, msg)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	tag, done := confirms.add()
+	p.mu.Unlock()
+
+	select {
+	case ack, ok := <-done:
+		if !ok {
+			return ErrPublisherClosed
+		}
+		if !ack {
+			return ErrPublishNacked
+		}
+		return nil
+	case <-ctx.Done():
+		confirms.forget(tag)
+		return ctx.Err()
+	}
+}
+
+/*
+Close the publisher's channel, and its connection if it owns it.
+Publishing after Close returns ErrPublisherClosed.
+*/
+func (p *Publisher) Close() (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.channel != nil {
+		err = p.channel.Close()
+		p.channel = nil
+		p.confirms = nil
+	}
+	if p.ownsConn && p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *Publisher) listenReturns(returns <-chan amqp.Return) {
+	for r := range returns {
+		p.mu.Lock()
+		fn := p.onReturn
+		p.mu.Unlock()
+		if fn != nil {
+			fn(r)
+		} else {
+			loggerOrDefault(p.logger).Warn("Message returned by broker",
+				"exchange", r.Exchange,
+				"routing_key", r.RoutingKey,
+				"reply_code", r.ReplyCode,
+				"reason", r.ReplyText)
+		}
+	}
+}
+
+/*
+Matches broker confirmations to the publishes waiting on them.
+*/
+type confirmTracker struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]chan bool
+	early   map[uint64]bool
+	closed  bool
+}
+
+func newConfirmTracker() *confirmTracker {
+	return &confirmTracker{next: 1, pending: make(map[uint64]chan bool), early: make(map[uint64]bool)}
+}
+
+/*
+Take the delivery tag of a message the channel has just published.
+The returned channel receives true on ack and false on nack, and
+is closed if the channel closes.
+*/
+func (t *confirmTracker) add() (uint64, chan bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tag := t.next
+	t.next++
+	done := make(chan bool, 1)
+	if ack, ok := t.early[tag]; ok {
+		// The broker confirmed the message before it was tagged.
+		delete(t.early, tag)
+		done <- ack
+		return tag, done
+	}
+	if t.closed {
+		close(done)
+		return tag, done
+	}
+	t.pending[tag] = done
+	return tag, done
+}
+
+func (t *confirmTracker) forget(tag uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, tag)
+}
+
+func (t *confirmTracker) resolve(c amqp.Confirmation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if done, ok := t.pending[c.DeliveryTag]; ok {
+		done <- c.Ack
+		delete(t.pending, c.DeliveryTag)
+	} else if c.DeliveryTag >= t.next {
+		t.early[c.DeliveryTag] = c.Ack
+	}
+}
+
+func (t *confirmTracker) listen(confirmations <-chan amqp.Confirmation) {
+	for c := range confirmations {
+		t.resolve(c)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for tag, done := range t.pending {
+		close(done)
+		delete(t.pending, tag)
+	}
+}
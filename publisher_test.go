@@ -0,0 +1,65 @@
+package consumer
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func TestConfirmTrackerAck(t *testing.T) {
+	tracker := newConfirmTracker()
+	first, firstDone := tracker.add()
+	second, secondDone := tracker.add()
+	if first != 1 || second != 2 {
+		t.Error("Tags should start at 1 and increase")
+	}
+	tracker.resolve(amqp.Confirmation{DeliveryTag: 2, Ack: false})
+	tracker.resolve(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	if !<-firstDone {
+		t.Error("First message should be acked")
+	}
+	if <-secondDone {
+		t.Error("Second message should be nacked")
+	}
+}
+
+func TestConfirmTrackerForget(t *testing.T) {
+	tracker := newConfirmTracker()
+	tag, done := tracker.add()
+	tracker.forget(tag)
+	tracker.resolve(amqp.Confirmation{DeliveryTag: tag, Ack: true})
+	select {
+	case <-done:
+		t.Error("Forgotten tags should not be resolved")
+	default:
+	}
+}
+
+func TestConfirmTrackerEarlyConfirm(t *testing.T) {
+	tracker := newConfirmTracker()
+	tracker.resolve(amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	if _, done := tracker.add(); !<-done {
+		t.Error("Confirms that arrive before the tag is taken should be kept")
+	}
+}
+
+func TestConfirmTrackerClose(t *testing.T) {
+	tracker := newConfirmTracker()
+	_, done := tracker.add()
+	confirmations := make(chan amqp.Confirmation)
+	close(confirmations)
+	tracker.listen(confirmations)
+	if _, ok := <-done; ok {
+		t.Error("Pending publishes should be closed")
+	}
+	_, late := tracker.add()
+	if _, ok := <-late; ok {
+		t.Error("Publishes after close should be closed")
+	}
+}
+
+func TestPublishClosed(t *testing.T) {
+	p := &Publisher{}
+	if err := p.Close(); err != nil {
+		t.Error("Closing an unconnected publisher should not fail")
+	}
+}
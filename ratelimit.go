@@ -0,0 +1,159 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+A token bucket shared by every worker consuming from a queue.
+
+A rate of zero or less means no limit.
+*/
+type limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+	now     func() time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	l := &limiter{changed: make(chan struct{}), now: time.Now}
+	l.set(rate, burst)
+	return l
+}
+
+func newLimiters(top topology) map[string]*limiter {
+	limiters := make(map[string]*limiter)
+	for _, bind := range top.Bindings() {
+		q := bind.Queue()
+		limiters[q.name] = newLimiter(q.rateLimit, q.burst)
+	}
+	return limiters
+}
+
+/*
+Change the rate and burst, waking any goroutines that are waiting.
+*/
+func (l *limiter) set(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	l.rate = rate
+	l.burst = burst
+	l.tokens = math.Min(l.tokens, float64(burst))
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	}
+	l.last = l.now()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+/*
+Take a token, returning how long to wait if none are available.
+*/
+func (l *limiter) reserve() (wait time.Duration, changed chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, nil
+	}
+	now := l.now()
+	l.tokens = math.Min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, nil
+	}
+	wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return wait, l.changed
+}
+
+/*
+Get the current rate and burst.
+*/
+func (l *limiter) limits() (rate float64, burst int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.burst
+}
+
+/*
+Block until a token is available or ctx is done.
+*/
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		wait, changed := l.reserve()
+		if wait <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+Change how many messages per second are handled from a queue.
+
+burst is how many messages can be handled at once after the queue
+has been idle. A perSecond of zero removes the limit. The limit is
+shared by all of the queue's workers.
+*/
+func (c *Consumer) SetRateLimit(queueName string, perSecond float64, burst int) error {
+	l, ok := c.limiters[queueName]
+	if !ok {
+		return fmt.Errorf("Unknown queue %q.", queueName)
+	}
+	c.log().Info("Changing rate limit", "queue", queueName, "rate_limit", perSecond, "burst", burst)
+	l.set(perSecond, burst)
+	return nil
+}
+
+/*
+Get the prefetch count for a queue's channel, or 0 for no limit.
+
+The prefetch option is used when it is set. Otherwise rate limited
+queues fetch enough messages to spend their burst and keep each
+handler busy, rather than holding the whole queue unacked while
+they wait for the limiter. Batches can still fill up.
+*/
+func (c *Consumer) prefetch(q queue) int {
+	if q.prefetch > 0 {
+		return q.prefetch
+	}
+	rate, burst := c.limiters[q.name].limits()
+	if rate <= 0 {
+		return 0
+	}
+	handlers := q.workers
+	if q.partitions > 0 {
+		handlers = q.partitions
+	}
+	prefetch := burst + handlers
+	if c.batch != nil && prefetch < q.batchSize {
+		prefetch = q.batchSize
+	}
+	return prefetch
+}
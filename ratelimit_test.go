@@ -0,0 +1,139 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(0, 1)
+	for i := 0; i < 100; i++ {
+		if wait, _ := l.reserve(); wait != 0 {
+			t.Fatal("Unlimited limiters should never wait")
+		}
+	}
+	var none *limiter
+	if none.wait(context.Background()) != nil {
+		t.Error("Nil limiters should not wait")
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(10, 3)
+	l.now = func() time.Time {
+		return now
+	}
+	l.last = now
+	for i := 0; i < 3; i++ {
+		if wait, _ := l.reserve(); wait != 0 {
+			t.Errorf("Burst of 3 should not wait on message %d", i+1)
+		}
+	}
+	wait, _ := l.reserve()
+	if wait != 100*time.Millisecond {
+		t.Errorf("Should wait for the next token. Got %s", wait)
+	}
+	now = now.Add(100 * time.Millisecond)
+	if wait, _ := l.reserve(); wait != 0 {
+		t.Errorf("Token should have refilled. Got %s", wait)
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := newLimiter(0.001, 1)
+	l.wait(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Errorf("Wait should stop when the context is done. Got %v", err)
+	}
+}
+
+func TestSetRateLimitWakesWaiters(t *testing.T) {
+	top, _ := NewTopology(newConfig(singleQueue))
+	c := &Consumer{logger: NopLogger(), limiters: newLimiters(top)}
+	if err := c.SetRateLimit("nope", 1, 1); err == nil {
+		t.Error("Should fail on unknown queues")
+	}
+	c.SetRateLimit("db_events", 0.001, 1)
+	l := c.limiters["db_events"]
+	l.wait(context.Background())
+
+	done := make(chan error)
+	go func() {
+		done <- l.wait(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.SetRateLimit("db_events", 0, 1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Removing the limit should wake waiting workers")
+	}
+}
+
+func TestNewQueueRateLimitOptions(t *testing.T) {
+	ini := `
+[queue]
+name = test
+workers = 4
+rate_limit = 2.5
+burst = 5
+`
+	q, err := newQueue(newConfig(ini), "queue")
+	if err != nil {
+		t.Error("Should not make an error")
+	}
+	if q.workers != 4 || q.rateLimit != 2.5 || q.burst != 5 {
+		t.Error("Rate limit options are wrong")
+	}
+	_, err = newQueue(newConfig("[queue]\nname = test\nworkers = 0\n"), "queue")
+	if err == nil {
+		t.Error("Should fail on invalid workers")
+	}
+	q, _ = newQueue(newConfig("[queue]\nname = test\nprefetch = 20\n"), "queue")
+	if q.prefetch != 20 {
+		t.Errorf("Prefetch option is wrong, got %d", q.prefetch)
+	}
+	_, err = newQueue(newConfig("[queue]\nname = test\nprefetch = -1\n"), "queue")
+	if err == nil {
+		t.Error("Should fail on invalid prefetch")
+	}
+	for _, option := range []string{"rate_limit = fast", "rate_limit = -1", "burst = big", "burst = 0"} {
+		_, err = newQueue(newConfig("[queue]\nname = test\n"+option+"\n"), "queue")
+		if err == nil {
+			t.Errorf("Should fail on %s", option)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	limited := newLimiter(10, 5)
+	cases := []struct {
+		q       queue
+		limiter *limiter
+		batch   bool
+		want    int
+	}{
+		{queue{workers: 1}, nil, false, 0},
+		{queue{workers: 1}, newLimiter(0, 5), false, 0},
+		{queue{workers: 1, prefetch: 20}, nil, false, 20},
+		{queue{workers: 4, prefetch: 2}, limited, false, 2},
+		{queue{workers: 4}, limited, false, 9},
+		{queue{workers: 1, partitions: 8}, limited, false, 13},
+		{queue{workers: 1, batchSize: 50}, limited, true, 50},
+		{queue{workers: 1, batchSize: 50}, limited, false, 6},
+	}
+	for i, tc := range cases {
+		c := &Consumer{limiters: map[string]*limiter{"orders": tc.limiter}}
+		if tc.batch {
+			c.batch = func(ctx context.Context, msgs []*Message) error { return nil }
+		}
+		tc.q.name = "orders"
+		if got := c.prefetch(tc.q); got != tc.want {
+			t.Errorf("%d: prefetch is %d, want %d", i, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+/*
+Header set on replies that carry an error payload.
+*/
+const RPCErrorHeader = "x-rpc-error"
+
+/*
+The response an RPCHandler sends back to the caller.
+*/
+type Reply struct {
+	ContentType string
+	Headers     map[string]interface{}
+	Body        []byte
+}
+
+/*
+A function that handles a request message and returns the reply for it.
+*/
+type RPCHandler func(ctx context.Context, msg *Message) (*Reply, error)
+
+/*
+Error payload sent when an RPCHandler fails.
+
+Handlers can return an *RPCError to control the code sent to
+the caller. Any other error is sent with only its message.
+*/
+type RPCError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return e.Code + ": " + e.Message
+}
+
+type rpcErrorBody struct {
+	Error *RPCError `json:"error"`
+}
+
+/*
+Anything that can publish messages. Implemented by Publisher.
+*/
+type MessagePublisher interface {
+	Publish(ctx context.Context, exchange, key string, msg Publishing) error
+}
+
+/*
+Binds an RPCHandler to the configured queues.
+
+Replies are published to the default exchange using the request's
+ReplyTo and CorrelationId. When the handler fails, an error payload
+is sent instead and the request is acked, as the caller has been
+told about the failure.
+*/
+func (c *Consumer) ConsumeRPC(handler RPCHandler) (err error) {
+	pub, err := c.Publisher()
+	if err != nil {
+		return
+	}
+	defer pub.Close()
+	return c.consume(rpcHandler(pub, handler, c.log()), true)
+}
+
+/*
+Wrap an RPCHandler in a Handler that sends its replies with pub,
+the same way ConsumeRPC does. Useful for testing RPC handlers
+with a recording publisher.
+*/
+func ReplyingHandler(pub MessagePublisher, handler RPCHandler) Handler {
+	return rpcHandler(pub, handler, loggerOrDefault(nil))
+}
+
+func rpcHandler(pub MessagePublisher, handler RPCHandler, logger Logger) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		reply, err := handler(ctx, msg)
+		if msg.ReplyTo == "" {
+			logger.Warn("Message has no reply_to, dropping reply",
+				"correlation_id", msg.CorrelationId,
+				"routing_key", msg.RoutingKey,
+				"delivery_tag", msg.DeliveryTag)
+			return err
+		}
+		return pub.Publish(ctx, "", msg.ReplyTo, replyFor(msg, reply, err))
+	}
+}
+
+/*
+Build the message sent in response to a request.
+*/
+func replyFor(msg *Message, reply *Reply, err error) Publishing {
+	out := Publishing{CorrelationId: msg.CorrelationId}
+	if err != nil {
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &RPCError{Message: err.Error()}
+		}
+		out.ContentType = "application/json"
+		out.Headers = map[string]interface{}{RPCErrorHeader: true}
+		out.Body, _ = json.Marshal(rpcErrorBody{Error: rpcErr})
+		return out
+	}
+	if reply != nil {
+		out.ContentType = reply.ContentType
+		out.Headers = reply.Headers
+		out.Body = reply.Body
+	}
+	return out
+}
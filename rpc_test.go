@@ -0,0 +1,103 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type publishRecorder struct {
+	exchange string
+	key      string
+	msg      Publishing
+	err      error
+}
+
+func (p *publishRecorder) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	p.exchange = exchange
+	p.key = key
+	p.msg = msg
+	return p.err
+}
+
+func TestRPCHandlerReply(t *testing.T) {
+	r := &ackRecorder{}
+	pub := &publishRecorder{}
+	c := &Consumer{}
+	handler := rpcHandler(pub, func(ctx context.Context, msg *Message) (*Reply, error) {
+		return &Reply{ContentType: "text/plain", Body: []byte("pong")}, nil
+	}, NopLogger())
+	msg := newTestMessage(r, 1)
+	msg.ReplyTo = "callback"
+	msg.CorrelationId = "abc"
+	c.handle(queue{name: "rpc"}, handler, true, msg)
+
+	if pub.exchange != "" || pub.key != "callback" {
+		t.Error("Reply should go to reply_to on the default exchange")
+	}
+	if pub.msg.CorrelationId != "abc" {
+		t.Error("Correlation id should be copied")
+	}
+	if string(pub.msg.Body) != "pong" || pub.msg.ContentType != "text/plain" {
+		t.Error("Reply body is wrong")
+	}
+	if len(r.acks) != 1 {
+		t.Error("Request should be acked")
+	}
+}
+
+func TestRPCHandlerError(t *testing.T) {
+	r := &ackRecorder{}
+	pub := &publishRecorder{}
+	c := &Consumer{}
+	handler := rpcHandler(pub, func(ctx context.Context, msg *Message) (*Reply, error) {
+		return nil, &RPCError{Code: "not_found", Message: "no such order"}
+	}, NopLogger())
+	msg := newTestMessage(r, 1)
+	msg.ReplyTo = "callback"
+	c.handle(queue{name: "rpc"}, handler, true, msg)
+
+	if pub.msg.Headers[RPCErrorHeader] != true {
+		t.Error("Error header should be set")
+	}
+	expected := `{"error":{"code":"not_found","message":"no such order"}}`
+	if string(pub.msg.Body) != expected {
+		t.Errorf("Error body is wrong. Got %s", pub.msg.Body)
+	}
+	if len(r.acks) != 1 {
+		t.Error("Request should be acked once the error is sent")
+	}
+}
+
+func TestRPCHandlerPublishFailure(t *testing.T) {
+	r := &ackRecorder{}
+	pub := &publishRecorder{err: errors.New("closed")}
+	c := &Consumer{}
+	handler := rpcHandler(pub, func(ctx context.Context, msg *Message) (*Reply, error) {
+		return &Reply{}, nil
+	}, NopLogger())
+	msg := newTestMessage(r, 1)
+	msg.ReplyTo = "callback"
+	c.handle(queue{name: "rpc", requeue: true}, handler, true, msg)
+
+	if len(r.nacks) != 1 || !r.requeue {
+		t.Error("Request should be requeued when the reply can't be sent")
+	}
+}
+
+func TestRPCHandlerNoReplyTo(t *testing.T) {
+	r := &ackRecorder{}
+	pub := &publishRecorder{}
+	c := &Consumer{}
+	handler := rpcHandler(pub, func(ctx context.Context, msg *Message) (*Reply, error) {
+		return &Reply{Body: []byte("pong")}, nil
+	}, NopLogger())
+	c.handle(queue{name: "rpc"}, handler, true, newTestMessage(r, 1))
+
+	if pub.msg.Body != nil {
+		t.Error("Nothing should be published")
+	}
+	if len(r.acks) != 1 {
+		t.Error("Request should be acked")
+	}
+}
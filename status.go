@@ -0,0 +1,176 @@
+package consumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+The states a queue's consumer can be in.
+*/
+const (
+	QueuePending   = "pending"
+	QueueConsuming = "consuming"
+	QueuePaused    = "paused"
+	QueueStopped   = "stopped"
+)
+
+/*
+A snapshot of a consumer's state, as served on /status.
+*/
+type Status struct {
+	Connected bool          `json:"connected"`
+	Declared  bool          `json:"declared"`
+	Queues    []QueueStatus `json:"queues"`
+}
+
+/*
+The state of a single queue's consumer.
+*/
+type QueueStatus struct {
+	Queue       string     `json:"queue"`
+	ConsumerTag string     `json:"consumer_tag"`
+	State       string     `json:"state"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+/*
+Whether the consumer is connected, has declared its
+topology and is consuming from every queue.
+*/
+func (s Status) Ready() bool {
+	if !s.Connected || !s.Declared {
+		return false
+	}
+	for _, q := range s.Queues {
+		if q.State != QueueConsuming {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Get a snapshot of the consumer's connection and queue states.
+*/
+func (c *Consumer) Status() Status {
+	return c.status.snapshot()
+}
+
+/*
+Keeps track of connection and queue state for health checks.
+
+All methods are safe to call on a nil *statusTracker.
+*/
+type statusTracker struct {
+	mu        sync.Mutex
+	connected bool
+	declared  bool
+	queues    []*QueueStatus
+}
+
+func newStatusTracker(top topology) *statusTracker {
+	s := &statusTracker{}
+	for _, bind := range top.Bindings() {
+		q := bind.Queue()
+		s.queues = append(s.queues, &QueueStatus{
+			Queue:       q.Name(),
+			ConsumerTag: q.Tag(),
+			State:       QueuePending,
+		})
+	}
+	return s
+}
+
+func (s *statusTracker) update(queue string, fn func(q *QueueStatus)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		if q.Queue == queue {
+			fn(q)
+		}
+	}
+}
+
+func (s *statusTracker) setConnected(connected, declared bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	s.declared = declared
+	if !connected {
+		for _, q := range s.queues {
+			q.State = QueueStopped
+		}
+	}
+}
+
+func (s *statusTracker) setState(queue, state string) {
+	s.update(queue, func(q *QueueStatus) {
+		q.State = state
+	})
+}
+
+func (s *statusTracker) received(queue string) {
+	now := time.Now()
+	s.update(queue, func(q *QueueStatus) {
+		q.LastMessage = &now
+	})
+}
+
+func (s *statusTracker) failed(queue string, err error) {
+	now := time.Now()
+	s.update(queue, func(q *QueueStatus) {
+		q.LastError = err.Error()
+		q.LastErrorAt = &now
+	})
+}
+
+func (s *statusTracker) snapshot() Status {
+	if s == nil {
+		return Status{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := Status{Connected: s.connected, Declared: s.declared}
+	for _, q := range s.queues {
+		status.Queues = append(status.Queues, *q)
+	}
+	return status
+}
+
+/*
+Get an http.Handler serving /healthz, /readyz and /status.
+
+/healthz always succeeds while the process is alive. /readyz
+fails with 503 until the consumer is connected, its topology is
+declared and every queue is being consumed. /status describes
+each queue as JSON.
+*/
+func (c *Consumer) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !c.Status().Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+	return mux
+}
@@ -0,0 +1,102 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func newStatusConsumer() *Consumer {
+	top, _ := NewTopology(newConfig(multiQueue))
+	return &Consumer{topology: top, status: newStatusTracker(top), logger: NopLogger()}
+}
+
+func TestStatusPending(t *testing.T) {
+	c := newStatusConsumer()
+	status := c.Status()
+	if status.Connected || status.Ready() {
+		t.Error("New consumers should not be ready")
+	}
+	if len(status.Queues) != 2 {
+		t.Fatal("Every queue should have a status")
+	}
+	if status.Queues[0].Queue != "back-events" || status.Queues[0].State != QueuePending {
+		t.Errorf("Queue status is wrong. Got %#v", status.Queues[0])
+	}
+	if status.Queues[0].ConsumerTag != "back-events-events" {
+		t.Error("Consumer tag is wrong")
+	}
+}
+
+func TestStatusReady(t *testing.T) {
+	c := newStatusConsumer()
+	c.status.setConnected(true, true)
+	c.status.setState("back-events", QueueConsuming)
+	if c.Status().Ready() {
+		t.Error("Should not be ready until every queue is consuming")
+	}
+	c.status.setState("front-events", QueueConsuming)
+	if !c.Status().Ready() {
+		t.Error("Should be ready")
+	}
+	c.status.setConnected(false, false)
+	status := c.Status()
+	if status.Ready() || status.Queues[0].State != QueueStopped {
+		t.Error("Disconnecting should stop every queue")
+	}
+}
+
+func TestStatusRecordsMessages(t *testing.T) {
+	c := newStatusConsumer()
+	q := c.topology.Bindings()[0].Queue()
+	c.status.received(q.name)
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		return errors.New("boom")
+	}, true, newTestMessage(&ackRecorder{}, 1))
+
+	status := c.Status().Queues[0]
+	if status.LastMessage == nil {
+		t.Error("Last message time should be set")
+	}
+	if status.LastError != "boom" || status.LastErrorAt == nil {
+		t.Error("Last error should be set")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	c := newStatusConsumer()
+	handler := c.HealthHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != 200 {
+		t.Error("healthz should always succeed")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Error("readyz should fail until connected")
+	}
+
+	c.status.setConnected(true, true)
+	c.status.setState("back-events", QueueConsuming)
+	c.status.setState("front-events", QueueConsuming)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 200 {
+		t.Error("readyz should succeed once consuming")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var status Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("status should be JSON. Got %s", rec.Body)
+	}
+	if !status.Connected || len(status.Queues) != 2 {
+		t.Errorf("status is wrong. Got %s", rec.Body)
+	}
+}
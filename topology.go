@@ -64,11 +64,17 @@ func NewTopology(config *conf.ConfigFile) (t topology, err error) {
 
 	for _, section := range sections {
 		if strings.HasPrefix(section, "queue") {
-			q, _ := newQueue(config, section)
+			q, err := newQueue(config, section)
+			if err != nil {
+				return t, err
+			}
 			queues = append(queues, q)
 		}
 		if strings.HasPrefix(section, "exchange") {
-			ex, _ := newExchange(config, section)
+			ex, err := newExchange(config, section)
+			if err != nil {
+				return t, err
+			}
 			exchanges = append(exchanges, ex)
 		}
 	}
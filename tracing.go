@@ -0,0 +1,256 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+Identifies a span, as carried in message headers.
+*/
+type SpanContext struct {
+	TraceID    string
+	SpanID     string
+	Sampled    bool
+	TraceState string
+}
+
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != "" && s.SpanID != ""
+}
+
+/*
+Starts spans. Adapt your tracing library to this interface to trace
+message handling without this package depending on it.
+
+Start should use SpanContextFromContext(ctx) as the parent, which will
+be the remote span from the message headers for consumed messages.
+*/
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span)
+}
+
+/*
+A span started by a Tracer.
+*/
+type Span interface {
+	// The ids to send to other services.
+	SpanContext() SpanContext
+	SetError(err error)
+	End()
+}
+
+/*
+Reads and writes span contexts in message headers.
+*/
+type Propagator interface {
+	Extract(headers map[string]interface{}) (SpanContext, bool)
+	Inject(sc SpanContext, headers map[string]interface{})
+}
+
+/*
+Trace message handling with t.
+*/
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+/*
+Set the header formats used to propagate traces.
+
+Span contexts are extracted with the first propagator that finds one,
+and injected with all of them. Defaults to W3CPropagator.
+*/
+func WithPropagators(p ...Propagator) Option {
+	return func(o *options) {
+		o.propagators = p
+	}
+}
+
+type spanContextKey struct{}
+
+/*
+Add a span context to ctx, so it's used as the parent for new spans
+and injected into messages published with ctx.
+*/
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+/*
+Get the span context added with ContextWithSpanContext.
+*/
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+var defaultPropagators = []Propagator{W3CPropagator{}}
+
+func extract(propagators []Propagator, headers map[string]interface{}) (SpanContext, bool) {
+	if propagators == nil {
+		propagators = defaultPropagators
+	}
+	for _, p := range propagators {
+		if sc, ok := p.Extract(headers); ok {
+			return sc, true
+		}
+	}
+	return SpanContext{}, false
+}
+
+/*
+Copy headers and add the span context from ctx to them.
+*/
+func inject(ctx context.Context, propagators []Propagator, headers map[string]interface{}) map[string]interface{} {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return headers
+	}
+	if propagators == nil {
+		propagators = defaultPropagators
+	}
+	out := make(map[string]interface{}, len(headers)+2)
+	for k, v := range headers {
+		out[k] = v
+	}
+	for _, p := range propagators {
+		p.Inject(sc, out)
+	}
+	return out
+}
+
+/*
+Start the span for handling a message.
+
+Without a tracer the remote span context is still added to
+the context, so publishes from the handler continue the trace.
+*/
+func (c *Consumer) startSpan(ctx context.Context, q queue, msg *Message) (context.Context, Span) {
+	remote, ok := extract(c.propagators, msg.Headers)
+	if ok {
+		ctx = ContextWithSpanContext(ctx, remote)
+	}
+	if c.tracer == nil {
+		return ctx, noopSpan{remote}
+	}
+	ctx, span := c.tracer.Start(ctx, q.name+" process", map[string]interface{}{
+		"messaging.system":                           "rabbitmq",
+		"messaging.operation":                        "process",
+		"messaging.destination.name":                 msg.Exchange,
+		"messaging.rabbitmq.destination.routing_key": msg.RoutingKey,
+		"messaging.message.id":                       msg.MessageId,
+		"messaging.consumer.queue":                   q.name,
+		"messaging.message.redelivered":              msg.Redelivered,
+	})
+	return ContextWithSpanContext(ctx, span.SpanContext()), span
+}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext { return s.sc }
+func (s noopSpan) SetError(err error)       {}
+func (s noopSpan) End()                     {}
+
+func headerString(headers map[string]interface{}, name string) string {
+	switch v := headers[name].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+var (
+	traceIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spanIdPattern  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+/*
+Propagates traces using the W3C traceparent and tracestate headers.
+*/
+type W3CPropagator struct{}
+
+func (W3CPropagator) Extract(headers map[string]interface{}) (SpanContext, bool) {
+	parts := strings.Split(headerString(headers, "traceparent"), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	traceId, spanId := parts[1], parts[2]
+	if !traceIdPattern.MatchString(traceId) || !spanIdPattern.MatchString(spanId) {
+		return SpanContext{}, false
+	}
+	var flags byte
+	fmt.Sscanf(parts[3], "%02x", &flags)
+	return SpanContext{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		Sampled:    flags&1 == 1,
+		TraceState: headerString(headers, "tracestate"),
+	}, true
+}
+
+func (W3CPropagator) Inject(sc SpanContext, headers map[string]interface{}) {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	headers["traceparent"] = "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+	if sc.TraceState != "" {
+		headers["tracestate"] = sc.TraceState
+	}
+}
+
+/*
+Propagates traces using Zipkin's B3 headers.
+
+Both the single b3 header and the X-B3-* headers are extracted.
+The single header is injected.
+*/
+type B3Propagator struct{}
+
+func (B3Propagator) Extract(headers map[string]interface{}) (SpanContext, bool) {
+	var traceId, spanId, sampled string
+	if single := headerString(headers, "b3"); single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return SpanContext{}, false
+		}
+		traceId, spanId = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else {
+		traceId = headerString(headers, "X-B3-TraceId")
+		spanId = headerString(headers, "X-B3-SpanId")
+		sampled = headerString(headers, "X-B3-Sampled")
+	}
+
+	// 64 bit trace ids are left padded to 128 bits.
+	if len(traceId) == 16 {
+		traceId = strings.Repeat("0", 16) + traceId
+	}
+	if !traceIdPattern.MatchString(traceId) || !spanIdPattern.MatchString(spanId) {
+		return SpanContext{}, false
+	}
+	return SpanContext{
+		TraceID: traceId,
+		SpanID:  spanId,
+		Sampled: sampled == "1" || sampled == "d" || sampled == "true",
+	}, true
+}
+
+func (B3Propagator) Inject(sc SpanContext, headers map[string]interface{}) {
+	sampled := "0"
+	if sc.Sampled {
+		sampled = "1"
+	}
+	headers["b3"] = sc.TraceID + "-" + sc.SpanID + "-" + sampled
+}
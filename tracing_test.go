@@ -0,0 +1,191 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+const (
+	testTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanId  = "00f067aa0ba902b7"
+)
+
+type testSpan struct {
+	name   string
+	attrs  map[string]interface{}
+	parent SpanContext
+	sc     SpanContext
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SpanContext() SpanContext { return s.sc }
+func (s *testSpan) SetError(err error)       { s.err = err }
+func (s *testSpan) End()                     { s.ended = true }
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span) {
+	parent, _ := SpanContextFromContext(ctx)
+	span := &testSpan{
+		name:   name,
+		attrs:  attrs,
+		parent: parent,
+		sc:     SpanContext{TraceID: parent.TraceID, SpanID: "1111111111111111", Sampled: parent.Sampled},
+	}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestW3CPropagatorExtract(t *testing.T) {
+	headers := amqp.Table{
+		"traceparent": []byte("00-" + testTraceId + "-" + testSpanId + "-01"),
+		"tracestate":  "vendor=value",
+	}
+	sc, ok := W3CPropagator{}.Extract(headers)
+	if !ok {
+		t.Fatal("Should extract traceparent")
+	}
+	if sc.TraceID != testTraceId || sc.SpanID != testSpanId || !sc.Sampled {
+		t.Errorf("Wrong span context %#v", sc)
+	}
+	if sc.TraceState != "vendor=value" {
+		t.Errorf("Wrong tracestate %q", sc.TraceState)
+	}
+
+	invalid := []string{
+		"",
+		"00-" + testTraceId + "-" + testSpanId,
+		"ff-" + testTraceId + "-" + testSpanId + "-01",
+		"00-" + testTraceId + "-XYZ067aa0ba902b7-01",
+	}
+	for _, value := range invalid {
+		if _, ok := (W3CPropagator{}).Extract(amqp.Table{"traceparent": value}); ok {
+			t.Errorf("Should not extract %q", value)
+		}
+	}
+}
+
+func TestW3CPropagatorInject(t *testing.T) {
+	headers := amqp.Table{}
+	W3CPropagator{}.Inject(SpanContext{TraceID: testTraceId, SpanID: testSpanId}, headers)
+	if headers["traceparent"] != "00-"+testTraceId+"-"+testSpanId+"-00" {
+		t.Errorf("Wrong traceparent %v", headers["traceparent"])
+	}
+	if _, ok := headers["tracestate"]; ok {
+		t.Error("Empty tracestate should not be set")
+	}
+}
+
+func TestB3PropagatorExtract(t *testing.T) {
+	sc, ok := B3Propagator{}.Extract(amqp.Table{"b3": testTraceId + "-" + testSpanId + "-1"})
+	if !ok || sc.TraceID != testTraceId || sc.SpanID != testSpanId || !sc.Sampled {
+		t.Errorf("Wrong single header span context %#v", sc)
+	}
+
+	sc, ok = B3Propagator{}.Extract(amqp.Table{
+		"X-B3-TraceId": "a3ce929d0e0e4736",
+		"X-B3-SpanId":  testSpanId,
+		"X-B3-Sampled": "0",
+	})
+	if !ok || sc.TraceID != "0000000000000000a3ce929d0e0e4736" || sc.Sampled {
+		t.Errorf("Wrong multi header span context %#v", sc)
+	}
+}
+
+func TestInjectCopiesHeaders(t *testing.T) {
+	headers := amqp.Table{"app": "orders"}
+	if out := inject(context.Background(), nil, headers); len(out) != 1 {
+		t.Error("Headers should be unchanged without a span context")
+	}
+
+	ctx := ContextWithSpanContext(context.Background(), SpanContext{TraceID: testTraceId, SpanID: testSpanId, Sampled: true})
+	out := inject(ctx, []Propagator{W3CPropagator{}, B3Propagator{}}, headers)
+	if _, ok := headers["traceparent"]; ok {
+		t.Error("Caller's headers should not be modified")
+	}
+	if out["app"] != "orders" || out["traceparent"] == nil || out["b3"] == nil {
+		t.Errorf("Wrong headers %v", out)
+	}
+}
+
+func TestHandleStartsSpan(t *testing.T) {
+	tracer := &testTracer{}
+	c := &Consumer{logger: NopLogger(), tracer: tracer}
+	q := queue{name: "orders", requeue: true}
+	msg := newMessage(q, amqp.Delivery{
+		Acknowledger: &ackRecorder{},
+		Exchange:     "app",
+		RoutingKey:   "order.created",
+		Headers:      amqp.Table{"traceparent": "00-" + testTraceId + "-" + testSpanId + "-01"},
+	})
+
+	var handlerSpan SpanContext
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		handlerSpan, _ = SpanContextFromContext(ctx)
+		return errors.New("boom")
+	}, true, msg)
+
+	if len(tracer.spans) != 1 {
+		t.Fatalf("Expected one span, got %d", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if span.name != "orders process" || span.attrs["messaging.rabbitmq.destination.routing_key"] != "order.created" {
+		t.Errorf("Wrong span %s %v", span.name, span.attrs)
+	}
+	if span.parent.SpanID != testSpanId {
+		t.Error("Span should be a child of the message's span")
+	}
+	if handlerSpan.SpanID != "1111111111111111" || handlerSpan.TraceID != testTraceId {
+		t.Errorf("Handler should see the new span, got %#v", handlerSpan)
+	}
+	if span.err == nil || !span.ended {
+		t.Error("Span should record the error and end")
+	}
+}
+
+func TestHandlePassesTraceWithoutTracer(t *testing.T) {
+	c := &Consumer{logger: NopLogger()}
+	q := queue{name: "orders"}
+	msg := newMessage(q, amqp.Delivery{
+		Acknowledger: &ackRecorder{},
+		Headers:      amqp.Table{"traceparent": "00-" + testTraceId + "-" + testSpanId + "-01"},
+	})
+	c.handle(q, func(ctx context.Context, msg *Message) error {
+		if sc, ok := SpanContextFromContext(ctx); !ok || sc.SpanID != testSpanId {
+			t.Error("Handler should see the message's span context")
+		}
+		return nil
+	}, true, msg)
+}
+
+func TestHandleBatchStartsSpans(t *testing.T) {
+	tracer := &testTracer{}
+	c := &Consumer{logger: NopLogger(), tracer: tracer}
+	q := queue{name: "orders", requeue: true}
+	batch := newBatch(&ackRecorder{}, 3)
+	batch[0].Headers = amqp.Table{"traceparent": "00-" + testTraceId + "-" + testSpanId + "-01"}
+
+	c.handleBatch(q, func(ctx context.Context, msgs []*Message) error {
+		return &BatchError{Failed: msgs[1:2], Err: errors.New("boom")}
+	}, batch)
+
+	if len(tracer.spans) != 3 {
+		t.Fatalf("Expected a span per message, got %d", len(tracer.spans))
+	}
+	if tracer.spans[0].parent.SpanID != testSpanId {
+		t.Error("Spans should be children of their message's span")
+	}
+	for i, span := range tracer.spans {
+		if span.name != "orders process" || !span.ended {
+			t.Errorf("Span %d should be named and ended, got %s", i, span.name)
+		}
+		if (span.err != nil) != (i == 1) {
+			t.Errorf("Only the failed message's span should record an error, span %d has %v", i, span.err)
+		}
+	}
+}
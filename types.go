@@ -3,6 +3,7 @@ package consumer
 import (
 	"code.google.com/p/goconf/conf"
 	"fmt"
+	"time"
 )
 
 type connection struct {
@@ -23,6 +24,34 @@ func (c *connection) Url() string {
 		c.vhost)
 }
 
+/*
+Get the AMQP connection URL with the password masked,
+for showing to people.
+*/
+func (c *connection) SafeUrl() string {
+	return fmt.Sprintf("amqp://%s:****@%s:%d%s",
+		c.user,
+		c.host,
+		c.port,
+		c.vhost)
+}
+
+func (c connection) Host() string {
+	return c.host
+}
+
+func (c connection) Port() int {
+	return c.port
+}
+
+func (c connection) VHost() string {
+	return c.vhost
+}
+
+func (c connection) User() string {
+	return c.user
+}
+
 func (c connection) String() string {
 	return fmt.Sprintf("%#v", c)
 }
@@ -35,17 +64,47 @@ type exchange struct {
 	autoDelete bool
 }
 
+func (e exchange) Name() string {
+	return e.name
+}
+
+func (e exchange) Kind() string {
+	return e.kind
+}
+
+func (e exchange) Durable() bool {
+	return e.durable
+}
+
+func (e exchange) AutoDelete() bool {
+	return e.autoDelete
+}
+
 func (e exchange) String() string {
 	return fmt.Sprintf("%#v", e)
 }
 
 
 type queue struct {
-	name       string
-	durable    bool
-	autoDelete bool
-	exclusive  bool
-	routingKey string
+	name                string
+	durable             bool
+	autoDelete          bool
+	exclusive           bool
+	routingKey          string
+	requeue             bool
+	handlerTimeout      time.Duration
+	maxDecompressedSize int64
+	breakerThreshold    int
+	breakerWindow       time.Duration
+	breakerCooldown     time.Duration
+	workers             int
+	rateLimit           float64
+	burst               int
+	prefetch            int
+	batchSize           int
+	batchTimeout        time.Duration
+	partitions          int
+	partitionKey        string
 }
 
 func (q *queue) Name() string {
@@ -60,6 +119,27 @@ func (q *queue) Exclusive() bool {
 	return q.exclusive
 }
 
+func (q queue) Durable() bool {
+	return q.durable
+}
+
+func (q queue) AutoDelete() bool {
+	return q.autoDelete
+}
+
+func (q queue) RoutingKey() string {
+	return q.routingKey
+}
+
+// Whether failed messages are requeued.
+func (q queue) Requeue() bool {
+	return q.requeue
+}
+
+func (q queue) Workers() int {
+	return q.workers
+}
+
 func (q queue) String() string {
 	return fmt.Sprintf("%#v", q)
 }
@@ -129,7 +209,7 @@ func newExchange(config *conf.ConfigFile, section string) (ex exchange, err erro
 		autoDelete: false,
 	}
 	ex.name, _ = config.GetString(section, "name")
-	if config.HasOption("exchange", "type") {
+	if config.HasOption(section, "type") {
 		ex.kind, _ = config.GetString(section, "type")
 	}
 	if config.HasOption(section, "durable") {
@@ -158,6 +238,14 @@ func newQueue(config *conf.ConfigFile, section string) (q queue, err error) {
 		autoDelete: false,
 		exclusive:  true,
 		routingKey: "",
+		requeue:    true,
+
+		breakerWindow:   time.Minute,
+		breakerCooldown: 30 * time.Second,
+		workers:         1,
+		burst:           1,
+		batchSize:       1,
+		batchTimeout:    time.Second,
 	}
 	if config.HasOption(section, "durable") {
 		q.durable, _ = config.GetBool(section, "durable")
@@ -171,5 +259,187 @@ func newQueue(config *conf.ConfigFile, section string) (q queue, err error) {
 	if config.HasOption(section, "routing_key") {
 		q.routingKey, _ = config.GetString(section, "routing_key")
 	}
+	if config.HasOption(section, "requeue") {
+		q.requeue, _ = config.GetBool(section, "requeue")
+	}
+	if config.HasOption(section, "max_decompressed_size") {
+		size, err := getInt(config, section, "max_decompressed_size")
+		if err != nil {
+			return q, err
+		}
+		if size < 0 {
+			return q, fmt.Errorf("Invalid max_decompressed_size in %s section. Must be 0 or more.", section)
+		}
+		q.maxDecompressedSize = int64(size)
+	}
+	if config.HasOption(section, "handler_timeout") {
+		q.handlerTimeout, err = getDuration(config, section, "handler_timeout")
+		if err != nil {
+			return
+		}
+	}
+	if config.HasOption(section, "workers") {
+		q.workers, _ = config.GetInt(section, "workers")
+		if q.workers < 1 {
+			return q, fmt.Errorf("Invalid workers in %s section. Must be at least 1.", section)
+		}
+	}
+	if config.HasOption(section, "rate_limit") {
+		q.rateLimit, err = getFloat(config, section, "rate_limit")
+		if err != nil {
+			return
+		}
+		if q.rateLimit < 0 {
+			return q, fmt.Errorf("Invalid rate_limit in %s section. Must be 0 or more.", section)
+		}
+	}
+	if config.HasOption(section, "burst") {
+		q.burst, err = getInt(config, section, "burst")
+		if err != nil {
+			return
+		}
+		if q.burst < 1 {
+			return q, fmt.Errorf("Invalid burst in %s section. Must be at least 1.", section)
+		}
+	}
+	if config.HasOption(section, "prefetch") {
+		q.prefetch, _ = config.GetInt(section, "prefetch")
+		if q.prefetch < 0 {
+			return q, fmt.Errorf("Invalid prefetch in %s section. Must be 0 or more.", section)
+		}
+	}
+	if config.HasOption(section, "partitions") {
+		q.partitions, err = getInt(config, section, "partitions")
+		if err != nil {
+			return
+		}
+		if q.partitions < 1 {
+			return q, fmt.Errorf("Invalid partitions in %s section. Must be at least 1.", section)
+		}
+	}
+	if config.HasOption(section, "partition_key") {
+		q.partitionKey, _ = config.GetString(section, "partition_key")
+	}
+	if config.HasOption(section, "batch_size") {
+		q.batchSize, _ = config.GetInt(section, "batch_size")
+		if q.batchSize < 1 {
+			return q, fmt.Errorf("Invalid batch_size in %s section. Must be at least 1.", section)
+		}
+	}
+	if config.HasOption(section, "batch_timeout") {
+		q.batchTimeout, err = getDuration(config, section, "batch_timeout")
+		if err != nil {
+			return
+		}
+	}
+	if config.HasOption(section, "breaker_failure_threshold") {
+		q.breakerThreshold, _ = config.GetInt(section, "breaker_failure_threshold")
+	}
+	if config.HasOption(section, "breaker_window") {
+		q.breakerWindow, err = getDuration(config, section, "breaker_window")
+		if err != nil {
+			return
+		}
+	}
+	if config.HasOption(section, "breaker_cooldown") {
+		q.breakerCooldown, err = getDuration(config, section, "breaker_cooldown")
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Read a duration like "30s" or "1m30s" from the config file.
+*/
+func getDuration(config *conf.ConfigFile, section, option string) (d time.Duration, err error) {
+	value, _ := config.GetString(section, option)
+	d, err = time.ParseDuration(value)
+	if err != nil {
+		err = fmt.Errorf("Invalid %s in %s section. Got %q", option, section, value)
+	}
+	return
+}
+
+func getInt(config *conf.ConfigFile, section, option string) (i int, err error) {
+	value, _ := config.GetString(section, option)
+	i, err = config.GetInt(section, option)
+	if err != nil {
+		err = fmt.Errorf("Invalid %s in %s section. Got %q", option, section, value)
+	}
+	return
+}
+
+func getFloat(config *conf.ConfigFile, section, option string) (f float64, err error) {
+	value, _ := config.GetString(section, option)
+	f, err = config.GetFloat64(section, option)
+	if err != nil {
+		err = fmt.Errorf("Invalid %s in %s section. Got %q", option, section, value)
+	}
+	return
+}
+
+type metricsConfig struct {
+	listen string
+	path   string
+}
+
+/*
+Create the metrics settings from the optional [metrics] section.
+*/
+func newMetricsConfig(config *conf.ConfigFile) (m metricsConfig, err error) {
+	if !config.HasSection("metrics") {
+		return m, fmt.Errorf("Missing metrics section in configuration file.")
+	}
+	m = metricsConfig{
+		listen: ":9100",
+		path:   "/metrics",
+	}
+	if config.HasOption("metrics", "listen") {
+		m.listen, _ = config.GetString("metrics", "listen")
+	}
+	if config.HasOption("metrics", "path") {
+		m.path, _ = config.GetString("metrics", "path")
+	}
+	return
+}
+
+type healthConfig struct {
+	listen string
+}
+
+/*
+Create the health check settings from the optional [health] section.
+*/
+func newHealthConfig(config *conf.ConfigFile) (h healthConfig, err error) {
+	if !config.HasSection("health") {
+		return h, fmt.Errorf("Missing health section in configuration file.")
+	}
+	h = healthConfig{listen: ":8080"}
+	if config.HasOption("health", "listen") {
+		h.listen, _ = config.GetString("health", "listen")
+	}
+	return
+}
+
+type adminConfig struct {
+	listen string
+}
+
+/*
+Create the admin server settings from the optional [admin] section.
+
+The admin server can pause and resume queues, so it only listens
+on localhost unless listen is set.
+*/
+func newAdminConfig(config *conf.ConfigFile) (a adminConfig, err error) {
+	if !config.HasSection("admin") {
+		return a, fmt.Errorf("Missing admin section in configuration file.")
+	}
+	a = adminConfig{listen: "127.0.0.1:8081"}
+	if config.HasOption("admin", "listen") {
+		a.listen, _ = config.GetString("admin", "listen")
+	}
 	return
 }
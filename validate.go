@@ -0,0 +1,230 @@
+package consumer
+
+import (
+	"code.google.com/p/goconf/conf"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+A problem found in a configuration file by ValidateConfig.
+
+Warnings are for settings that are ignored, such as misspelled
+options. Anything else will stop a consumer from starting or
+be rejected by the broker.
+*/
+type ConfigProblem struct {
+	Section string
+	Option  string
+	Message string
+	Warning bool
+}
+
+func (p ConfigProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	switch {
+	case p.Option != "":
+		return fmt.Sprintf("%s: [%s] %s: %s", level, p.Section, p.Option, p.Message)
+	case p.Section != "":
+		return fmt.Sprintf("%s: [%s] %s", level, p.Section, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", level, p.Message)
+}
+
+type optionKind int
+
+const (
+	stringOption optionKind = iota
+	boolOption
+	intOption
+	floatOption
+	durationOption
+)
+
+var knownOptions = map[string]map[string]optionKind{
+	"connection": {
+		"host":     stringOption,
+		"vhost":    stringOption,
+		"user":     stringOption,
+		"password": stringOption,
+		"port":     intOption,
+	},
+	"exchange": {
+		"name":        stringOption,
+		"type":        stringOption,
+		"durable":     boolOption,
+		"auto_delete": boolOption,
+	},
+	"queue": {
+		"name":                      stringOption,
+		"durable":                   boolOption,
+		"auto_delete":               boolOption,
+		"exclusive":                 boolOption,
+		"routing_key":               stringOption,
+		"requeue":                   boolOption,
+		"handler_timeout":           durationOption,
+		"max_decompressed_size":     intOption,
+		"workers":                   intOption,
+		"rate_limit":                floatOption,
+		"burst":                     intOption,
+		"prefetch":                  intOption,
+		"partitions":                intOption,
+		"partition_key":             stringOption,
+		"batch_size":                intOption,
+		"batch_timeout":             durationOption,
+		"breaker_failure_threshold": intOption,
+		"breaker_window":            durationOption,
+		"breaker_cooldown":          durationOption,
+	},
+	"metrics": {
+		"listen": stringOption,
+		"path":   stringOption,
+	},
+	"health": {
+		"listen": stringOption,
+	},
+	"admin": {
+		"listen": stringOption,
+	},
+}
+
+var exchangeKinds = map[string]bool{
+	"direct":  true,
+	"fanout":  true,
+	"topic":   true,
+	"headers": true,
+}
+
+/*
+Check a configuration file more strictly than NewTopology.
+
+As well as the errors NewTopology returns, unknown sections
+and options, values that can't be parsed, unknown exchange types
+and queues or exchanges that are configured more than once are
+reported. Problems are sorted by section and then option, followed
+by problems with the topology as a whole.
+*/
+func ValidateConfig(config *conf.ConfigFile) (problems []ConfigProblem) {
+	top, err := NewTopology(config)
+	if err != nil {
+		problems = append(problems, ConfigProblem{Message: err.Error()})
+	}
+
+	defaults := map[string]bool{}
+	defaultOptions, _ := config.GetOptions("default")
+	for _, option := range defaultOptions {
+		defaults[option] = true
+	}
+
+	sections := config.GetSections()
+	sort.Strings(sections)
+	for _, section := range sections {
+		if section == "default" {
+			continue
+		}
+		known, ok := knownOptions[sectionKind(section)]
+		if !ok {
+			problems = append(problems, ConfigProblem{
+				Section: section,
+				Message: "Unknown section. It will be ignored.",
+				Warning: true,
+			})
+			continue
+		}
+		options, _ := config.GetOptions(section)
+		sort.Strings(options)
+		for _, option := range options {
+			if defaults[option] {
+				continue
+			}
+			kind, ok := known[option]
+			if !ok {
+				problems = append(problems, ConfigProblem{
+					Section: section,
+					Option:  option,
+					Message: "Unknown option. It will be ignored.",
+					Warning: true,
+				})
+				continue
+			}
+			if err := checkOption(config, section, option, kind); err != nil {
+				problems = append(problems, ConfigProblem{Section: section, Option: option, Message: err.Error()})
+			}
+		}
+	}
+
+	return append(problems, checkTopology(top)...)
+}
+
+/*
+Get the kind of a section, ignoring any suffix used
+to pair exchanges and queues.
+*/
+func sectionKind(section string) string {
+	for _, prefix := range []string{"exchange", "queue"} {
+		if strings.HasPrefix(section, prefix) {
+			return prefix
+		}
+	}
+	return section
+}
+
+func checkOption(config *conf.ConfigFile, section, option string, kind optionKind) (err error) {
+	value, _ := config.GetString(section, option)
+	switch kind {
+	case boolOption:
+		_, err = config.GetBool(section, option)
+	case intOption:
+		_, err = config.GetInt(section, option)
+	case floatOption:
+		_, err = config.GetFloat64(section, option)
+	case durationOption:
+		_, err = getDuration(config, section, option)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value %q.", value)
+	}
+	if option == "port" {
+		port, _ := config.GetInt(section, option)
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("Invalid value %q. Must be between 1 and 65535.", value)
+		}
+	}
+	return nil
+}
+
+/*
+Check the exchanges and queues a topology would declare.
+*/
+func checkTopology(top topology) (problems []ConfigProblem) {
+	exchanges := map[string]exchange{}
+	queues := map[string]int{}
+	for _, b := range top.Bindings() {
+		ex := b.Exchange()
+		if !exchangeKinds[ex.kind] && !strings.HasPrefix(ex.kind, "x-") {
+			problems = append(problems, ConfigProblem{
+				Message: fmt.Sprintf("Exchange %q has unknown type %q.", ex.name, ex.kind),
+			})
+		}
+		if seen, ok := exchanges[ex.name]; ok && seen != ex {
+			problems = append(problems, ConfigProblem{
+				Message: fmt.Sprintf("Exchange %q is configured more than once with different settings.", ex.name),
+			})
+		}
+		exchanges[ex.name] = ex
+		queues[b.Queue().name]++
+	}
+
+	for _, name := range sortedKeys(queues) {
+		if queues[name] > 1 {
+			problems = append(problems, ConfigProblem{
+				Message: fmt.Sprintf("Queue %q is configured %d times. Each queue can only be consumed once.", name, queues[name]),
+			})
+		}
+	}
+	return
+}
@@ -0,0 +1,91 @@
+package consumer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigValid(t *testing.T) {
+	if problems := ValidateConfig(newConfig(multiQueue)); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestValidateConfigTopologyError(t *testing.T) {
+	problems := ValidateConfig(newConfig(""))
+	if len(problems) != 1 || problems[0].Warning {
+		t.Fatalf("Expected one error, got %v", problems)
+	}
+	if !strings.Contains(problems[0].String(), "Missing connection section") {
+		t.Errorf("Wrong message %s", problems[0])
+	}
+}
+
+func TestValidateConfigUnknownOptions(t *testing.T) {
+	ini := `
+[connection]
+virtual_host = /
+
+[exchange]
+name = events
+
+[queue]
+name = events
+workers = many
+breaker_window = soon
+
+[stats]
+listen = :9000
+`
+	problems := ValidateConfig(newConfig(ini))
+	expected := []string{
+		"warning: [connection] virtual_host: Unknown option. It will be ignored.",
+		`error: [queue] breaker_window: Invalid value "soon".`,
+		`error: [queue] workers: Invalid value "many".`,
+		"warning: [stats] Unknown section. It will be ignored.",
+	}
+	var got []string
+	for _, p := range problems {
+		if p.Section != "" {
+			got = append(got, p.String())
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong problems:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestValidateConfigTopologyChecks(t *testing.T) {
+	ini := `
+[connection]
+port = 99999
+
+[exchange-a]
+name = events
+type = topic
+
+[queue-a]
+name = events
+
+[exchange-b]
+name = events
+type = bogus
+
+[queue-b]
+name = events
+`
+	problems := ValidateConfig(newConfig(ini))
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	expected := []string{
+		`error: [connection] port: Invalid value "99999". Must be between 1 and 65535.`,
+		`error: Exchange "events" has unknown type "bogus".`,
+		`error: Exchange "events" is configured more than once with different settings.`,
+		`error: Queue "events" is configured 2 times. Each queue can only be consumed once.`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Wrong problems:\n%s", strings.Join(got, "\n"))
+	}
+}